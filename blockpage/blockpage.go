@@ -0,0 +1,454 @@
+package blockpage
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed fingerprints.json
+var defaultFingerprints []byte
+
+// Fingerprint describes a known blockpage. A page matches when every regex
+// that is set matches: BodyRegex against the body, TitleRegex against the
+// <title>, and HeaderRegex against the value of the Header header.
+type Fingerprint struct {
+	Name        string `json:"name"`
+	Country     string `json:"country,omitempty"`
+	BodyRegex   string `json:"body_regex,omitempty"`
+	TitleRegex  string `json:"title_regex,omitempty"`
+	Header      string `json:"header,omitempty"`
+	HeaderRegex string `json:"header_regex,omitempty"`
+
+	body   *regexp.Regexp
+	title  *regexp.Regexp
+	header *regexp.Regexp
+}
+
+// compile checks and compiles each of the regexes that are set
+func (fp *Fingerprint) compile() error {
+	var err error
+	if len(fp.BodyRegex) > 0 {
+		if fp.body, err = regexp.Compile(fp.BodyRegex); err != nil {
+			return fmt.Errorf("%s body_regex: %v", fp.Name, err)
+		}
+	}
+	if len(fp.TitleRegex) > 0 {
+		if fp.title, err = regexp.Compile(fp.TitleRegex); err != nil {
+			return fmt.Errorf("%s title_regex: %v", fp.Name, err)
+		}
+	}
+	if len(fp.HeaderRegex) > 0 {
+		if len(fp.Header) == 0 {
+			return fmt.Errorf("%s has a header_regex but no header", fp.Name)
+		}
+		if fp.header, err = regexp.Compile(fp.HeaderRegex); err != nil {
+			return fmt.Errorf("%s header_regex: %v", fp.Name, err)
+		}
+	}
+	if fp.body == nil && fp.title == nil && fp.header == nil {
+		return fmt.Errorf("%s has nothing to match", fp.Name)
+	}
+
+	return nil
+}
+
+// Matches returns true if page matches every regex in fp
+func (fp *Fingerprint) Matches(page *Page) bool {
+	if fp.body != nil && !fp.body.Match(page.Body) {
+		return false
+	}
+	if fp.title != nil && !fp.title.MatchString(page.Title) {
+		return false
+	}
+	if fp.header != nil && !fp.header.MatchString(page.Headers.Get(fp.Header)) {
+		return false
+	}
+
+	return true
+}
+
+// Library is a list of blockpage Fingerprints
+type Library struct {
+	Fingerprints []*Fingerprint
+}
+
+// ParseLibrary reads a JSON array of Fingerprints
+func ParseLibrary(b []byte) (*Library, error) {
+	lib := new(Library)
+	err := json.Unmarshal(b, &lib.Fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range lib.Fingerprints {
+		if err = fp.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return lib, nil
+}
+
+// DefaultLibrary returns the fingerprints shipped with this package
+func DefaultLibrary() *Library {
+	lib, err := ParseLibrary(defaultFingerprints)
+	if err != nil {
+		panic(err)
+	}
+
+	return lib
+}
+
+// LoadLibrary returns the DefaultLibrary with the fingerprints in path added
+func LoadLibrary(path string) (*Library, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fromFile, err := ParseLibrary(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	lib := DefaultLibrary()
+	lib.Fingerprints = append(lib.Fingerprints, fromFile.Fingerprints...)
+
+	return lib, nil
+}
+
+// Match returns the first Fingerprint in lib that page matches
+func (lib *Library) Match(page *Page) (*Fingerprint, bool) {
+	for _, fp := range lib.Fingerprints {
+		if fp.Matches(page) {
+			return fp, true
+		}
+	}
+
+	return nil, false
+}
+
+// Page is the parts of an HTTP response that are compared
+type Page struct {
+	URL        string
+	StatusCode int
+	Title      string
+	Headers    http.Header
+	Body       []byte
+}
+
+var titleRegex = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// getTitle returns the contents of the first <title> in body
+func getTitle(body []byte) string {
+	match := titleRegex.FindSubmatch(body)
+	if match == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(match[1]))
+}
+
+// Result says whether the page served by an IP for a domain is a blockpage
+// and why.
+type Result struct {
+	Blockpage   bool   `json:"blockpage"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+// Checker fetches pages for domains from answered IPs and compares them to
+// the Library and to a control fetch of the same domain. HTTPPort and
+// HTTPSPort default to 80 and 443, and control fetches dial the domain
+// itself. Both can be changed to point at local servers.
+type Checker struct {
+	Library   *Library
+	Timeout   time.Duration
+	HTTPPort  string
+	HTTPSPort string
+	// MaxBody is how many bytes of a body are read, 1 MiB when 0
+	MaxBody int64
+	// ControlAddr, if set, is dialed for control fetches instead of the
+	// domain (e.g. "127.0.0.1" for a local server)
+	ControlAddr string
+	// ControlHTTPPort and ControlHTTPSPort are the ports of control fetches,
+	// HTTPPort and HTTPSPort when empty
+	ControlHTTPPort  string
+	ControlHTTPSPort string
+	// Logger, if set, logs the control fetches that failed, whose domains
+	// are then only checked against the Library
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	controls map[string]*Page
+}
+
+// NewChecker returns a Checker using lib with default ports and timeout
+func NewChecker(lib *Library) *Checker {
+	return &Checker{
+		Library:   lib,
+		Timeout:   10 * time.Second,
+		HTTPPort:  "80",
+		HTTPSPort: "443",
+	}
+}
+
+func (c *Checker) port(scheme string) string {
+	if scheme == "https" {
+		if len(c.HTTPSPort) == 0 {
+			return "443"
+		}
+		return c.HTTPSPort
+	}
+	if len(c.HTTPPort) == 0 {
+		return "80"
+	}
+
+	return c.HTTPPort
+}
+
+// controlPort is the port control fetches for scheme go to
+func (c *Checker) controlPort(scheme string) string {
+	if scheme == "https" && len(c.ControlHTTPSPort) > 0 {
+		return c.ControlHTTPSPort
+	}
+	if scheme == "http" && len(c.ControlHTTPPort) > 0 {
+		return c.ControlHTTPPort
+	}
+
+	return c.port(scheme)
+}
+
+// Fetch requests scheme://domain/ from host (an IP or a name), without
+// following redirects and without verifying certificates, blockpages rarely
+// have valid ones.
+func (c *Checker) Fetch(
+	ctx context.Context, scheme, domain, host string,
+) (*Page, error) {
+	return c.fetch(ctx, scheme, domain, net.JoinHostPort(host, c.port(scheme)))
+}
+
+// fetch requests scheme://domain/ from addr, a host and port
+func (c *Checker) fetch(
+	ctx context.Context, scheme, domain, addr string,
+) (*Page, error) {
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	client := &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{
+				ServerName:         domain,
+				InsecureSkipVerify: true,
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	pageURL := fmt.Sprintf("%s://%s/", scheme, domain)
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	maxBody := c.MaxBody
+	if maxBody <= 0 {
+		maxBody = 1 << 20
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Page{
+		URL:        pageURL,
+		StatusCode: resp.StatusCode,
+		Title:      getTitle(body),
+		Headers:    resp.Header,
+		Body:       body,
+	}, nil
+}
+
+// control returns the control page for scheme://domain/, fetched once and
+// then kept for later checks. A failed fetch isn't kept, the next check of
+// the domain tries again.
+func (c *Checker) control(
+	ctx context.Context, scheme, domain string,
+) (*Page, error) {
+	key := scheme + "://" + domain
+	c.mu.Lock()
+	if c.controls == nil {
+		c.controls = make(map[string]*Page)
+	}
+	page, ok := c.controls[key]
+	c.mu.Unlock()
+	if ok {
+		return page, nil
+	}
+
+	host := domain
+	if len(c.ControlAddr) > 0 {
+		host = c.ControlAddr
+	}
+	page, err := c.fetch(
+		ctx, scheme, domain, net.JoinHostPort(host, c.controlPort(scheme)),
+	)
+	if err != nil {
+		if c.Logger != nil {
+			c.Logger.Printf(
+				"control fetch of %s failed, not comparing to it: %v\n", key, err,
+			)
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.controls[key] = page
+	c.mu.Unlock()
+
+	return page, nil
+}
+
+// statusClass puts 2xx and 3xx responses in one class, fetches don't follow
+// redirects so a server redirecting where the control served the page (or
+// the other way around) is still the same site. Other codes are their own
+// hundred.
+func statusClass(code int) int {
+	if code >= 200 && code < 400 {
+		return 200
+	}
+
+	return code / 100 * 100
+}
+
+// isRedirect is true for 3xx responses
+func isRedirect(page *Page) bool {
+	return page.StatusCode >= 300 && page.StatusCode < 400
+}
+
+// redirectHost is the host a redirect's Location points to, "" when there
+// is none
+func redirectHost(page *Page) string {
+	u, err := url.Parse(page.Headers.Get("Location"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// differs compares a page to the control page for the same URL the way OONI's
+// web connectivity does: a body less than 70% the size of the control with a
+// different title. A different status code only counts along with a
+// different body or title. When both are redirects they are compared by the
+// host they redirect to, and a redirect where the control served the page (or
+// the other way around) isn't compared, its body says nothing.
+func differs(page, control *Page) (bool, string) {
+	if isRedirect(page) && isRedirect(control) {
+		host, controlHost := redirectHost(page), redirectHost(control)
+		if host != controlHost {
+			return true, fmt.Sprintf(
+				"redirects to %q, control redirects to %q", host, controlHost,
+			)
+		}
+		return false, ""
+	}
+	if isRedirect(page) != isRedirect(control) &&
+		statusClass(page.StatusCode) == statusClass(control.StatusCode) {
+		return false, ""
+	}
+
+	small, large := len(page.Body), len(control.Body)
+	if small > large {
+		small, large = large, small
+	}
+	smaller := large > 0 && float64(small)/float64(large) < 0.7
+	retitled := page.Title != control.Title
+	if statusClass(page.StatusCode) != statusClass(control.StatusCode) &&
+		(smaller || retitled) {
+		return true, fmt.Sprintf(
+			"status %d with title %q, control had %d with title %q",
+			page.StatusCode, page.Title, control.StatusCode, control.Title,
+		)
+	}
+	if smaller && retitled {
+		return true, fmt.Sprintf(
+			"body is %d bytes with title %q, control is %d bytes with title %q",
+			len(page.Body), page.Title, len(control.Body), control.Title,
+		)
+	}
+
+	return false, ""
+}
+
+// Check fetches http and https pages for domain from ip and labels them as a
+// blockpage if either matches a fingerprint or differs from the control.
+func (c *Checker) Check(ctx context.Context, domain string, ip net.IP) Result {
+	var reasons []string
+	for _, scheme := range []string{"http", "https"} {
+		page, err := c.Fetch(ctx, scheme, domain, ip.String())
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", scheme, err))
+			continue
+		}
+		if fp, ok := c.Library.Match(page); ok {
+			return Result{
+				Blockpage:   true,
+				Fingerprint: fp.Name,
+				URL:         page.URL,
+				Reason:      fmt.Sprintf("matched fingerprint %s", fp.Name),
+			}
+		}
+		control, err := c.control(ctx, scheme, domain)
+		if err != nil {
+			reasons = append(
+				reasons, fmt.Sprintf("%s: no control, %v", scheme, err),
+			)
+			continue
+		}
+		if different, why := differs(page, control); different {
+			return Result{
+				Blockpage: true,
+				URL:       page.URL,
+				Reason:    fmt.Sprintf("differs from control: %s", why),
+			}
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: matches control", scheme))
+	}
+
+	return Result{Reason: strings.Join(reasons, ", ")}
+}
+
+// CheckAny checks each of ips in turn and stops at the first blockpage. It
+// fits classify.Classifier's Blockpage field.
+func (c *Checker) CheckAny(
+	ctx context.Context, domain string, ips []net.IP,
+) (bool, string) {
+	for _, ip := range ips {
+		result := c.Check(ctx, domain, ip)
+		if result.Blockpage {
+			return true, fmt.Sprintf("%s served a blockpage, %s", ip, result.Reason)
+		}
+	}
+
+	return false, ""
+}
@@ -0,0 +1,236 @@
+package blockpage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDomain = "example.com"
+
+// realSite is what the control (and an honest server) serves
+const realSite = `<html><head><title>Example Domain</title></head><body>` +
+	`This domain is for use in illustrative examples in documents, ` +
+	`you may use it without asking for permission.</body></html>`
+
+// serve returns a handler answering every request with status and body
+func serve(status int, body string, headers map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+}
+
+// port returns the port a test server listens on
+func port(t *testing.T, srv *httptest.Server) string {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", srv.URL, err)
+	}
+
+	return u.Port()
+}
+
+// closedPort returns a local port nothing is listening on
+func closedPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	return p
+}
+
+// testLibrary has one fingerprint, for the test blockpage
+func testLibrary(t *testing.T) *Library {
+	lib, err := ParseLibrary([]byte(
+		`[{"name": "test block", "body_regex": "blocked by the test ministry"}]`,
+	))
+	if err != nil {
+		t.Fatalf("ParseLibrary: %v", err)
+	}
+
+	return lib
+}
+
+// newTestChecker points every fetch at local servers: the answered IP's
+// pages at page and the control's at control, either can be nil to have
+// nothing listening. https servers are TLS ones.
+func newTestChecker(t *testing.T, page, control *httptest.Server, https bool) *Checker {
+	c := NewChecker(testLibrary(t))
+	c.Timeout = 2 * time.Second
+	c.ControlAddr = "127.0.0.1"
+	c.HTTPPort, c.HTTPSPort = closedPort(t), closedPort(t)
+	c.ControlHTTPPort, c.ControlHTTPSPort = closedPort(t), closedPort(t)
+	if page != nil {
+		if https {
+			c.HTTPSPort = port(t, page)
+		} else {
+			c.HTTPPort = port(t, page)
+		}
+	}
+	if control != nil {
+		if https {
+			c.ControlHTTPSPort = port(t, control)
+		} else {
+			c.ControlHTTPPort = port(t, control)
+		}
+	}
+
+	return c
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		https       bool
+		page        http.Handler
+		control     http.Handler
+		blockpage   bool
+		fingerprint string
+		reason      string
+	}{
+		{
+			name:        "fingerprint match",
+			page:        serve(200, "<html>This site was blocked by the test ministry</html>", nil),
+			control:     serve(200, realSite, nil),
+			blockpage:   true,
+			fingerprint: "test block",
+			reason:      "matched fingerprint",
+		},
+		{
+			name:      "body and title differ",
+			page:      serve(200, "<html><title>Forbidden</title>no</html>", nil),
+			control:   serve(200, realSite, nil),
+			blockpage: true,
+			reason:    "differs from control: body is",
+		},
+		{
+			name:      "body and title differ over https",
+			https:     true,
+			page:      serve(200, "<html><title>Forbidden</title>no</html>", nil),
+			control:   serve(200, realSite, nil),
+			blockpage: true,
+			reason:    "differs from control: body is",
+		},
+		{
+			name:      "status and title differ",
+			page:      serve(403, "<html><title>Access denied</title>"+realSite+"</html>", nil),
+			control:   serve(200, realSite, nil),
+			blockpage: true,
+			reason:    "differs from control: status 403",
+		},
+		{
+			name:    "same page",
+			page:    serve(200, realSite, nil),
+			control: serve(200, realSite, nil),
+			reason:  "http: matches control",
+		},
+		{
+			name: "redirect where the control served the page",
+			page: serve(301, "<html><title>301 Moved</title></html>", map[string]string{
+				"Location": "https://www.example.com/",
+			}),
+			control: serve(200, realSite, nil),
+			reason:  "http: matches control",
+		},
+		{
+			name:    "page where the control redirected",
+			page:    serve(200, realSite, nil),
+			control: serve(302, "", map[string]string{"Location": "https://example.com/"}),
+			reason:  "http: matches control",
+		},
+		{
+			name:      "redirect to another host",
+			page:      serve(302, "", map[string]string{"Location": "http://block.example.net/"}),
+			control:   serve(302, "", map[string]string{"Location": "https://example.com/"}),
+			blockpage: true,
+			reason:    "redirects to \"block.example.net\"",
+		},
+		{
+			name:   "control failure",
+			page:   serve(200, "<html><title>Forbidden</title>no</html>", nil),
+			reason: "http: no control",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newServer := httptest.NewServer
+			if test.https {
+				newServer = httptest.NewTLSServer
+			}
+			page := newServer(test.page)
+			defer page.Close()
+			var control *httptest.Server
+			if test.control != nil {
+				control = newServer(test.control)
+				defer control.Close()
+			}
+			c := newTestChecker(t, page, control, test.https)
+
+			result := c.Check(context.Background(), testDomain, net.ParseIP("127.0.0.1"))
+			if result.Blockpage != test.blockpage {
+				t.Errorf("Blockpage = %v, want %v (%s)", result.Blockpage, test.blockpage, result.Reason)
+			}
+			if result.Fingerprint != test.fingerprint {
+				t.Errorf("Fingerprint = %q, want %q", result.Fingerprint, test.fingerprint)
+			}
+			if !strings.Contains(result.Reason, test.reason) {
+				t.Errorf("Reason = %q, want it to contain %q", result.Reason, test.reason)
+			}
+		})
+	}
+}
+
+// TestControlFailureNotKept checks a failed control fetch is tried again by
+// the next check instead of skipping the comparison for the rest of the run
+func TestControlFailureNotKept(t *testing.T) {
+	page := httptest.NewServer(serve(200, "<html><title>Forbidden</title>no</html>", nil))
+	defer page.Close()
+	c := newTestChecker(t, page, nil, false)
+	ip := net.ParseIP("127.0.0.1")
+
+	if result := c.Check(context.Background(), testDomain, ip); result.Blockpage {
+		t.Fatalf("blockpage without a control: %s", result.Reason)
+	}
+
+	control := httptest.NewServer(serve(200, realSite, nil))
+	defer control.Close()
+	c.ControlHTTPPort = port(t, control)
+	result := c.Check(context.Background(), testDomain, ip)
+	if !result.Blockpage {
+		t.Fatalf("control wasn't fetched again: %s", result.Reason)
+	}
+}
+
+// TestControlCanceled checks a control fetch cut short by the context isn't
+// kept either
+func TestControlCanceled(t *testing.T) {
+	control := httptest.NewServer(serve(200, realSite, nil))
+	defer control.Close()
+	c := newTestChecker(t, nil, control, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.control(ctx, "http", testDomain); err == nil {
+		t.Fatalf("control fetch with a canceled context succeeded")
+	}
+	page, err := c.control(context.Background(), "http", testDomain)
+	if err != nil || page == nil {
+		t.Fatalf("control fetch after a canceled one: %v", err)
+	}
+	if page.Title != "Example Domain" {
+		t.Errorf("control title = %q, want %q", page.Title, "Example Domain")
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/timartiny/RipeProbe/blockpage
+
+go 1.16
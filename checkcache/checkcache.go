@@ -0,0 +1,184 @@
+package checkcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// key is a (domain, ip) pair
+type key struct {
+	domain string
+	ip     string
+}
+
+// call is a check that is running, goroutines asking for the same key wait
+// on done instead of running their own.
+type call struct {
+	done  chan struct{}
+	valid bool
+	err   error
+}
+
+// Stats are how often a Cache has been asked for a result and how each
+// request was answered.
+type Stats struct {
+	Entries int `json:"entries"`
+	// Hits were answered from a stored result
+	Hits int `json:"hits"`
+	// Misses ran the check
+	Misses int `json:"misses"`
+	// Shared waited for the same check already running in another goroutine
+	Shared int `json:"shared"`
+}
+
+// Cache stores whether an IP is valid for a domain. It is safe for
+// concurrent use, and a check for a (domain, ip) pair is only ever running
+// once at a time, everyone else asking waits for that result.
+type Cache struct {
+	mu       sync.Mutex
+	entries  map[key]bool
+	inflight map[key]*call
+	stats    Stats
+}
+
+// New returns an empty Cache
+func New() *Cache {
+	return &Cache{
+		entries:  make(map[key]bool),
+		inflight: make(map[key]*call),
+	}
+}
+
+// Load returns a Cache holding the results saved in path, or an empty one if
+// path doesn't exist yet.
+func Load(path string) (*Cache, error) {
+	c := New()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved map[string]map[string]bool
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return nil, err
+	}
+	for domain, ips := range saved {
+		for ip, valid := range ips {
+			c.entries[key{domain, ip}] = valid
+		}
+	}
+
+	return c, nil
+}
+
+// Save writes every stored result to path as JSON ({domain: {ip: valid}}).
+// The file is written next to path and then renamed so an interrupted Save
+// doesn't lose the previous one, it keeps the previous file's mode (0644 for a
+// new file).
+func (c *Cache) Save(path string) error {
+	saved := make(map[string]map[string]bool)
+	c.mu.Lock()
+	for k, valid := range c.entries {
+		if saved[k.domain] == nil {
+			saved[k.domain] = make(map[string]bool)
+		}
+		saved[k.domain][k.ip] = valid
+	}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// TempFile creates the file 0600, keep the mode of the file being
+	// replaced instead
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns the stored result for domain and ip, false if there isn't one
+func (c *Cache) Get(domain string, ip net.IP) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	valid, ok := c.entries[key{domain, ip.String()}]
+
+	return valid, ok
+}
+
+// Do returns the stored result for domain and ip, if there isn't one it runs
+// check (or waits for the goroutine already running it) and stores the result.
+// When check returns an error (e.g. it was cancelled) nothing is stored, so the
+// pair is checked again next time.
+func (c *Cache) Do(
+	domain string, ip net.IP, check func() (bool, error),
+) (bool, error) {
+	k := key{domain, ip.String()}
+	c.mu.Lock()
+	if valid, ok := c.entries[k]; ok {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return valid, nil
+	}
+	if cl, ok := c.inflight[k]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		<-cl.done
+		return cl.valid, cl.err
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[k] = cl
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	cl.valid, cl.err = check()
+
+	c.mu.Lock()
+	if cl.err == nil {
+		c.entries[k] = cl.valid
+	}
+	delete(c.inflight, k)
+	c.mu.Unlock()
+	close(cl.done)
+
+	return cl.valid, cl.err
+}
+
+// Stats returns the number of stored results and how requests were answered
+// so far.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := c.stats
+	ret.Entries = len(c.entries)
+
+	return ret
+}
@@ -0,0 +1,155 @@
+package checkcache
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestDoRunsCheckOnce checks goroutines asking for the same pair at once
+// share a single run of the check
+func TestDoRunsCheckOnce(t *testing.T) {
+	c := New()
+	ip := net.ParseIP("192.0.2.1")
+	release := make(chan struct{})
+	var runs int32
+	check := func() (bool, error) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return true, nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	results := make([]bool, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			valid, err := c.Do("example.com", ip, check)
+			if err != nil {
+				t.Errorf("Do: %v", err)
+			}
+			results[i] = valid
+		}(i)
+	}
+	// let every caller get to the cache before the check finishes
+	for {
+		s := c.Stats()
+		if s.Misses+s.Shared == callers {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if runs != 1 {
+		t.Errorf("check ran %d times, want 1", runs)
+	}
+	for i, valid := range results {
+		if !valid {
+			t.Errorf("caller %d got invalid", i)
+		}
+	}
+	if s := c.Stats(); s.Misses != 1 || s.Shared != callers-1 || s.Entries != 1 {
+		t.Errorf("Stats = %+v, want 1 miss, %d shared and 1 entry", s, callers-1)
+	}
+	if _, err := c.Do("example.com", ip, check); err != nil || runs != 1 {
+		t.Errorf("a stored result was checked again")
+	}
+	if s := c.Stats(); s.Hits != 1 {
+		t.Errorf("Hits = %d, want 1", s.Hits)
+	}
+}
+
+// TestCanceledCheckNotStored checks a check that fails is run again next time
+func TestCanceledCheckNotStored(t *testing.T) {
+	c := New()
+	ip := net.ParseIP("192.0.2.1")
+	_, err := c.Do("example.com", ip, func() (bool, error) {
+		return false, context.Canceled
+	})
+	if err != context.Canceled {
+		t.Fatalf("Do returned %v, want %v", err, context.Canceled)
+	}
+	if _, ok := c.Get("example.com", ip); ok {
+		t.Fatalf("a canceled check was stored")
+	}
+
+	valid, err := c.Do("example.com", ip, func() (bool, error) {
+		return true, nil
+	})
+	if err != nil || !valid {
+		t.Errorf("Do after cancel = %v, %v, want true", valid, err)
+	}
+	if s := c.Stats(); s.Misses != 2 || s.Entries != 1 {
+		t.Errorf("Stats = %+v, want 2 misses and 1 entry", s)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load of a missing file: %v", err)
+	}
+	pairs := []struct {
+		domain string
+		ip     string
+		valid  bool
+	}{
+		{"example.com", "192.0.2.1", true},
+		{"example.com", "2001:db8::1", false},
+		{"example.org", "192.0.2.1", false},
+	}
+	for _, p := range pairs {
+		valid := p.valid
+		c.Do(p.domain, net.ParseIP(p.ip), func() (bool, error) {
+			return valid, nil
+		})
+	}
+	if err = c.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("new cache has mode %v, want 0644", fi.Mode().Perm())
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if s := loaded.Stats(); s.Entries != len(pairs) {
+		t.Errorf("loaded %d entries, want %d", s.Entries, len(pairs))
+	}
+	for _, p := range pairs {
+		valid, ok := loaded.Get(p.domain, net.ParseIP(p.ip))
+		if !ok || valid != p.valid {
+			t.Errorf("%s %s: got %v (stored %v), want %v", p.domain, p.ip, valid, ok, p.valid)
+		}
+	}
+
+	// saving again keeps the mode the file has
+	if err = os.Chmod(path, 0640); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err = loaded.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if fi, err = os.Stat(path); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("saved cache has mode %v, want 0640", fi.Mode().Perm())
+	}
+}
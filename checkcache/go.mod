@@ -0,0 +1,3 @@
+module github.com/timartiny/RipeProbe/checkcache
+
+go 1.16
@@ -0,0 +1,287 @@
+package classify
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	fingerprint "github.com/timartiny/RipeProbe/fingerprint"
+)
+
+// Category is one outcome in the fixed taxonomy every analysis tool sorts DNS
+// responses into.
+type Category int
+
+const (
+	Unclassified Category = iota
+	ValidTLS
+	ConsistentASN
+	InvalidIP
+	Blockpage
+	BogonIP
+	KnownInjection
+	NXDomain
+	ServFail
+	Refused
+	EmptyNoError
+	Referral
+	Timeout
+	Malformed
+)
+
+// Categories lists every Category a Classifier can return, in the order they
+// should be reported.
+var Categories = []Category{
+	ValidTLS,
+	ConsistentASN,
+	InvalidIP,
+	Blockpage,
+	BogonIP,
+	KnownInjection,
+	NXDomain,
+	ServFail,
+	Refused,
+	EmptyNoError,
+	Referral,
+	Timeout,
+	Malformed,
+}
+
+var categoryNames = map[Category]string{
+	Unclassified:   "unclassified",
+	ValidTLS:       "valid-tls",
+	ConsistentASN:  "consistent-asn",
+	InvalidIP:      "invalid-ip",
+	Blockpage:      "blockpage",
+	BogonIP:        "bogon-ip",
+	KnownInjection: "known-injection",
+	NXDomain:       "nxdomain",
+	ServFail:       "servfail",
+	Refused:        "refused",
+	EmptyNoError:   "empty-noerror",
+	Referral:       "referral",
+	Timeout:        "timeout",
+	Malformed:      "malformed",
+}
+
+func (c Category) String() string {
+	if name, ok := categoryNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("category(%d)", int(c))
+}
+
+// Valid returns true for the Categories that count as a correct answer
+func (c Category) Valid() bool {
+	return c == ValidTLS || c == ConsistentASN
+}
+
+// MarshalText lets a Category be used as a JSON value and map key.
+func (c Category) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText reads back a Category written by MarshalText
+func (c *Category) UnmarshalText(text []byte) error {
+	for cat, name := range categoryNames {
+		if name == string(text) {
+			*c = cat
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown category: %s", text)
+}
+
+// Response is what a single probe got back from a resolver for one domain, as
+// stored in results.QueryResult. RCode is the response code of the DNS
+// message, when it is empty NOERROR is assumed.
+type Response struct {
+	Domain  string
+	Answers []string
+	RCode   string
+}
+
+// Result is the Category a Response falls in and a human readable reason.
+type Result struct {
+	Category Category `json:"category"`
+	Reason   string   `json:"reason"`
+}
+
+// Classifier sorts Responses into Categories. Answered addresses are first
+// matched against Fingerprints (fingerprint.Default() when nil), only those
+// that don't match are passed to Verify, which is asked whether any of them
+// serves a valid certificate for the domain. When Verify is nil every
+// unmatched address is counted as an InvalidIP. If none of them are valid
+// and Consistent is set it is asked whether they line up with control answers
+// for the domain (e.g. the same ASN), then if Blockpage is set it is asked
+// whether any of them serve a blockpage.
+type Classifier struct {
+	Fingerprints *fingerprint.Database
+	Verify       func(domain string, ips []net.IP) bool
+	Consistent   func(domain string, ips []net.IP) (bool, string)
+	Blockpage    func(domain string, ips []net.IP) (bool, string)
+}
+
+// defaultFingerprints is used by Classifiers without their own Fingerprints
+var defaultFingerprints = fingerprint.Default()
+
+// fingerprints returns the database to match addresses against
+func (c *Classifier) fingerprints() *fingerprint.Database {
+	if c.Fingerprints == nil {
+		return defaultFingerprints
+	}
+
+	return c.Fingerprints
+}
+
+// Classify returns the Category of r. The order matters: a timeout or error
+// from the probe beats everything, then the response code, then the
+// addresses, then the authority section.
+func (c *Classifier) Classify(r Response) Result {
+	answers := Parse(r.Answers)
+	switch {
+	case answers.Timeout:
+		return Result{Timeout, fmt.Sprintf("probe reported %s", answers.Errors[0])}
+	case len(answers.Errors) > 0:
+		return Result{
+			Malformed,
+			fmt.Sprintf("probe reported %s", strings.Join(answers.Errors, ", ")),
+		}
+	case answers.Empty():
+		return Result{Malformed, "no answers were recorded"}
+	}
+
+	switch rcode := NormalizeRCode(r.RCode); rcode {
+	case "", "NOERROR":
+	case "NXDOMAIN":
+		return Result{NXDomain, "resolver answered NXDOMAIN"}
+	case "SERVFAIL":
+		return Result{ServFail, "resolver answered SERVFAIL"}
+	case "REFUSED":
+		return Result{Refused, "resolver answered REFUSED"}
+	default:
+		return Result{Malformed, fmt.Sprintf("unexpected rcode %s", rcode)}
+	}
+
+	if len(answers.IPs) > 0 {
+		var routable []net.IP
+		var bogons, injections []string
+		for _, ip := range answers.IPs {
+			fp, ok := c.fingerprints().Match(ip)
+			switch {
+			case !ok:
+				routable = append(routable, ip)
+			case fp.Kind.IsBogon():
+				bogons = append(bogons, fmt.Sprintf("%s (%s)", ip, fp.Label))
+			default:
+				injections = append(
+					injections, fmt.Sprintf("%s (%s %s)", ip, fp.Kind, fp.Label),
+				)
+			}
+		}
+		if len(injections) > 0 {
+			return Result{
+				KnownInjection,
+				fmt.Sprintf(
+					"matched known injection fingerprints: %s",
+					strings.Join(injections, ", "),
+				),
+			}
+		}
+		if len(routable) == 0 {
+			return Result{
+				BogonIP,
+				fmt.Sprintf(
+					"every address is a bogon: %s", strings.Join(bogons, ", "),
+				),
+			}
+		}
+		if c.Verify != nil && c.Verify(r.Domain, routable) {
+			return Result{
+				ValidTLS,
+				fmt.Sprintf("an address served a valid certificate for %s", r.Domain),
+			}
+		}
+		var inconsistent string
+		if c.Consistent != nil {
+			consistent, reason := c.Consistent(r.Domain, routable)
+			if consistent {
+				return Result{ConsistentASN, reason}
+			}
+			inconsistent = ", " + reason
+		}
+		if c.Blockpage != nil {
+			if isBlockpage, reason := c.Blockpage(r.Domain, routable); isBlockpage {
+				return Result{Blockpage, reason}
+			}
+		}
+		return Result{
+			InvalidIP,
+			fmt.Sprintf(
+				"none of %d address(es) served a valid certificate for %s%s",
+				len(routable),
+				r.Domain,
+				inconsistent,
+			),
+		}
+	}
+
+	switch {
+	case len(answers.NSs) > 0:
+		return Result{
+			Referral,
+			fmt.Sprintf("referred to %s", strings.Join(answers.NSs, ", ")),
+		}
+	case answers.Referral:
+		return Result{Referral, "NS records in authority section"}
+	case answers.SOA:
+		return Result{EmptyNoError, "no answer, SOA in authority section"}
+	case answers.NoAnswer:
+		return Result{EmptyNoError, "no answer or authority given"}
+	case answers.NoAddress:
+		return Result{EmptyNoError, "answer section held no addresses"}
+	}
+
+	return Result{
+		Malformed,
+		fmt.Sprintf("unrecognized answer(s): %s", strings.Join(answers.Others, ", ")),
+	}
+}
+
+// Counts tallies how many Responses fell into each Category.
+type Counts map[Category]int
+
+// Add counts one more Response in c
+func (cs Counts) Add(c Category) {
+	cs[c]++
+}
+
+// Merge adds all of other's counts to cs
+func (cs Counts) Merge(other Counts) {
+	for c, n := range other {
+		cs[c] += n
+	}
+}
+
+// Total returns the number of Responses counted
+func (cs Counts) Total() int {
+	var total int
+	for _, n := range cs {
+		total += n
+	}
+
+	return total
+}
+
+// Rate returns the fraction of all the counted Responses in c, 0 when nothing
+// has been counted.
+func (cs Counts) Rate(c Category) float64 {
+	total := cs.Total()
+	if total == 0 {
+		return 0.0
+	}
+
+	return float64(cs[c]) / float64(total)
+}
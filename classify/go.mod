@@ -0,0 +1,7 @@
+module github.com/timartiny/RipeProbe/classify
+
+replace github.com/timartiny/RipeProbe/fingerprint => ../fingerprint
+
+go 1.16
+
+require github.com/timartiny/RipeProbe/fingerprint v0.0.0-00010101000000-000000000000
@@ -0,0 +1,129 @@
+package classify
+
+import (
+	"net"
+	"strings"
+)
+
+// noAnswer is what whiteboardresults records when a response has neither an
+// answer nor an authority section.
+const noAnswer = "No Answer or Authority Given"
+
+// probeErrorKeys are the keys of the error object RIPE Atlas reports instead
+// of a response. whiteboardresults records the object as a single answer,
+// "<key>: <value>" for each key joined with ", ".
+var probeErrorKeys = []string{"timeout", "getaddrinfo"}
+
+// probeError returns whether answer is a probe error as whiteboardresults
+// records it, and whether the error was a timeout
+func probeError(answer string) (bool, bool) {
+	parts := strings.Split(answer, ", ")
+	var isError, timeout bool
+	for i, part := range parts {
+		for _, key := range probeErrorKeys {
+			if !strings.HasPrefix(part, key+": ") {
+				continue
+			}
+			// only the first part has to be a key, a value can hold ", "
+			if i == 0 {
+				isError = true
+			}
+			if key == "timeout" {
+				timeout = true
+			}
+		}
+	}
+
+	return isError, isError && timeout
+}
+
+// Answers is the list of strings whiteboardresults stores for a response,
+// sorted by what each string is.
+type Answers struct {
+	IPs []net.IP
+	// NSs are name server names from the authority section
+	NSs []string
+	// Referral is set when the authority section held NS records
+	Referral bool
+	// SOA is set when the authority section held an SOA record
+	SOA bool
+	// NoAnswer is set when there was no answer or authority section
+	NoAnswer bool
+	// NoAddress is set when the answer section held records that were not
+	// addresses (e.g. only a CNAME)
+	NoAddress bool
+	Timeout   bool
+	// Errors are the errors RIPE Atlas reported instead of a response
+	Errors []string
+	Others []string
+}
+
+// Empty returns true when nothing at all was recorded
+func (a Answers) Empty() bool {
+	return len(a.IPs) == 0 && len(a.NSs) == 0 && !a.Referral && !a.SOA &&
+		!a.NoAnswer && !a.NoAddress && !a.Timeout && len(a.Errors) == 0 &&
+		len(a.Others) == 0
+}
+
+// isHostname is a loose check that s looks like a domain name
+func isHostname(s string) bool {
+	return strings.Contains(s, ".") && !strings.ContainsAny(s, " :/")
+}
+
+// Parse sorts the strings whiteboardresults recorded for one response
+func Parse(answers []string) Answers {
+	var ret Answers
+	for _, answer := range answers {
+		answer = strings.TrimSpace(answer)
+		isError, timeout := probeError(answer)
+		switch {
+		case len(answer) == 0:
+			continue
+		case net.ParseIP(answer) != nil:
+			ret.IPs = append(ret.IPs, net.ParseIP(answer))
+		case isError:
+			ret.Timeout = ret.Timeout || timeout
+			ret.Errors = append(ret.Errors, answer)
+		case answer == noAnswer:
+			ret.NoAnswer = true
+		case answer == "SOA":
+			ret.SOA = true
+		case answer == "NS":
+			ret.Referral = true
+		case answer == "IN":
+			// whiteboardresults records the class of answers without an
+			// address
+			ret.NoAddress = true
+		case isHostname(answer):
+			ret.Referral = true
+			ret.NSs = append(ret.NSs, strings.TrimSuffix(answer, "."))
+		default:
+			ret.Others = append(ret.Others, answer)
+		}
+	}
+
+	return ret
+}
+
+// NormalizeRCode turns the response code strings from gopacket ("Non-Existent
+// Domain") or dig style mnemonics ("nxdomain") into the mnemonic ("NXDOMAIN")
+func NormalizeRCode(rcode string) string {
+	switch strings.ToUpper(strings.TrimSpace(rcode)) {
+	case "":
+		return ""
+	case "NO ERROR", "NOERROR":
+		return "NOERROR"
+	case "FORMAT ERROR", "FORMERR":
+		return "FORMERR"
+	case "SERVER FAILURE", "SERVFAIL":
+		return "SERVFAIL"
+	case "NON-EXISTENT DOMAIN", "NXDOMAIN":
+		return "NXDOMAIN"
+	case "NOT IMPLEMENTED", "NOTIMP":
+		return "NOTIMP"
+	case "QUERY REFUSED", "REFUSED":
+		return "REFUSED"
+	}
+
+	return strings.ToUpper(strings.TrimSpace(rcode))
+}
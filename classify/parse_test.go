@@ -0,0 +1,47 @@
+package classify
+
+import "testing"
+
+func TestParseProbeErrors(t *testing.T) {
+	tests := []struct {
+		answer  string
+		errors  int
+		timeout bool
+		ips     int
+	}{
+		{answer: "timeout: 5000", errors: 1, timeout: true},
+		{answer: "getaddrinfo: Name or service not known", errors: 1},
+		{answer: "getaddrinfo: no route, timeout: 5000", errors: 1, timeout: true},
+		// answers that only look like errors
+		{answer: "v=spf1 include: _spf.example.com"},
+		{answer: "note: timeout: 5000"},
+		{answer: "192.0.2.1", ips: 1},
+	}
+
+	for _, test := range tests {
+		answers := Parse([]string{test.answer})
+		if len(answers.Errors) != test.errors || answers.Timeout != test.timeout {
+			t.Errorf(
+				"%q: %d errors, timeout %v, want %d and %v",
+				test.answer, len(answers.Errors), answers.Timeout, test.errors, test.timeout,
+			)
+		}
+		if len(answers.IPs) != test.ips {
+			t.Errorf("%q: %d addresses, want %d", test.answer, len(answers.IPs), test.ips)
+		}
+	}
+}
+
+// TestOddAnswerKeepsAddresses checks an answer with ": " in it doesn't make
+// a response with addresses malformed
+func TestOddAnswerKeepsAddresses(t *testing.T) {
+	c := Classifier{}
+	result := c.Classify(Response{
+		Domain:  "example.com",
+		Answers: []string{"192.0.2.1", "v=spf1 include: _spf.example.com"},
+		RCode:   "No Error",
+	})
+	if result.Category == Malformed || result.Category == Timeout {
+		t.Errorf("Category = %s (%s), want the addresses classified", result.Category, result.Reason)
+	}
+}
@@ -10,16 +10,35 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	blockpage "github.com/timartiny/RipeProbe/blockpage"
+	checkcache "github.com/timartiny/RipeProbe/checkcache"
+	classify "github.com/timartiny/RipeProbe/classify"
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	fingerprint "github.com/timartiny/RipeProbe/fingerprint"
+	resolve "github.com/timartiny/RipeProbe/resolve"
 	results "github.com/timartiny/RipeProbe/results"
 )
 
 var infoLogger *log.Logger
 var errorLogger *log.Logger
 
+// fingerprints are matched against answered IPs before any TLS checks
+var fingerprints *fingerprint.Database
+
+// consistencies, when set, compares IPs without a valid certificate to control
+// answers
+var consistencies *consistency.Checker
+
+// blockpages, when set, checks IPs without a valid certificate for blockpages
+var blockpages *blockpage.Checker
+
 type Results []results.ProbeResult
 
 func getStruct(path string) Results {
@@ -43,12 +62,6 @@ func getStruct(path string) Results {
 	return res
 }
 
-func isUrl(str string) bool {
-	// this is almost certainly a bad way to do it:
-
-	return strings.ContainsAny(str, ".-")
-}
-
 type ResolverResults []*ResolverResult
 
 // ResolverResult stores the ip address of a given resolver, the type of
@@ -62,28 +75,28 @@ type ResolverResult struct {
 }
 
 // Domain Result stores the domain name that was resolved, what the actual
-// A record request results were (ips, and NSs) as well as AAAA, and whether
-// any of those results successfully load the given domain page.
-// We will require that all of the A int results add up to the number of probes
-// (same for AAAA)
+// A record request results were (ips, and NSs) as well as AAAA, and how the
+// classify package sorted each probe's response. Referrals are followed up
+// by asking the given NSs, SuccessesNS and FailedNS count how that went.
+// When control answers are given, Control tallies how the answered IPs
+// compared to them, separately from the TLS check. We will require that the
+// A counts add up to the number of probes (same for AAAA)
 type DomainResult struct {
 	Domain            string
 	AResponse         *DNSResponse
-	ASuccessesIP      int
+	ACounts           classify.Counts
+	AReasons          []string
 	ASuccessProbes    []int
-	AFailedIP         int
 	ASuccessesNS      int
 	AFailedNS         int
-	ATimeouts         int
-	AAuthority        int
+	AControl          consistency.Tally
 	AAAAResponse      *DNSResponse
-	AAAASuccessesIP   int
+	AAAACounts        classify.Counts
+	AAAAReasons       []string
 	AAAASuccessProbes []int
-	AAAAFailedIP      int
 	AAAASuccessesNS   int
 	AAAAFailedNS      int
-	AAAATimeouts      int
-	AAAAAuthority     int
+	AAAAControl       consistency.Tally
 }
 
 // DNSResponse is the actual response to DNS queries, the list of IPs, Nameservers
@@ -96,6 +109,19 @@ type DNSResponse struct {
 	Others    []string
 }
 
+// newDNSResponse gathers up the parts of answers this tool cares about
+func newDNSResponse(answers classify.Answers) *DNSResponse {
+	dnsr := new(DNSResponse)
+	dnsr.IPs = answers.IPs
+	dnsr.NSs = answers.NSs
+	dnsr.Timeouts = answers.Timeout
+	dnsr.Authority = answers.NoAnswer || answers.SOA
+	dnsr.Others = append(dnsr.Others, answers.Errors...)
+	dnsr.Others = append(dnsr.Others, answers.Others...)
+
+	return dnsr
+}
+
 func strContains(arr []string, str string) bool {
 	for _, s := range arr {
 		if s == str {
@@ -147,81 +173,54 @@ func (dnsr *DNSResponse) Append(newDNSR *DNSResponse) *DNSResponse {
 	return dnsr
 }
 
-type IPStatus int
-
-const (
-	Unknown IPStatus = iota
-	Success
-	Failure
-)
-
-var quickCheckConnDetailsChan chan ConnDetails
-var quickCheckStatusChan chan IPStatus
-
-func quickIPDomainLookup() {
-	var quickLookupMap = map[string]map[string]IPStatus{} // [domain, ip] -> status
-
-	for cd := range quickCheckConnDetailsChan {
-		if cd.Status != Unknown {
-			if quickLookupMap[cd.Domain] == nil {
-				quickLookupMap[cd.Domain] = map[string]IPStatus{}
-			}
-			quickLookupMap[cd.Domain][cd.IP.String()] = cd.Status
-		} else {
-			if quickLookupMap[cd.Domain] == nil {
-				quickCheckStatusChan <- Unknown
-			} else {
-				quickCheckStatusChan <- quickLookupMap[cd.Domain][cd.IP.String()]
-			}
-		}
-	}
-}
+// validityCache keeps the result of each (domain, ip) TLS check so each pair
+// is only dialed once
+var validityCache *checkcache.Cache
 
 type ConnDetails struct {
 	Domain string
 	IP     net.IP
-	Status IPStatus
 }
 
-func ipChecker(connDetailsChan <-chan ConnDetails, isValidChan chan<- bool) {
-	for cd := range connDetailsChan {
-		quickCheckConnDetailsChan <- cd
-		status := <-quickCheckStatusChan
-		if status != Unknown {
-			isValidChan <- status == Success
-			continue
-		}
-		dialer := &net.Dialer{
+// tlsValid dials ip on 443 and returns true if it serves a valid certificate
+// for domain. An error is only returned when ctx was cancelled, the answer
+// can't be trusted then.
+func tlsValid(ctx context.Context, domain string, ip net.IP) (bool, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{
 			Timeout: time.Second,
-		}
-		config := &tls.Config{
-			ServerName: cd.Domain,
-		}
-
-		conn, err := tls.DialWithDialer(
-			dialer, "tcp", net.JoinHostPort(cd.IP.String(), "443"), config,
-		)
-		if err != nil {
-			cd.Status = Failure
-			quickCheckConnDetailsChan <- cd
-			isValidChan <- false
-			continue
-		}
+		},
+		Config: &tls.Config{
+			ServerName: domain,
+		},
+	}
 
-		err = conn.VerifyHostname(cd.Domain)
-		toSend := err == nil
-		if toSend {
-			cd.Status = Success
-		} else {
-			cd.Status = Failure
-		}
-		quickCheckConnDetailsChan <- cd
-		isValidChan <- toSend
+	conn, err := dialer.DialContext(
+		ctx, "tcp", net.JoinHostPort(ip.String(), "443"),
+	)
+	if err != nil {
+		return false, ctx.Err()
 	}
+	defer conn.Close()
 
+	return conn.(*tls.Conn).VerifyHostname(domain) == nil, nil
 }
 
-func ipSuccess(dnsr *DNSResponse, domain string) bool {
+func ipChecker(
+	ctx context.Context,
+	connDetailsChan <-chan ConnDetails,
+	isValidChan chan<- bool,
+) {
+	for cd := range connDetailsChan {
+		cd := cd
+		valid, _ := validityCache.Do(cd.Domain, cd.IP, func() (bool, error) {
+			return tlsValid(ctx, cd.Domain, cd.IP)
+		})
+		isValidChan <- valid
+	}
+}
+
+func ipSuccess(ctx context.Context, dnsr *DNSResponse, domain string) bool {
 	var ret bool
 
 	const numIPCheckers = 10
@@ -229,7 +228,7 @@ func ipSuccess(dnsr *DNSResponse, domain string) bool {
 	resultsChan := make(chan bool, len(dnsr.IPs))
 
 	for i := 0; i < numIPCheckers; i++ {
-		go ipChecker(connDetailsChan, resultsChan)
+		go ipChecker(ctx, connDetailsChan, resultsChan)
 	}
 
 	for _, ip := range dnsr.IPs {
@@ -247,44 +246,55 @@ func ipSuccess(dnsr *DNSResponse, domain string) bool {
 	return ret
 }
 
-func nsSuccess(dnsr *DNSResponse, domain string) bool {
-	var ret bool
+// nsResolver follows referrals to the name servers a resolver gave
+var nsResolver *resolve.Resolver
+
+// nsSuccess resolves domain iteratively from the name servers in dnsr and
+// checks the answered IPs, it returns whether they were valid and what
+// happened.
+func nsSuccess(
+	ctx context.Context, dnsr *DNSResponse, domain string,
+) (bool, string) {
 	if len(dnsr.NSs) == 0 {
-		return ret
-	}
-	for _, ns := range dnsr.NSs {
-		r := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Second,
-				}
-				return d.DialContext(ctx, network, net.JoinHostPort(ns, "53"))
-			},
-		}
-		ips, err := r.LookupHost(context.Background(), domain)
-		if err != nil || len(ips) == 0 {
-			return ret
-		}
+		return false, "referral named no name servers"
+	}
+	ans, err := nsResolver.ResolveFrom(ctx, dnsr.NSs, domain)
+	if err != nil {
+		return false, fmt.Sprintf("following referral failed, %v", err)
+	}
 
-		tmpDNSR := new(DNSResponse)
-		for _, ip := range ips {
-			tmpDNSR.IPs = append(tmpDNSR.IPs, net.ParseIP(ip))
-		}
-		if ipSuccess(tmpDNSR, domain) {
-			ret = true
-			break
-		}
+	tmpDNSR := &DNSResponse{IPs: ans.IPs}
+	if ipSuccess(ctx, tmpDNSR, domain) {
+		return true, fmt.Sprintf(
+			"%s (%s) answered %v, valid", ans.NS, ans.Server, ans.IPs,
+		)
 	}
 
-	return ret
+	return false, fmt.Sprintf(
+		"%s (%s) answered %v, invalid", ans.NS, ans.Server, ans.IPs,
+	)
 }
 
 func parseQueryResults(
+	ctx context.Context,
 	qrc <-chan QueryResultsAndNumAs,
 	consolidateChan chan<- ResolverResults,
 	wg *sync.WaitGroup,
 ) {
+	classifier := classify.Classifier{
+		Fingerprints: fingerprints,
+		Verify: func(domain string, ips []net.IP) bool {
+			return ipSuccess(ctx, &DNSResponse{IPs: ips}, domain)
+		},
+	}
+	if consistencies != nil {
+		classifier.Consistent = consistencies.Consistent
+	}
+	if blockpages != nil {
+		classifier.Blockpage = func(domain string, ips []net.IP) (bool, string) {
+			return blockpages.CheckAny(ctx, domain, ips)
+		}
+	}
 	for qra := range qrc {
 		numAs := qra.NumAs
 		qrs := qra.QueryResults
@@ -292,74 +302,75 @@ func parseQueryResults(
 		for _, qr := range qrs {
 			rr := new(ResolverResult)
 			rr.ResolverIP = net.ParseIP(qr.ResolverIP)
-			if strings.Contains(qr.ResolverType, "_Resolver") {
+			switch {
+			case qr.Resolver != nil && qr.Resolver.Kind == results.ResolverKindISP:
+				rr.ResolverType = "ISP Resolver"
+			case strings.Contains(qr.ResolverType, "_Resolver"):
 				rr.ResolverType = "Open Resolver"
-			} else {
+			default:
 				rr.ResolverType = qr.ResolverType
 			}
 			for domain, responses := range qr.Queries {
 				dr := new(DomainResult)
-				dnsr := new(DNSResponse)
 				dr.Domain = domain
-				for _, response := range responses {
-					if x := net.ParseIP(response); x != nil {
-						dnsr.IPs = append(dnsr.IPs, x)
-					} else if strings.Split(response, ": ")[0] == "timeout" {
-						dnsr.Timeouts = true
-					} else if len(response) == 0 {
-						infoLogger.Printf("len of str is 0\n")
-					} else if strings.Contains(response, "Authority") {
-						dnsr.Authority = true
-					} else if isUrl(response) {
-						dnsr.NSs = append(dnsr.NSs, response)
+				dnsr := newDNSResponse(classify.Parse(responses))
+				// the answers of each response code are classified on
+				// their own, a SERVFAIL retry doesn't hide the addresses
+				// of another response
+				counts := classify.Counts{}
+				var valid bool
+				var nsSuccesses, nsFailures int
+				var reasons []string
+				for _, resp := range qr.Responses(domain) {
+					result := classifier.Classify(classify.Response{
+						Domain:  domain,
+						Answers: resp.Answers,
+						RCode:   resp.RCode,
+					})
+					counts.Add(result.Category)
+					valid = valid || result.Category.Valid()
+					reasons = append(reasons, result.Reason)
+					if result.Category != classify.Referral {
+						continue
+					}
+					nsValid, reason := nsSuccess(
+						ctx, newDNSResponse(classify.Parse(resp.Answers)), domain,
+					)
+					if nsValid {
+						nsSuccesses++
 					} else {
-						dnsr.Others = append(dnsr.Others, response)
+						nsFailures++
 					}
+					reasons = append(reasons, reason)
+				}
+				var control consistency.Tally
+				if consistencies != nil && len(dnsr.IPs) > 0 {
+					control.Add(consistencies.Compare(domain, dnsr.IPs))
 				}
 				if numAs == 1 {
-					switch {
-					case ipSuccess(dnsr, domain):
-						dr.ASuccessesIP = 1
+					dr.ACounts = counts
+					dr.AReasons = reasons
+					if valid {
 						dr.ASuccessProbes = append(
 							dr.ASuccessProbes, qra.ProbeID,
 						)
-					case len(dnsr.IPs) > 0:
-						dr.AFailedIP = 1
-					case nsSuccess(dnsr, domain):
-						dr.ASuccessesNS = 1
-					case len(dnsr.NSs) > 0:
-						dr.AFailedNS = 1
-					case dnsr.Timeouts:
-						dr.ATimeouts = 1
-					case dnsr.Authority:
-						dr.AAuthority = 1
-					default:
-						infoLogger.Printf("nothing got 1 this time...\n")
 					}
+					dr.ASuccessesNS = nsSuccesses
+					dr.AFailedNS = nsFailures
+					dr.AControl = control
 					dr.AResponse = dnsr
-					// pass dnsr, domain to check certs here and set ASuccessesIP, ASuccessesNS
 				} else if numAs == 4 {
-					switch {
-					case ipSuccess(dnsr, domain):
-						dr.AAAASuccessesIP = 1
+					dr.AAAACounts = counts
+					dr.AAAAReasons = reasons
+					if valid {
 						dr.AAAASuccessProbes = append(
 							dr.AAAASuccessProbes, qra.ProbeID,
 						)
-					case len(dnsr.IPs) > 0:
-						dr.AAAAFailedIP = 1
-					case nsSuccess(dnsr, domain):
-						dr.AAAASuccessesNS = 1
-					case len(dnsr.NSs) > 0:
-						dr.AAAAFailedNS = 1
-					case dnsr.Timeouts:
-						dr.AAAATimeouts = 1
-					case dnsr.Authority:
-						dr.AAAAAuthority = 1
-					default:
-						infoLogger.Printf("nothing got 1 this time...\n")
 					}
+					dr.AAAASuccessesNS = nsSuccesses
+					dr.AAAAFailedNS = nsFailures
+					dr.AAAAControl = control
 					dr.AAAAResponse = dnsr
-					// pass dnsr, domain to check certs here and set AAAASuccessesIP, AAAASuccessesNS
 				}
 
 				rr.DomainResults = append(rr.DomainResults, dr)
@@ -367,7 +378,11 @@ func parseQueryResults(
 
 			ret = append(ret, rr)
 		}
-		consolidateChan <- ret
+		// checks cut short by an interrupt look like failures, so nothing
+		// finished after one is kept
+		if ctx.Err() == nil {
+			consolidateChan <- ret
+		}
 		wg.Done()
 	}
 }
@@ -378,18 +393,29 @@ type QueryResultsAndNumAs struct {
 	NumAs        int
 }
 
+// completedProbes counts the probes whose results were all checked before an
+// interrupt, only their results are consolidated
+var completedProbes int32
+
 func parseProbeResult(
+	ctx context.Context,
 	pr results.ProbeResult,
 	rrChan chan<- ResolverResults,
 	ctrChan chan<- int,
 	wg *sync.WaitGroup,
 ) {
 	defer wg.Done()
+	if ctx.Err() != nil {
+		return
+	}
 	queryResultChan := make(chan QueryResultsAndNumAs)
 	defer close(queryResultChan)
 
+	// the probe's four batches are held back until all of them are checked,
+	// so an interrupt doesn't leave part of a probe in the results
+	batchChan := make(chan ResolverResults, 4)
 	var tmpWg sync.WaitGroup
-	go parseQueryResults(queryResultChan, rrChan, &tmpWg)
+	go parseQueryResults(ctx, queryResultChan, batchChan, &tmpWg)
 	ctrChan <- pr.ProbeID
 	tmpWg.Add(4)
 	queryResultChan <- QueryResultsAndNumAs{
@@ -405,9 +431,37 @@ func parseProbeResult(
 		ProbeID: pr.ProbeID, QueryResults: pr.V6ToV6, NumAs: 4,
 	}
 	tmpWg.Wait()
+	close(batchChan)
+	if ctx.Err() == nil && len(batchChan) == 4 {
+		for rrs := range batchChan {
+			rrChan <- rrs
+		}
+		atomic.AddInt32(&completedProbes, 1)
+	}
 	ctrChan <- pr.ProbeID * -1
 }
 
+// mergeCounts adds other to counts, either may be nil
+func mergeCounts(counts, other classify.Counts) classify.Counts {
+	if counts == nil {
+		counts = classify.Counts{}
+	}
+	counts.Merge(other)
+
+	return counts
+}
+
+// mergeReasons appends the reasons in other that aren't already in reasons
+func mergeReasons(reasons, other []string) []string {
+	for _, reason := range other {
+		if !strContains(reasons, reason) {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	return reasons
+}
+
 func consolidate(
 	rrChan <-chan ResolverResults,
 	mapChan chan<- map[string]*ResolverResult,
@@ -420,31 +474,36 @@ func consolidate(
 				consolidated[rr.ResolverIP.String()] = rr
 			} else {
 				for _, dr := range rr.DomainResults {
+					found := false
 					for _, existingDR := range existingRR.DomainResults {
 						if existingDR.Domain != dr.Domain {
 							continue
 						}
+						found = true
 						existingDR.AResponse = existingDR.AResponse.Append(dr.AResponse)
-						existingDR.AAAAResponse = existingDR.AAAAResponse.Append(dr.AResponse)
-						existingDR.ASuccessesIP += dr.ASuccessesIP
+						existingDR.AAAAResponse = existingDR.AAAAResponse.Append(dr.AAAAResponse)
+						existingDR.ACounts = mergeCounts(existingDR.ACounts, dr.ACounts)
+						existingDR.AReasons = mergeReasons(existingDR.AReasons, dr.AReasons)
 						existingDR.ASuccessProbes = append(
 							existingDR.ASuccessProbes, dr.ASuccessProbes...,
 						)
-						existingDR.AFailedIP += dr.AFailedIP
 						existingDR.ASuccessesNS += dr.ASuccessesNS
 						existingDR.AFailedNS += dr.AFailedNS
-						existingDR.ATimeouts += dr.ATimeouts
-						existingDR.AAuthority += dr.AAuthority
-						existingDR.AAAASuccessesIP += dr.AAAASuccessesIP
+						existingDR.AControl.Merge(dr.AControl)
+						existingDR.AAAACounts = mergeCounts(existingDR.AAAACounts, dr.AAAACounts)
+						existingDR.AAAAReasons = mergeReasons(existingDR.AAAAReasons, dr.AAAAReasons)
 						existingDR.AAAASuccessProbes = append(
 							existingDR.AAAASuccessProbes,
 							dr.AAAASuccessProbes...,
 						)
-						existingDR.AAAAFailedIP += dr.AAAAFailedIP
 						existingDR.AAAASuccessesNS += dr.AAAASuccessesNS
 						existingDR.AAAAFailedNS += dr.AAAAFailedNS
-						existingDR.AAAATimeouts += dr.AAAATimeouts
-						existingDR.AAAAAuthority += dr.AAAAAuthority
+						existingDR.AAAAControl.Merge(dr.AAAAControl)
+					}
+					if !found {
+						existingRR.DomainResults = append(
+							existingRR.DomainResults, dr,
+						)
 					}
 				}
 			}
@@ -454,27 +513,16 @@ func consolidate(
 	mapChan <- consolidated
 }
 
-func printIPResults(failures, successes int, succesProbes []int) {
-	if successes > 0 {
-		fmt.Printf("\t\t%d probe(s) received a valid IP", successes)
-		fmt.Printf(" (Probe ids: %v)\n", succesProbes)
-	}
-	if failures > 0 {
-		fmt.Printf("\t\t%d probe(s) received only invalid IPs\n", failures)
-	}
-}
-
-func printTimeouts(num int) {
-	if num > 0 {
-		fmt.Printf("\t\t%d probe(s) timed out\n", num)
-	}
-}
-
-func printAuthoritys(num int) {
-	if num > 0 {
-		fmt.Printf(
-			"\t\t%d probe(s) received No Answer or Authority Given\n", num,
-		)
+func printCounts(counts classify.Counts, successProbes []int) {
+	for _, c := range classify.Categories {
+		if counts[c] == 0 {
+			continue
+		}
+		fmt.Printf("\t\t%d probe(s) received %s", counts[c], c)
+		if c.Valid() {
+			fmt.Printf(" (Probe ids: %v)", successProbes)
+		}
+		fmt.Printf("\n")
 	}
 }
 
@@ -495,9 +543,31 @@ func printNSResults(failures, successes int) {
 	}
 }
 
-func printResults(numProbes int, mapChan <-chan map[string]*ResolverResult) {
+func printControl(t consistency.Tally, prefixLen int) {
+	if t.NoControl > 0 {
+		fmt.Printf(
+			"\t\t%d probe(s) received IPs with no control answers to compare to\n",
+			t.NoControl,
+		)
+	}
+	if t.Compared == 0 {
+		return
+	}
+	fmt.Printf(
+		"\t\t%d probe(s) received IPs that were compared to the control "+
+			"answers: %d shared an IP, %d a /%d, %d an ASN, %d were "+
+			"consistent and %d were inconsistent\n",
+		t.Compared,
+		t.IPOverlap,
+		t.PrefixOverlap,
+		prefixLen,
+		t.ASNOverlap,
+		t.Consistent,
+		t.Compared-t.Consistent,
+	)
+}
 
-	m := <-mapChan
+func printResults(numProbes int, m map[string]*ResolverResult) {
 	fmt.Printf(
 		"%d Probes were asked to use %d IPs as resolvers\n", numProbes, len(m),
 	)
@@ -506,30 +576,14 @@ func printResults(numProbes int, mapChan <-chan map[string]*ResolverResult) {
 		fmt.Printf("%s (%s)\n", resIP, rr.ResolverType)
 		for _, domRes := range rr.DomainResults {
 			fmt.Printf("\tFor A record requests for %s:\n", domRes.Domain)
-			dnsRes := domRes.AResponse
-			printIPResults(
-				domRes.AFailedIP, domRes.ASuccessesIP, domRes.ASuccessProbes,
-			)
+			printCounts(domRes.ACounts, domRes.ASuccessProbes)
 			printNSResults(domRes.AFailedNS, domRes.ASuccessesNS)
-			printTimeouts(domRes.ATimeouts)
-			printAuthoritys(domRes.AAuthority)
-			if len(dnsRes.Others) > 0 {
-				fmt.Printf("\t\t%d probes received something else...\n", len(dnsRes.Others))
-			}
+			printControl(domRes.AControl, 24)
 
 			fmt.Printf("\tFor AAAA record requests for %s:\n", domRes.Domain)
-			dnsRes = domRes.AAAAResponse
-			printIPResults(
-				domRes.AAAAFailedIP,
-				domRes.AAAASuccessesIP,
-				domRes.AAAASuccessProbes,
-			)
+			printCounts(domRes.AAAACounts, domRes.AAAASuccessProbes)
 			printNSResults(domRes.AAAAFailedNS, domRes.AAAASuccessesNS)
-			printTimeouts(domRes.AAAATimeouts)
-			printAuthoritys(domRes.AAAAAuthority)
-			if len(dnsRes.Others) > 0 {
-				fmt.Printf("\t\t%d probes received something else...\n", len(dnsRes.Others))
-			}
+			printControl(domRes.AAAAControl, 48)
 		}
 	}
 }
@@ -550,6 +604,19 @@ func ctr(ctrChan <-chan int) {
 
 func main() {
 	resultsPath := flag.String("r", "", "Path to results file")
+	fingerprintsPath := flag.String("fingerprints", "", "Path to a file of known injected addresses (<address or CIDR> <kind> <label> per line), bogons are always checked")
+	controlsPath := flag.String("controls", "", "Comma separated paths to ZDNS output (e.g. querylist's --v4_dns and --v6_dns files) or querylist's full details output to compare answered IPs to by IP, /24 (/48) and, with -asn_db, ASN")
+	asnPath := flag.String("asn_db", "", "Path to a MaxMind ASN mmdb, used with -controls to compare answered IPs by ASN")
+	nsPort := flag.String("ns_port", "53", "Port to query name servers from referrals on (e.g. for local stub servers)")
+	cachePath := flag.String("cache", "", "Path to write TLS check results to at the end (or when interrupted)")
+	resume := flag.Bool("resume", false, "Read the -cache of a previous (interrupted) run and skip the (domain, IP) pairs it already checked")
+	checkBlockpages := flag.Bool("blockpage", false, "Fetch HTTP/HTTPS pages from IPs without a valid certificate and check for blockpages")
+	blockpagePath := flag.String("blockpage_fingerprints", "", "Path to a JSON file of extra blockpage fingerprints, implies -blockpage")
+	jsonPath := flag.String("json", "", "Path to write the per resolver and domain verdicts to (in JSON)")
+	censoredRatio := flag.Float64("censored_ratio", 0.5, "Fraction of probes' responses for a domain that must look censored for a censored verdict")
+	unreliableRatio := flag.Float64("unreliable_ratio", 0.5, "Fraction of probes' responses for a domain that must fail (timeout, servfail, ...) for an unreliable verdict")
+	unreliableDomainRatio := flag.Float64("unreliable_domain_ratio", 0.5, "Fraction of a resolver's verdicts that must be unreliable for the resolver to be unreliable")
+	censoringDomains := flag.Int("censoring_domains", 1, "Number of censored verdicts needed for a resolver to be censoring")
 	// printIPs := flag.Bool("ips", false, "Determine whether to print IPs of resolvers")
 	flag.Parse()
 	infoLogger = log.New(
@@ -564,20 +631,90 @@ func main() {
 	)
 	var wg sync.WaitGroup
 
+	fingerprints = fingerprint.Default()
+	if len(*fingerprintsPath) > 0 {
+		var err error
+		fingerprints, err = fingerprint.Load(*fingerprintsPath)
+		if err != nil {
+			errorLogger.Fatalf("Error loading fingerprints, %v\n", err)
+		}
+	}
+
+	thresholds := Thresholds{
+		CensoredRatio:         *censoredRatio,
+		UnreliableRatio:       *unreliableRatio,
+		UnreliableDomainRatio: *unreliableDomainRatio,
+		CensoringDomains:      *censoringDomains,
+	}
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal kills the process as usual
+		stop()
+		infoLogger.Printf(
+			"Interrupted, stopping checks and writing out partial results\n",
+		)
+	}()
+
+	nsResolver = resolve.New()
+	nsResolver.Port = *nsPort
+
+	if *resume && len(*cachePath) == 0 {
+		errorLogger.Fatalf("-resume needs the -cache from the previous run\n")
+	}
+	validityCache = checkcache.New()
+	if *resume {
+		var err error
+		validityCache, err = checkcache.Load(*cachePath)
+		if err != nil {
+			errorLogger.Fatalf("Error loading cache: %s, %v\n", *cachePath, err)
+		}
+		infoLogger.Printf(
+			"loaded %d TLS check results from %s\n",
+			validityCache.Stats().Entries,
+			*cachePath,
+		)
+	}
+
+	if len(*asnPath) > 0 && len(*controlsPath) == 0 {
+		errorLogger.Fatalf("-asn_db needs control answers from -controls\n")
+	}
+	if len(*controlsPath) > 0 {
+		var err error
+		consistencies, err = consistency.Load(*asnPath, strings.Split(*controlsPath, ","))
+		if err != nil {
+			errorLogger.Fatalf("Error loading control answers, %v\n", err)
+		}
+		defer consistencies.Close()
+		infoLogger.Printf("loaded control answers for %d domains\n", len(consistencies.Controls))
+	}
+	if *checkBlockpages || len(*blockpagePath) > 0 {
+		lib := blockpage.DefaultLibrary()
+		if len(*blockpagePath) > 0 {
+			var err error
+			lib, err = blockpage.LoadLibrary(*blockpagePath)
+			if err != nil {
+				errorLogger.Fatalf("Error loading blockpage fingerprints, %v\n", err)
+			}
+		}
+		blockpages = blockpage.NewChecker(lib)
+		blockpages.Logger = infoLogger
+	}
+
 	fullResults := getStruct(*resultsPath)
 
 	rrChan := make(chan ResolverResults)
 	mapChan := make(chan map[string]*ResolverResult)
 	ctrChan := make(chan int)
-	quickCheckConnDetailsChan = make(chan ConnDetails)
-	quickCheckStatusChan = make(chan IPStatus)
-
-	go quickIPDomainLookup()
 	go consolidate(rrChan, mapChan)
 	go ctr(ctrChan)
 	for _, probeResult := range fullResults {
 		wg.Add(1)
-		go parseProbeResult(probeResult, rrChan, ctrChan, &wg)
+		go parseProbeResult(ctx, probeResult, rrChan, ctrChan, &wg)
 	}
 	// genChan := make(chan GenStats)
 	// v4AChan := make(chan SpecificResults)
@@ -604,5 +741,41 @@ func main() {
 	wg.Wait()
 	close(ctrChan)
 	close(rrChan)
-	printResults(len(fullResults), mapChan)
+	m := <-mapChan
+	if ctx.Err() != nil {
+		infoLogger.Printf(
+			"Interrupted, results only cover %d of %d probes\n",
+			completedProbes,
+			len(fullResults),
+		)
+	}
+	printResults(int(completedProbes), m)
+	if len(*jsonPath) > 0 {
+		verdicts := getVerdicts(m, thresholds)
+		classifications := make(map[string]int)
+		for _, rv := range verdicts {
+			classifications[rv.Classification]++
+		}
+		infoLogger.Printf(
+			"%d clean, %d censoring and %d unreliable resolvers\n",
+			classifications[results.ClassificationClean],
+			classifications[results.ClassificationCensoring],
+			classifications[results.ClassificationUnreliable],
+		)
+		writeVerdicts(verdicts, *jsonPath)
+	}
+
+	stats := validityCache.Stats()
+	infoLogger.Printf(
+		"TLS check cache: %d entries, %d hits, %d misses, %d shared in-flight\n",
+		stats.Entries,
+		stats.Hits,
+		stats.Misses,
+		stats.Shared,
+	)
+	if len(*cachePath) > 0 {
+		if err := validityCache.Save(*cachePath); err != nil {
+			errorLogger.Fatalf("Error saving cache: %s, %v\n", *cachePath, err)
+		}
+	}
 }
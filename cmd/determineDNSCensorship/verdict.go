@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	classify "github.com/timartiny/RipeProbe/classify"
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// Verdicts for a single domain and record type
+const (
+	VerdictOK         = "ok"
+	VerdictCensored   = "censored"
+	VerdictUnreliable = "unreliable"
+	VerdictNoData     = "no-data"
+)
+
+// censoredCategories are the responses that point at tampering
+var censoredCategories = []classify.Category{
+	classify.InvalidIP,
+	classify.Blockpage,
+	classify.BogonIP,
+	classify.KnownInjection,
+	classify.NXDomain,
+}
+
+// failedCategories are the responses that say nothing about tampering, the
+// resolver (or the path to it) just didn't work
+var failedCategories = []classify.Category{
+	classify.Timeout,
+	classify.ServFail,
+	classify.Refused,
+	classify.Malformed,
+}
+
+// Thresholds decide the verdicts. CensoredRatio and UnreliableRatio are the
+// fraction of probes' responses for a domain that have to be censored (or
+// failed) for the domain to get that verdict. A resolver is unreliable when
+// at least UnreliableDomainRatio of its verdicts are unreliable, otherwise it
+// is censoring when at least CensoringDomains of them are censored.
+type Thresholds struct {
+	CensoredRatio         float64
+	UnreliableRatio       float64
+	UnreliableDomainRatio float64
+	CensoringDomains      int
+}
+
+// RecordVerdict is the verdict for one record type of a domain and the
+// evidence it is based on.
+type RecordVerdict struct {
+	Verdict       string            `json:"verdict"`
+	SuccessProbes []int             `json:"success_probes"`
+	Counts        classify.Counts   `json:"counts"`
+	Reasons       []string          `json:"reasons"`
+	SuccessesNS   int               `json:"ns_successes"`
+	FailedNS      int               `json:"ns_failures"`
+	Control       consistency.Tally `json:"control"`
+}
+
+// DomainVerdict holds the A and AAAA verdicts for a domain
+type DomainVerdict struct {
+	Domain string        `json:"domain"`
+	A      RecordVerdict `json:"a"`
+	AAAA   RecordVerdict `json:"aaaa"`
+}
+
+// ResolverVerdict is the classification of a resolver and the verdicts for
+// each domain it was asked about.
+type ResolverVerdict struct {
+	Resolver       string          `json:"resolver"`
+	ResolverType   string          `json:"resolver_type"`
+	Classification string          `json:"classification"`
+	Censored       int             `json:"censored"`
+	Unreliable     int             `json:"unreliable"`
+	Domains        []DomainVerdict `json:"domains"`
+}
+
+// sumCategories returns how many responses in counts are in any of cats
+func sumCategories(counts classify.Counts, cats []classify.Category) int {
+	var ret int
+	for _, c := range cats {
+		ret += counts[c]
+	}
+
+	return ret
+}
+
+// getRecordVerdict decides the verdict for one record type of a domain
+func getRecordVerdict(
+	counts classify.Counts,
+	reasons []string,
+	successProbes []int,
+	successesNS, failedNS int,
+	control consistency.Tally,
+	t Thresholds,
+) RecordVerdict {
+	ret := RecordVerdict{
+		SuccessProbes: successProbes,
+		Counts:        counts,
+		Reasons:       reasons,
+		SuccessesNS:   successesNS,
+		FailedNS:      failedNS,
+		Control:       control,
+	}
+	total := counts.Total()
+	if total == 0 {
+		ret.Verdict = VerdictNoData
+		return ret
+	}
+	// referrals that led to invalid IPs count against the resolver too
+	censored := sumCategories(counts, censoredCategories) + failedNS
+	failed := sumCategories(counts, failedCategories)
+
+	switch {
+	case float64(failed)/float64(total) >= t.UnreliableRatio:
+		ret.Verdict = VerdictUnreliable
+	case float64(censored)/float64(total) >= t.CensoredRatio:
+		ret.Verdict = VerdictCensored
+	default:
+		ret.Verdict = VerdictOK
+	}
+
+	return ret
+}
+
+// getResolverVerdict decides the verdicts for every domain rr was asked about
+// and classifies rr from them.
+func getResolverVerdict(
+	resIP string, rr *ResolverResult, t Thresholds,
+) ResolverVerdict {
+	ret := ResolverVerdict{Resolver: resIP, ResolverType: rr.ResolverType}
+	var withData int
+	for _, dr := range rr.DomainResults {
+		dv := DomainVerdict{
+			Domain: dr.Domain,
+			A: getRecordVerdict(
+				dr.ACounts, dr.AReasons, dr.ASuccessProbes,
+				dr.ASuccessesNS, dr.AFailedNS, dr.AControl, t,
+			),
+			AAAA: getRecordVerdict(
+				dr.AAAACounts, dr.AAAAReasons, dr.AAAASuccessProbes,
+				dr.AAAASuccessesNS, dr.AAAAFailedNS, dr.AAAAControl, t,
+			),
+		}
+		for _, rv := range []RecordVerdict{dv.A, dv.AAAA} {
+			switch rv.Verdict {
+			case VerdictNoData:
+				continue
+			case VerdictCensored:
+				ret.Censored++
+			case VerdictUnreliable:
+				ret.Unreliable++
+			}
+			withData++
+		}
+		ret.Domains = append(ret.Domains, dv)
+	}
+	sort.Slice(ret.Domains, func(i, j int) bool {
+		return ret.Domains[i].Domain < ret.Domains[j].Domain
+	})
+
+	switch {
+	case withData == 0 ||
+		float64(ret.Unreliable)/float64(withData) >= t.UnreliableDomainRatio:
+		ret.Classification = results.ClassificationUnreliable
+	case ret.Censored >= t.CensoringDomains:
+		ret.Classification = results.ClassificationCensoring
+	default:
+		ret.Classification = results.ClassificationClean
+	}
+
+	return ret
+}
+
+// getVerdicts returns the verdicts for every resolver, sorted by IP
+func getVerdicts(m map[string]*ResolverResult, t Thresholds) []ResolverVerdict {
+	var ret []ResolverVerdict
+	for resIP, rr := range m {
+		ret = append(ret, getResolverVerdict(resIP, rr, t))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Resolver < ret[j].Resolver
+	})
+
+	return ret
+}
+
+// writeVerdicts writes the verdicts to path as JSON
+func writeVerdicts(verdicts []ResolverVerdict, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	b, err := json.MarshalIndent(verdicts, "", "\t")
+	if err != nil {
+		errorLogger.Fatalf("Error marshaling verdicts, %v\n", err)
+	}
+	file.Write(b)
+	file.WriteString("\n")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// externalSorter sorts more lines than fit in memory. Lines are collected
+// until there are runSize of them, then sorted and written to a temporary
+// file (a run). Merge then reads all the runs back in order.
+type externalSorter struct {
+	dir     string
+	runSize int
+	lines   []string
+	runs    []string
+}
+
+// newExternalSorter writes its runs to dir (the system's temporary directory
+// when empty) and keeps at most runSize lines in memory
+func newExternalSorter(dir string, runSize int) *externalSorter {
+	if runSize <= 0 {
+		runSize = 1000000
+	}
+
+	return &externalSorter{dir: dir, runSize: runSize}
+}
+
+// Add adds a line, which must not contain a newline
+func (s *externalSorter) Add(line string) error {
+	s.lines = append(s.lines, line)
+	if len(s.lines) >= s.runSize {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// flush sorts the lines in memory and writes them out as a run
+func (s *externalSorter) flush() error {
+	if len(s.lines) == 0 {
+		return nil
+	}
+	sort.Strings(s.lines)
+	file, err := ioutil.TempFile(s.dir, "querylist-run-")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file.Name())
+	w := bufio.NewWriterSize(file, 1024*1024)
+	for _, line := range s.lines {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	s.lines = s.lines[:0]
+
+	return file.Close()
+}
+
+// Cleanup removes the runs
+func (s *externalSorter) Cleanup() {
+	for _, run := range s.runs {
+		os.Remove(run)
+	}
+	s.runs = nil
+}
+
+// runReader is the next line of a run
+type runReader struct {
+	line    string
+	scanner *bufio.Scanner
+	file    *os.File
+}
+
+// runHeap orders runs by their next line
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
+
+// Merge calls f with every added line in sorted order, only one line per run
+// is held in memory at a time
+func (s *externalSorter) Merge(f func(line string)) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	h := &runHeap{}
+	defer func() {
+		for _, rr := range *h {
+			rr.file.Close()
+		}
+	}()
+	for _, run := range s.runs {
+		file, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		rr := &runReader{scanner: scanner, file: file}
+		if !scanner.Scan() {
+			file.Close()
+			if err = scanner.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		rr.line = scanner.Text()
+		heap.Push(h, rr)
+	}
+
+	for h.Len() > 0 {
+		rr := (*h)[0]
+		f(rr.line)
+		if rr.scanner.Scan() {
+			rr.line = rr.scanner.Text()
+			heap.Fix(h, 0)
+			continue
+		}
+		heap.Pop(h)
+		rr.file.Close()
+		if err := rr.scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,8 +1,17 @@
 module querylist
 
+replace github.com/timartiny/RipeProbe/normalize => ../../normalize
+
+replace github.com/timartiny/RipeProbe/results => ../../results
+
+replace github.com/timartiny/RipeProbe/zgrabtls => ../../zgrabtls
+
 go 1.16
 
 require (
-	github.com/zmap/zflags v1.4.0-beta.1 // indirect
-	github.com/zmap/zgrab2 v0.1.7
+	github.com/klauspost/compress v1.14.4
+	github.com/timartiny/RipeProbe/normalize v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/zgrabtls v0.0.0-00010101000000-000000000000
+	github.com/zmap/zflags v1.4.0-beta.1
 )
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// fingerprintBytes is how much of the start of an input is hashed, hashing
+// all of a 23 GB ZGrab file would take about as long as parsing it
+const fingerprintBytes = 1024 * 1024
+
+// fileFingerprint identifies an input's contents without reading all of it.
+// Path is only informational, a file that was moved still matches.
+type fileFingerprint struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// SHA256 is the hash of the first fingerprintBytes of the file
+	SHA256 string `json:"sha256"`
+}
+
+// Equal returns true when both are nil or both describe the same contents
+func (f *fileFingerprint) Equal(other *fileFingerprint) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+
+	return f.Size == other.Size && f.ModTime.Equal(other.ModTime) &&
+		f.SHA256 == other.SHA256
+}
+
+// fingerprint returns the fingerprint of the file at path, nil for no path
+func fingerprint(path string) *fileFingerprint {
+	if len(path) == 0 {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		errorLogger.Fatalf("Error opening file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		errorLogger.Fatalf("Error checking file: %s, %v\n", path, err)
+	}
+	hash := sha256.New()
+	if _, err = io.CopyN(hash, file, fingerprintBytes); err != nil && err != io.EOF {
+		errorLogger.Fatalf("Error reading file: %s, %v\n", path, err)
+	}
+
+	return &fileFingerprint{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+	}
+}
+
+// inputFingerprints are the fingerprints of the inputs a details file was
+// made from, written next to it so a later run can tell what changed
+type inputFingerprints struct {
+	V4DNS     *fileFingerprint `json:"v4_dns"`
+	V6DNS     *fileFingerprint `json:"v6_dns"`
+	V4TLS     *fileFingerprint `json:"v4_tls"`
+	V4DupTLS  *fileFingerprint `json:"v4_dup_tls,omitempty"`
+	V6TLS     *fileFingerprint `json:"v6_tls"`
+	V6DupTLS  *fileFingerprint `json:"v6_dup_tls,omitempty"`
+	RootStore *fileFingerprint `json:"root_store,omitempty"`
+}
+
+// getInputFingerprints fingerprints the inputs given in args
+func getInputFingerprints(args QuerylistFlags) inputFingerprints {
+	return inputFingerprints{
+		V4DNS:     fingerprint(args.V4DNS),
+		V6DNS:     fingerprint(args.V6DNS),
+		V4TLS:     fingerprint(args.V4TLS),
+		V4DupTLS:  fingerprint(args.V4DupTLS),
+		V6TLS:     fingerprint(args.V6TLS),
+		V6DupTLS:  fingerprint(args.V6DupTLS),
+		RootStore: fingerprint(args.RootStore),
+	}
+}
+
+// dnsUnchanged returns true when both were made from the same DNS results
+func (i inputFingerprints) dnsUnchanged(other inputFingerprints) bool {
+	return i.V4DNS.Equal(other.V4DNS) && i.V6DNS.Equal(other.V6DNS)
+}
+
+// tlsUnchanged returns true when both were made from the same banner grabs,
+// verified against the same roots
+func (i inputFingerprints) tlsUnchanged(other inputFingerprints) bool {
+	return i.V4TLS.Equal(other.V4TLS) && i.V4DupTLS.Equal(other.V4DupTLS) &&
+		i.V6TLS.Equal(other.V6TLS) && i.V6DupTLS.Equal(other.V6DupTLS) &&
+		i.RootStore.Equal(other.RootStore)
+}
+
+// fingerprintsPath is where the fingerprints of a details file's inputs go
+func fingerprintsPath(detailsPath string) string {
+	return detailsPath + ".inputs.json"
+}
+
+// readInputFingerprints reads the fingerprints written next to detailsPath,
+// false when there aren't any
+func readInputFingerprints(detailsPath string) (inputFingerprints, bool) {
+	var ret inputFingerprints
+	b, err := ioutil.ReadFile(fingerprintsPath(detailsPath))
+	if err != nil {
+		return ret, false
+	}
+	if err = json.Unmarshal(b, &ret); err != nil {
+		errorLogger.Printf(
+			"Ignoring unreadable %s, %v\n", fingerprintsPath(detailsPath), err,
+		)
+		return ret, false
+	}
+
+	return ret, true
+}
+
+// writeInputFingerprints writes fps next to detailsPath
+func writeInputFingerprints(fps inputFingerprints, detailsPath string) {
+	b, err := json.MarshalIndent(fps, "", "\t")
+	if err != nil {
+		errorLogger.Fatalf("json.Marshal error: %v\n", err)
+	}
+	if err = ioutil.WriteFile(fingerprintsPath(detailsPath), append(b, '\n'), 0644); err != nil {
+		errorLogger.Fatalf("Error writing %s: %v\n", fingerprintsPath(detailsPath), err)
+	}
+}
+
+// reuse says which parts of the previous details can stand in for inputs
+// that haven't changed
+type reuse struct {
+	dns bool
+	tls bool
+}
+
+// addPreviousResults adds a record holding each domain's previous details to
+// sorter, to diff against and to reuse the parts whose inputs didn't change
+func addPreviousResults(sorter *externalSorter, path string, progress time.Duration) {
+	in, err := openInput(path)
+	if err != nil {
+		errorLogger.Fatalf("Error opening previous details: %v\n", err)
+	}
+
+	err = in.scanLines(progress, func(l []byte) {
+		dr := new(results.DomainResults)
+		if err := json.Unmarshal(l, dr); err != nil {
+			errorLogger.Printf("Skipping bad line in %s: %v\n", path, err)
+			return
+		}
+		addRecord(sorter, dr.Domain, record{Kind: recordPrevious, Previous: dr})
+	})
+	if err != nil {
+		errorLogger.Fatalf("Error reading previous details: %v\n", err)
+	}
+	if err = in.Close(); err != nil {
+		errorLogger.Fatalf("Error closing %s: %v\n", path, err)
+	}
+}
+
+// usePrevious fills in the parts of the domain's results that come from
+// inputs that didn't change since the previous run
+func (dj *domainJoin) usePrevious(r reuse) {
+	prev := dj.previous
+	if prev == nil {
+		return
+	}
+	if r.dns {
+		dj.hasDNS = true
+		dj.dr.Rank = prev.Rank
+		dj.dr.HasV4 = prev.HasV4
+		dj.dr.HasV6 = prev.HasV6
+		dj.dr.V4DNS = prev.V4DNS
+		dj.dr.V6DNS = prev.V6DNS
+	}
+	if r.tls {
+		for _, a := range prev.V4TLS.Addresses {
+			dj.v4TLS[a.IP] = a.Reason
+		}
+		for _, a := range prev.V6TLS.Addresses {
+			dj.v6TLS[a.IP] = a.Reason
+		}
+	}
+}
+
+// Changes a domain can go through between two runs
+const (
+	ChangeAdded             = "added"
+	ChangeRemoved           = "removed"
+	ChangeGainedV4          = "gained-v4"
+	ChangeLostV4            = "lost-v4"
+	ChangeGainedV6          = "gained-v6"
+	ChangeLostV6            = "lost-v6"
+	ChangeGainedV4TLS       = "gained-v4-tls"
+	ChangeLostV4TLS         = "lost-v4-tls"
+	ChangeGainedV6TLS       = "gained-v6-tls"
+	ChangeLostV6TLS         = "lost-v6-tls"
+	ChangeCitizenLabAdded   = "citizen-lab-added"
+	ChangeCitizenLabRemoved = "citizen-lab-removed"
+)
+
+// DomainChange is one way a domain changed since the previous run, List is
+// the Citizen Lab list (a country code or GLOBAL) for the Citizen Lab changes
+type DomainChange struct {
+	Domain string `json:"domain"`
+	Change string `json:"change"`
+	List   string `json:"list,omitempty"`
+}
+
+// differ writes the changes between the previous and the new details of each
+// domain, one line of JSON at a time, and counts them
+type differ struct {
+	w      *bufio.Writer
+	file   *os.File
+	counts map[string]int
+}
+
+func newDiffer(path string) *differ {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+
+	return &differ{
+		w:      bufio.NewWriter(file),
+		file:   file,
+		counts: make(map[string]int),
+	}
+}
+
+func (d *differ) write(domain, change, list string) {
+	bs, err := json.Marshal(DomainChange{Domain: domain, Change: change, List: list})
+	if err != nil {
+		errorLogger.Fatalf("json.Marshal error: %v\n", err)
+	}
+	d.w.Write(bs)
+	d.w.WriteByte('\n')
+	d.counts[change]++
+}
+
+// flag writes gained or lost when a flag changed
+func (d *differ) flag(domain string, prev, now bool, gained, lost string) {
+	switch {
+	case !prev && now:
+		d.write(domain, gained, "")
+	case prev && !now:
+		d.write(domain, lost, "")
+	}
+}
+
+// citizenLabLists returns the Citizen Lab lists a domain is on
+func citizenLabLists(dr *results.DomainResults) map[string]bool {
+	ret := make(map[string]bool)
+	if dr.CitizenLabGlobalList {
+		ret["GLOBAL"] = true
+	}
+	for _, cc := range dr.CitizenLabCountryList {
+		ret[cc] = true
+	}
+
+	return ret
+}
+
+// sortedKeys returns the keys of m that aren't in other, sorted
+func sortedKeys(m, other map[string]bool) []string {
+	var ret []string
+	for k := range m {
+		if !other[k] {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+// compare writes how a domain changed, prev is nil for a domain that wasn't in
+// the previous run and now is nil for one that isn't in this run
+func (d *differ) compare(prev, now *results.DomainResults) {
+	switch {
+	case prev == nil && now == nil:
+		return
+	case prev == nil:
+		d.write(now.Domain, ChangeAdded, "")
+		return
+	case now == nil:
+		d.write(prev.Domain, ChangeRemoved, "")
+		return
+	}
+
+	domain := now.Domain
+	d.flag(domain, prev.HasV4, now.HasV4, ChangeGainedV4, ChangeLostV4)
+	d.flag(domain, prev.HasV6, now.HasV6, ChangeGainedV6, ChangeLostV6)
+	d.flag(domain, prev.HasV4TLS, now.HasV4TLS, ChangeGainedV4TLS, ChangeLostV4TLS)
+	d.flag(domain, prev.HasV6TLS, now.HasV6TLS, ChangeGainedV6TLS, ChangeLostV6TLS)
+	prevLists, nowLists := citizenLabLists(prev), citizenLabLists(now)
+	for _, list := range sortedKeys(nowLists, prevLists) {
+		d.write(domain, ChangeCitizenLabAdded, list)
+	}
+	for _, list := range sortedKeys(prevLists, nowLists) {
+		d.write(domain, ChangeCitizenLabRemoved, list)
+	}
+}
+
+// Close flushes the changes and logs how many of each there were
+func (d *differ) Close() {
+	if err := d.w.Flush(); err != nil {
+		errorLogger.Fatalf("Error writing diff: %v\n", err)
+	}
+	d.file.Close()
+	for _, change := range []string{
+		ChangeAdded, ChangeRemoved,
+		ChangeGainedV4, ChangeLostV4, ChangeGainedV6, ChangeLostV6,
+		ChangeGainedV4TLS, ChangeLostV4TLS, ChangeGainedV6TLS, ChangeLostV6TLS,
+		ChangeCitizenLabAdded, ChangeCitizenLabRemoved,
+	} {
+		infoLogger.Printf("%s: %d\n", change, d.counts[change])
+	}
+}
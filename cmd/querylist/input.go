@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxLineSize is the longest line read from an input, zgrab2 lines with long
+// certificate chains go well past bufio.Scanner's 64 KB default
+const maxLineSize = 64 * 1024 * 1024
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// countingReader counts the bytes read through it, so progress can be
+// reported as a share of the (possibly compressed) file
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+
+	return n, err
+}
+
+// input is an opened results file, decompressed if it was gzip or zstd
+type input struct {
+	io.Reader
+	path    string
+	size    int64
+	file    *os.File
+	counted *countingReader
+	closers []func() error
+}
+
+// openInput opens path, and decompresses it when it starts with the gzip or
+// zstd magic bytes
+func openInput(path string) (*input, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := &input{path: path, file: file}
+	if info, err := file.Stat(); err == nil {
+		ret.size = info.Size()
+	}
+	ret.counted = &countingReader{r: file}
+	buffered := bufio.NewReaderSize(ret.counted, 1024*1024)
+	ret.closers = append(ret.closers, file.Close)
+
+	magic, _ := buffered.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ret.Reader = gz
+		ret.closers = append([]func() error{gz.Close}, ret.closers...)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ret.Reader = zr
+		ret.closers = append([]func() error{func() error {
+			zr.Close()
+			return nil
+		}}, ret.closers...)
+	default:
+		ret.Reader = buffered
+	}
+
+	return ret, nil
+}
+
+// Close closes the decompressor and the file
+func (in *input) Close() error {
+	var ret error
+	for _, c := range in.closers {
+		if err := c(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// scanLines calls f with each line of in, logging progress every
+// progressEvery. The slice passed to f is only valid until f returns.
+func (in *input) scanLines(progressEvery time.Duration, f func(line []byte)) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1024*1024), maxLineSize)
+	start := time.Now()
+	last := start
+	var lines int64
+	for scanner.Scan() {
+		lines++
+		f(scanner.Bytes())
+		if lines%10000 == 0 && time.Since(last) >= progressEvery {
+			last = time.Now()
+			in.logProgress(lines, start)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: line %d: %v", in.path, lines+1, err)
+	}
+	infoLogger.Printf(
+		"Read %d lines of %s in %s\n",
+		lines,
+		in.path,
+		time.Since(start).Round(time.Second),
+	)
+
+	return nil
+}
+
+// logProgress logs how far into the file reading has gotten
+func (in *input) logProgress(lines int64, start time.Time) {
+	read := atomic.LoadInt64(&in.counted.n)
+	if in.size <= 0 {
+		infoLogger.Printf("%s: %d lines read\n", in.path, lines)
+		return
+	}
+	done := float64(read) / float64(in.size)
+	elapsed := time.Since(start)
+	var eta time.Duration
+	if done > 0 {
+		eta = time.Duration(float64(elapsed)/done) - elapsed
+	}
+	infoLogger.Printf(
+		"%s: %d lines read, %.1f%% done, about %s left\n",
+		in.path,
+		lines,
+		100*done,
+		eta.Round(time.Second),
+	)
+}
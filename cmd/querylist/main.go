@@ -2,19 +2,22 @@ package main
 
 import (
 	"bufio"
-	"crypto/x509"
-	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	normalize "github.com/timartiny/RipeProbe/normalize"
+	results "github.com/timartiny/RipeProbe/results"
+	zgrabtls "github.com/timartiny/RipeProbe/zgrabtls"
 	flags "github.com/zmap/zflags"
-	"github.com/zmap/zgrab2"
 )
 
 var infoLogger *log.Logger
@@ -44,109 +47,87 @@ type ZDNSAnswer struct {
 	Answer  string `json:"answer,omitempty" groups:"short,normal,long,trace"`
 }
 
-type IPSupportsTLS map[string]bool
-
-type TLSResults struct {
-	Domain    string
-	Addresses IPSupportsTLS
-}
-
-type TLSResultsMap map[string]*TLSResults
-
-type DomainResults struct {
-	Domain                string   `json:"domain,omitempty"`
-	Rank                  int      `json:"tranco_rank,omitempty"`
-	HasV4                 bool     `json:"has_v4"`
-	HasV6                 bool     `json:"has_v6"`
-	HasV4TLS              bool     `json:"has_v4_tls"`
-	HasV6TLS              bool     `json:"has_v6_tls"`
-	CitizenLabGlobalList  bool     `json:"citizen_lab_global_list"`
-	CitizenLabCountryList []string `json:"citizen_lab_country_list"`
-}
-
-type DomainResultsMap map[string]*DomainResults
-
 type QuerylistFlags struct {
-	V4DNS               string `long:"v4_dns" description:"Path to the ZDNS results for v4 lookups" required:"true" json:"v4_dns"`
-	V6DNS               string `long:"v6_dns" description:"Path to the ZDNS results for v6 lookups" required:"true" json:"v6_dns"`
-	V4TLS               string `long:"v4_tls" description:"Path to the ZGrab results for v4 TLS banner grabs" required:"true" json:"v4_tls"`
-	V4DupTLS            string `long:"v4_dup_tls" description:"Path to the ZGrab results for v4 TLS banner grabs, duplication for timeouts" json:"v4_dup_tls"`
-	V6TLS               string `long:"v6_tls" description:"Path to the ZGrab results for v6 TLS banner grabs" required:"true" json:"v6_tls"`
-	V6DupTLS            string `long:"v6_dup_tls" description:"Path to the ZGrab results for v6 TLS banner grabs, duplication for timeouts" json:"v6_dup_tls"`
-	CitizenLabDirectory string `long:"citizen_lab_directory" description:"Path to the directory containing the Citizen Lab lists" required:"true" json:"citizen_lab_directory"`
-	Outfile             string `long:"out_file" description:"File to write all details to (in JSON)" required:"true" json:"out_file"`
-}
-
-// removes protocol and www. subdomains and ending slash
-func stripUrl(url string) string {
-	protoIndex := strings.Index(url, "://")
-	var hostAndPath string
-	if protoIndex != -1 {
-		hostAndPath = url[protoIndex+3:]
-	} else {
-		hostAndPath = url
-	}
-	wwwIndex := strings.Index(hostAndPath, "www.")
-	if wwwIndex != -1 {
-		hostAndPath = hostAndPath[wwwIndex+4:]
-	}
-	hostAndPathLen := len(hostAndPath)
-	if hostAndPathLen > 0 && hostAndPath[hostAndPathLen-1] == '/' {
-		hostAndPath = hostAndPath[:hostAndPathLen-1]
-	}
-
-	return hostAndPath
+	V4DNS               string   `long:"v4_dns" description:"Path to the ZDNS results for v4 lookups" required:"true" json:"v4_dns"`
+	V6DNS               string   `long:"v6_dns" description:"Path to the ZDNS results for v6 lookups" required:"true" json:"v6_dns"`
+	V4TLS               string   `long:"v4_tls" description:"Path to the ZGrab results for v4 TLS banner grabs" required:"true" json:"v4_tls"`
+	V4DupTLS            string   `long:"v4_dup_tls" description:"Path to the ZGrab results for v4 TLS banner grabs, duplication for timeouts" json:"v4_dup_tls"`
+	V6TLS               string   `long:"v6_tls" description:"Path to the ZGrab results for v6 TLS banner grabs" required:"true" json:"v6_tls"`
+	V6DupTLS            string   `long:"v6_dup_tls" description:"Path to the ZGrab results for v6 TLS banner grabs, duplication for timeouts" json:"v6_dup_tls"`
+	CitizenLabDirectory string   `long:"citizen_lab_directory" description:"Path to the directory containing the Citizen Lab lists" required:"true" json:"citizen_lab_directory"`
+	Rankings            []string `long:"ranking" description:"A popularity list to record each domain's rank on, as comma separated key=value pairs: source and path, and optionally format (rank_domain, crux or csv), id, date and country. Can be given more than once" json:"rankings"`
+	RegistrableDomain   bool     `long:"registrable_domain" description:"Reduce Citizen Lab URLs to their registrable domain (e.g. news.bbc.co.uk to bbc.co.uk) before matching" json:"registrable_domain"`
+	RootStore           string   `long:"root_store" description:"PEM bundle of root certificates to verify TLS certificates against (e.g. a Mozilla root store snapshot from the scan date), the system roots by default" json:"root_store"`
+	TLSPolicy           string   `long:"tls_policy" default:"all" description:"When a domain supports TLS on an IP version: all (every address has a valid certificate), any, or a fraction of its addresses such as 0.5" json:"tls_policy"`
+	Previous            string   `long:"previous" description:"Full details output of an earlier run, inputs that haven't changed since are reused from it instead of read again" json:"previous"`
+	DiffFile            string   `long:"diff_file" description:"File to write the changes since --previous to (in JSON)" json:"diff_file"`
+	TmpDir              string   `long:"tmp_dir" description:"Directory for the temporary sorted runs, the system's temporary directory by default" json:"tmp_dir"`
+	RunSize             int      `long:"run_size" default:"1000000" description:"Number of records to sort in memory at a time, more uses more memory and fewer temporary files" json:"run_size"`
+	ProgressSeconds     int      `long:"progress_seconds" default:"30" description:"Seconds between progress updates while reading inputs" json:"progress_seconds"`
+	Outfile             string   `long:"out_file" description:"File to write all details to (in JSON)" required:"true" json:"out_file"`
 }
 
 // assumes file has form:
 // url,category_code,category_description,date_added,source,notes
-// url has protocol (http[s]), might have www. and an ending slash
-// this function will remove them all.
-func getBlocked(path string) map[string]interface{} {
-	ret := make(map[string]interface{})
+// each url is normalized down to its domain (see the normalize package) and
+// the rest of each row is kept keyed by that domain. stats counts the rows and
+// those that couldn't be normalized.
+func getBlocked(
+	path, list string, opts normalize.Options,
+) (map[string][]results.CitizenLabEntry, normalize.Stats) {
+	ret := make(map[string][]results.CitizenLabEntry)
+	var stats normalize.Stats
 	file, err := os.Open(path)
 	if err != nil {
 		errorLogger.Fatalf("Can't open file, %s, %v\n", path, err)
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	if scanner.Scan() {
-		// clear first line, citizen lab adds a header line
-		scanner.Text()
-	} else {
-		errorLogger.Fatalf("File didn't have any lines\n")
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	// citizen lab adds a header line, use it to find the columns
+	header, err := reader.Read()
+	if err != nil {
+		errorLogger.Fatalf("File didn't have any lines, %s, %v\n", path, err)
 	}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		url := strings.Split(line, ",")[0]
-		strippedUrl := stripUrl(url)
-		ret[strippedUrl] = nil
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
 	}
-
-	return ret
-}
-
-// writeToFile will write the results map to the provided file
-// one line of JSON at a time.
-func writeToFile(drm DomainResultsMap, path string) {
-	infoLogger.Printf("Writing to %s\n", path)
-	file, err := os.Create(path)
-	if err != nil {
-		errorLogger.Printf("Can't open file %s: %v", path, err)
-		os.Exit(1)
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
 	}
-	defer file.Close()
 
-	for _, dr := range drm {
-		bs, err := json.Marshal(dr)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			errorLogger.Printf("json.Marshal error: %v\n", err)
-			os.Exit(2)
+			errorLogger.Printf("Skipping bad line in %s, %v\n", path, err)
+			continue
+		}
+		url := field(record, "url")
+		stats.Entries++
+		domain, err := normalize.Domain(url, opts)
+		if err != nil {
+			stats.Failed++
+			continue
 		}
-		file.WriteString(string(bs) + "\n")
+		ret[domain] = append(ret[domain], results.CitizenLabEntry{
+			List:                list,
+			URL:                 url,
+			CategoryCode:        field(record, "category_code"),
+			CategoryDescription: field(record, "category_description"),
+			DateAdded:           field(record, "date_added"),
+			Source:              field(record, "source"),
+		})
 	}
 
+	return ret, stats
 }
 
 // setupArgs grabs the commandline arguments and puts them in a usable struct
@@ -161,227 +142,306 @@ func setupArgs(args []string) QuerylistFlags {
 	if len(posArgs) > 0 {
 		infoLogger.Printf("Extra arguments provided, but not used: %v\n", args)
 	}
+	if len(ret.DiffFile) > 0 && len(ret.Previous) == 0 {
+		errorLogger.Fatalf("--diff_file needs the --previous details to compare to\n")
+	}
 
 	return ret
 }
 
-// addDNSResults will take a path to the DNS results (in ZDNS form) and update
-// drm.
-func addDNSResults(drm DomainResultsMap, path string) {
-	file, err := os.Open(path)
+// record is what one line of a ZDNS, ZGrab or ranking input says about a
+// domain. Every input is reduced to records, which are sorted by domain so all
+// of a domain's records can be joined without holding every domain in memory.
+type record struct {
+	Kind   string `json:"kind"`
+	Rank   int    `json:"rank,omitempty"`
+	HasV4  bool   `json:"has_v4,omitempty"`
+	HasV6  bool   `json:"has_v6,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// V6 is set on the records of the AAAA lookups
+	V6     bool               `json:"v6,omitempty"`
+	Lookup *results.DNSLookup `json:"lookup,omitempty"`
+	// Previous is the domain's details from the --previous run
+	Previous *results.DomainResults `json:"previous,omitempty"`
+	// Ranking is the domain's rank on one --ranking list
+	Ranking *results.Ranking `json:"ranking,omitempty"`
+}
+
+// Kinds of record
+const (
+	recordDNS      = "dns"
+	recordTLS      = "tls"
+	recordPrevious = "previous"
+	recordRanking  = "ranking"
+)
+
+// addRecord adds rec to the sorter keyed by domain. A tab sorts before any
+// character allowed in a domain, so a domain's lines stay together.
+func addRecord(sorter *externalSorter, domain string, rec record) {
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		errorLogger.Fatalf("json.Marshal error: %v\n", err)
+	}
+	if err = sorter.Add(domain + "\t" + string(bs)); err != nil {
+		errorLogger.Fatalf("Error writing sorted run: %v\n", err)
+	}
+}
+
+// addDNSResults will take a path to the DNS results (in ZDNS form) and add a
+// record of each domain's addresses, CNAMEs and resolver to sorter. v6 is set
+// for the results of the AAAA lookups.
+func addDNSResults(
+	sorter *externalSorter, path string, v6 bool, progress time.Duration,
+) {
+	in, err := openInput(path)
 	if err != nil {
 		errorLogger.Printf("os.Open err: %v\n", err)
 		errorLogger.Fatalln("Please provide a valid file using the --v{4,6}_dns flag")
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
+	err = in.scanLines(progress, func(l []byte) {
 		var zdnsResult ZDNSResult
-		l := scanner.Text()
-		json.Unmarshal([]byte(l), &zdnsResult)
+		json.Unmarshal(l, &zdnsResult)
 		domainName := zdnsResult.Name
-		// infoLogger.Printf("the domain name is: %s\n", domainName)
-		if _, ok := drm[domainName]; !ok {
-			// this domain is not already in the mapping, add it now.
-			tmp := new(DomainResults)
-			tmp.Domain = domainName
-			tmp.Rank = zdnsResult.AlexaRank
-			drm[domainName] = tmp
-		}
-		interfaceAnswers, ok := zdnsResult.Data.(map[string]interface{})["answers"]
+		lookup := &results.DNSLookup{
+			Resolver: zdnsResult.Nameserver,
+			Status:   zdnsResult.Status,
+		}
+		rec := record{
+			Kind:   recordDNS,
+			Rank:   zdnsResult.AlexaRank,
+			V6:     v6,
+			Lookup: lookup,
+		}
+		data, _ := zdnsResult.Data.(map[string]interface{})
+		if len(lookup.Resolver) == 0 {
+			// some zdns versions put the resolver in with the answers
+			lookup.Resolver, _ = data["resolver"].(string)
+		}
+		interfaceAnswers, ok := data["answers"].([]interface{})
 		if !ok {
 			// infoLogger.Printf("This results has no answers, domain: %s\n", domainName)
-			continue
+			addRecord(sorter, domainName, rec)
+			return
 		}
-		zdnsAnswers := interfaceAnswers.([]interface{})
-		for _, interfaceAnswer := range zdnsAnswers {
+		for _, interfaceAnswer := range interfaceAnswers {
 			tmpJSONString, _ := json.Marshal(interfaceAnswer)
 			var answer ZDNSAnswer
 			json.Unmarshal(tmpJSONString, &answer)
-			if answer.Type == "A" {
+			dnsAnswer := results.DNSAnswer{
+				Name:   strings.TrimSuffix(answer.Name, "."),
+				Answer: strings.TrimSuffix(answer.Answer, "."),
+				TTL:    answer.Ttl,
+			}
+			switch answer.Type {
+			case "A":
 				ip := net.ParseIP(answer.Answer)
 				if ip != nil && ip.To4() != nil {
-					drm[domainName].HasV4 = true
-					break
+					rec.HasV4 = true
+					lookup.Addresses = append(lookup.Addresses, dnsAnswer)
 				}
-			} else if answer.Type == "AAAA" {
+			case "AAAA":
 				ip := net.ParseIP(answer.Answer)
 				if ip != nil && ip.To4() == nil {
-					drm[domainName].HasV6 = true
+					rec.HasV6 = true
+					lookup.Addresses = append(lookup.Addresses, dnsAnswer)
 				}
+			case "CNAME":
+				lookup.CNAMEs = append(lookup.CNAMEs, dnsAnswer)
 			}
 		}
+		addRecord(sorter, domainName, rec)
+	})
+	if err != nil {
+		errorLogger.Fatalf("Error reading DNS results: %v\n", err)
+	}
+	// a gzip checksum mismatch is only reported by Close
+	if err = in.Close(); err != nil {
+		errorLogger.Fatalf("Error closing %s: %v\n", path, err)
 	}
 }
 
-// addTLSResults will take the results of ZGrab2 tls banner grab and store
-// collection of IPs and whether they have a valid TLS cert in trm
-func addTLSResults(trm TLSResultsMap, path string) {
-	file, err := os.Open(path)
+// addTLSResults will take the results of ZGrab2 tls banner grab and add a
+// record of whether each IP has a valid TLS cert, and why not, to sorter
+func addTLSResults(
+	sorter *externalSorter,
+	verifier *zgrabtls.Verifier,
+	path string,
+	progress time.Duration,
+) {
+	in, err := openInput(path)
 	if err != nil {
 		errorLogger.Printf("os.Open err: %v\n", err)
 		errorLogger.Fatalln("Please provide a valid file using the --v{4,6}_tls flag")
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
 
-	for scanner.Scan() {
-		var zgrabResult zgrab2.Grab
-		l := scanner.Text()
-		json.Unmarshal([]byte(l), &zgrabResult)
-		domainName := zgrabResult.Domain
-		if _, ok := trm[domainName]; !ok {
-			// this domain is not already in the mapping, add it now.
-			tmpTLSResults := new(TLSResults)
-			tmpTLSResults.Domain = domainName
+	err = in.scanLines(progress, func(l []byte) {
+		grab, err := zgrabtls.Decode(l)
+		if err != nil {
+			errorLogger.Printf("Skipping undecodable ZGrab line: %v\n", err)
+			return
+		}
+		result := verifier.Verify(grab)
+		if result.Reason == zgrabtls.ReasonMalformed {
+			errorLogger.Printf(
+				"Malformed grab of %s for %s: %v\n",
+				result.IP,
+				result.Domain,
+				result.Err,
+			)
+		}
+		addRecord(sorter, grab.Domain, record{
+			Kind:   recordTLS,
+			IP:     grab.IP,
+			Reason: result.Reason,
+		})
+	})
+	if err != nil {
+		errorLogger.Fatalf("Error reading TLS results: %v\n", err)
+	}
+	// a gzip checksum mismatch is only reported by Close
+	if err = in.Close(); err != nil {
+		errorLogger.Fatalf("Error closing %s: %v\n", path, err)
+	}
+}
 
-			tmpTLSResults.Addresses = IPSupportsTLS{zgrabResult.IP: false}
-			trm[domainName] = tmpTLSResults
+// summarizeTLS counts the valid and invalid addresses of one IP version,
+// given the reason for each address. This will print out anomalies like only
+// some IPs supporting TLS
+func summarizeTLS(domain string, addresses map[string]string) results.TLSSummary {
+	var ret results.TLSSummary
+	for ip, reason := range addresses {
+		if reason == zgrabtls.ReasonValid {
+			ret.Valid++
 		} else {
-			if v, ok := trm[domainName].Addresses[zgrabResult.IP]; ok && v {
-				// we've already seen this and it supports TLS, no need to check
-				// again
-				continue
-			} else {
-				trm[domainName].Addresses[zgrabResult.IP] = false
-			}
+			ret.Invalid++
 		}
+		ret.Addresses = append(ret.Addresses, results.TLSAddress{IP: ip, Reason: reason})
+	}
+	sort.Slice(ret.Addresses, func(i, j int) bool {
+		return ret.Addresses[i].IP < ret.Addresses[j].IP
+	})
+	if ret.Partial() {
+		infoLogger.Printf(
+			"Unusual Situation: not all IPs for domain %s have the"+
+				" same value on supporting TLS: %#v\n",
+			domain,
+			addresses,
+		)
+	}
 
-		tlsScanResults, ok := zgrabResult.Data["tls"]
-		if !ok {
-			// infoLogger.Printf("This results has no tls section, domain: %s\n", domainName)
-			continue
-		}
-		if tlsScanResults.Status != "success" {
-			// infoLogger.Printf("This results is a non-successful tls result: %s, %s\n", domainName, tlsScanResults.Status)
-			continue
-		}
+	return ret
+}
 
-		timestampString := tlsScanResults.Timestamp
-		timestamp, err := time.Parse(time.RFC3339, timestampString)
-		if err != nil {
-			errorLogger.Printf("Error parsing timestamp: %s\n", timestampString)
-			continue
-		}
-		serverHandshakeInterface := tlsScanResults.Result.(map[string]interface{})["handshake_log"].(map[string]interface{})
-		serverCertificatesInterface := serverHandshakeInterface["server_certificates"].(map[string]interface{})
-		leafCertificateInterface := serverCertificatesInterface["certificate"].(map[string]interface{})
-		rawLeafCertificate := leafCertificateInterface["raw"].(string)
+// domainJoin collects the records of one domain
+type domainJoin struct {
+	dr     *results.DomainResults
+	hasDNS bool
+	// v4TLS and v6TLS are the reason each IP has a valid cert or not, when
+	// an IP was grabbed more than once the most telling reason is kept
+	v4TLS map[string]string
+	v6TLS map[string]string
+	// previous is the domain's details from the --previous run, if any
+	previous *results.DomainResults
+}
 
-		decoded, err := base64.StdEncoding.DecodeString(string(rawLeafCertificate))
-		if err != nil {
-			errorLogger.Printf("base64.Decode of cert err: %v\n", err)
-			continue
+func newDomainJoin(domain string) *domainJoin {
+	return &domainJoin{
+		dr:    &results.DomainResults{Domain: domain},
+		v4TLS: make(map[string]string),
+		v6TLS: make(map[string]string),
+	}
+}
+
+// add folds rec into the domain's results
+func (dj *domainJoin) add(rec record) {
+	switch rec.Kind {
+	case recordDNS:
+		dj.hasDNS = true
+		if rec.Rank > 0 && (dj.dr.Rank == 0 || rec.Rank < dj.dr.Rank) {
+			dj.dr.Rank = rec.Rank
 		}
-		x509Cert, err := x509.ParseCertificate(decoded)
-		if err != nil {
-			errorLogger.Printf("x509.ParseCertificate of cert err: %v\n", err)
-			errorLogger.Printf("decoded certificate: %v\n", decoded)
-			continue
+		dj.dr.HasV4 = dj.dr.HasV4 || rec.HasV4
+		dj.dr.HasV6 = dj.dr.HasV6 || rec.HasV6
+		lookup := &dj.dr.V4DNS
+		if rec.V6 {
+			lookup = &dj.dr.V6DNS
 		}
-		err = x509Cert.VerifyHostname(domainName)
-		if err != nil {
-			continue
+		// when a domain was looked up more than once keep a lookup with
+		// addresses
+		if rec.Lookup != nil && len(lookup.Addresses) == 0 {
+			*lookup = *rec.Lookup
 		}
-
-		certPool := x509.NewCertPool()
-		var chain []interface{}
-		if serverCertificatesInterface["chain"] != nil {
-			chain = serverCertificatesInterface["chain"].([]interface{})
+	case recordPrevious:
+		dj.previous = rec.Previous
+	case recordRanking:
+		if rec.Ranking != nil {
+			dj.addRanking(*rec.Ranking)
 		}
-
-		for ind, mInterface := range chain {
-			raw := mInterface.(map[string]interface{})["raw"]
-			chainDecoded, err := base64.StdEncoding.DecodeString(raw.(string))
-			if err != nil {
-				errorLogger.Printf("base64.Decode of chain ind %d err: %v\n", ind, err)
-				continue
-			}
-
-			chainCert, err := x509.ParseCertificate(chainDecoded)
-			if err != nil {
-				errorLogger.Printf("x509.ParseCertificate for chain ind %d err: %v\n", ind, err)
-				continue
-			}
-			certPool.AddCert(chainCert)
+	case recordTLS:
+		ip := net.ParseIP(rec.IP)
+		if ip == nil {
+			return
 		}
-
-		verifyOptions := x509.VerifyOptions{
-			DNSName:       domainName,
-			CurrentTime:   timestamp,
-			Intermediates: certPool,
+		addresses := dj.v6TLS
+		if ip.To4() != nil {
+			addresses = dj.v4TLS
 		}
-		_, err = x509Cert.Verify(verifyOptions)
-		if err == nil {
-			trm[domainName].Addresses[zgrabResult.IP] = true
+		if have, ok := addresses[rec.IP]; !ok || zgrabtls.Better(rec.Reason, have) {
+			addresses[rec.IP] = rec.Reason
 		}
 	}
 }
 
-// parseTLSResults will go throw the TLSResultsMap to determine whether a domain
-// supports TLS	on either v4 or v6. A domain supports TLS if all of the IPs do
-// This will print out anomalies like only some IPs supporting TLS
-func parseTLSResults(trm TLSResultsMap, drm DomainResultsMap) {
-	for domain, tlsResults := range trm {
-		var domainSupportsTLS *bool
-		var addressType string
-		for ipString, ipSupportsTLS := range tlsResults.Addresses {
-			ip := net.ParseIP(ipString)
-			if ip.To4() == nil {
-				addressType = "AAAA"
-			} else {
-				addressType = "A"
-			}
-			if domainSupportsTLS == nil {
-				// this is the first iteration through
-				domainSupportsTLS = &ipSupportsTLS
-			} else if ipSupportsTLS != *domainSupportsTLS {
-				infoLogger.Printf(
-					"Unusual Situation: not all IPs for domain %s have the"+
-						" same value on supporting TLS: %#v\n",
-					domain,
-					tlsResults.Addresses,
-				)
-				*domainSupportsTLS = false
-				break
-			}
-		}
-		if _, ok := drm[domain]; !ok {
-			// only for debugging when DNS results don't happen first
-			continue
-		}
-
-		if addressType == "A" {
-			drm[domain].HasV4TLS = *domainSupportsTLS
-		} else if addressType == "AAAA" {
-			drm[domain].HasV6TLS = *domainSupportsTLS
+// contains returns true if s is in arr
+func contains(arr []string, s string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
 		}
 	}
+
+	return false
 }
 
-// Updates existing tech details with a given file's contents
-func addCountryBlockage(drm DomainResultsMap, path, countryCode string) {
-	blockedDomains := getBlocked(path)
-	for dom, dr := range drm {
-		if _, ok := blockedDomains[dom]; !ok {
-			// this domain isn't on this country's blocked list, so nothing to add
-			continue
-		}
+// citizenLabList is one Citizen Lab list, its entries keyed by domain and how
+// many of them matched
+type citizenLabList struct {
+	fileName    string
+	countryCode string
+	blocked     map[string][]results.CitizenLabEntry
+	stats       normalize.Stats
+}
 
-		if countryCode == "GLOBAL" {
-			dr.CitizenLabGlobalList = true
-		} else {
-			dr.CitizenLabCountryList = append(dr.CitizenLabCountryList, countryCode)
+// Updates a domain's details with a list's entries for it
+func addCountryBlockage(dr *results.DomainResults, list *citizenLabList) {
+	entries, ok := list.blocked[dr.Domain]
+	if !ok {
+		// this domain isn't on this country's blocked list, so nothing to add
+		return
+	}
+	list.stats.Matched += len(entries)
+
+	if list.countryCode == "GLOBAL" {
+		dr.CitizenLabGlobalList = true
+	} else {
+		dr.CitizenLabCountryList = append(dr.CitizenLabCountryList, list.countryCode)
+	}
+	dr.CitizenLabEntries = append(dr.CitizenLabEntries, entries...)
+	for _, entry := range entries {
+		if len(entry.CategoryCode) > 0 &&
+			!contains(dr.CitizenLabCategories, entry.CategoryCode) {
+			dr.CitizenLabCategories = append(
+				dr.CitizenLabCategories, entry.CategoryCode,
+			)
 		}
 	}
 }
 
-// fillInCitizenLabData will read each of the lists from Citizen Lab and fill
-// in for each domain
-func fillInCitizenLabData(drm DomainResultsMap, path string) {
+// readCitizenLabLists will read each of the lists from Citizen Lab, they are
+// small enough to keep in memory while the domains stream past
+func readCitizenLabLists(path string, opts normalize.Options) []*citizenLabList {
 	files, err := os.ReadDir(path)
 	if err != nil {
 		errorLogger.Fatalf("Error checking Citizen Lab List directory: %v\n", err)
@@ -391,13 +451,132 @@ func fillInCitizenLabData(drm DomainResultsMap, path string) {
 	if err != nil {
 		errorLogger.Fatalf("Error with regex pattern: %v\n", err)
 	}
+	var ret []*citizenLabList
 	for _, file := range files {
 		fileName := file.Name()
 		if fileName == "global.csv" || matcher.Match([]byte(fileName)) {
 			countryCode := strings.ToUpper(strings.Split(fileName, ".")[0])
-			addCountryBlockage(drm, filepath.Join(path, fileName), countryCode)
+			list := &citizenLabList{fileName: fileName, countryCode: countryCode}
+			list.blocked, list.stats = getBlocked(
+				filepath.Join(path, fileName), countryCode, opts,
+			)
+			ret = append(ret, list)
 		}
 	}
+
+	return ret
+}
+
+// logCitizenLabStats logs how many of each list's entries matched a domain
+func logCitizenLabStats(lists []*citizenLabList) {
+	for _, list := range lists {
+		infoLogger.Printf(
+			"%s: %d entries, %d couldn't be normalized, %d matched a "+
+				"domain (%.1f%%)\n",
+			list.fileName,
+			list.stats.Entries,
+			list.stats.Failed,
+			list.stats.Matched,
+			100*list.stats.MatchRate(),
+		)
+	}
+}
+
+// joinResults merges the sorted records, fills in the Citizen Lab data, counts
+// the domains on each ranking list and
+// writes each domain's details to path, one line of JSON at a time, as soon as
+// all of its records have been read. A domain supports TLS on an IP version
+// when its addresses of that version satisfy policy. The parts of the previous
+// run's details that r allows stand in for inputs that weren't read, and when
+// diff isn't nil each domain is compared to its previous details. Returns the
+// number of domains written and how many of them only had valid TLS on some
+// addresses.
+func joinResults(
+	sorter *externalSorter,
+	lists []*citizenLabList,
+	rankings []*rankingList,
+	policy results.TLSPolicy,
+	r reuse,
+	diff *differ,
+	path string,
+) (int, int) {
+	infoLogger.Printf("Writing to %s\n", path)
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Printf("Can't open file %s: %v", path, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1024*1024)
+
+	var written, partial int
+	var current *domainJoin
+	finish := func() {
+		if current == nil {
+			return
+		}
+		current.usePrevious(r)
+		if !current.hasDNS {
+			// TLS results for a domain without DNS results, nothing to add
+			// them to. The domain might have been dropped since last time.
+			if diff != nil {
+				diff.compare(current.previous, nil)
+			}
+			return
+		}
+		dr := current.dr
+		dr.V4TLS = summarizeTLS(dr.Domain, current.v4TLS)
+		dr.V6TLS = summarizeTLS(dr.Domain, current.v6TLS)
+		dr.HasV4TLS = dr.V4TLS.Supports(policy)
+		dr.HasV6TLS = dr.V6TLS.Supports(policy)
+		if dr.V4TLS.Partial() || dr.V6TLS.Partial() {
+			partial++
+		}
+		for _, list := range lists {
+			addCountryBlockage(dr, list)
+		}
+		countRankings(dr, rankings)
+		if diff != nil {
+			diff.compare(current.previous, dr)
+		}
+		if dr.Domain == "google.com" || dr.Domain == "netflix.com" {
+			infoLogger.Printf("%s's final results: %+v\n", dr.Domain, dr)
+		}
+		bs, err := json.Marshal(dr)
+		if err != nil {
+			errorLogger.Printf("json.Marshal error: %v\n", err)
+			os.Exit(2)
+		}
+		w.Write(bs)
+		w.WriteByte('\n')
+		written++
+	}
+
+	err = sorter.Merge(func(line string) {
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return
+		}
+		domain := line[:tab]
+		var rec record
+		if err := json.Unmarshal([]byte(line[tab+1:]), &rec); err != nil {
+			errorLogger.Fatalf("Error reading sorted record %q: %v\n", line, err)
+		}
+		if current == nil || current.dr.Domain != domain {
+			finish()
+			current = newDomainJoin(domain)
+		}
+		current.add(rec)
+	})
+	if err != nil {
+		errorLogger.Fatalf("Error merging sorted runs: %v\n", err)
+	}
+	finish()
+	if err = w.Flush(); err != nil {
+		errorLogger.Fatalf("Error writing to %s: %v\n", path, err)
+	}
+
+	return written, partial
 }
 
 func main() {
@@ -413,45 +592,93 @@ func main() {
 	)
 
 	args := setupArgs(os.Args[1:])
+	progress := time.Duration(args.ProgressSeconds) * time.Second
 
-	domainResultsMap := make(DomainResultsMap)
-	infoLogger.Printf("Reading in v4 DNS query results from %s\n", args.V4DNS)
-	addDNSResults(domainResultsMap, args.V4DNS)
-	infoLogger.Printf("Google's results so far: %+v\n", domainResultsMap["google.com"])
-	infoLogger.Printf("Netflix's results so far: %+v\n", domainResultsMap["netflix.com"])
-
-	infoLogger.Printf("Reading in v6 DNS query results from %s\n", args.V6DNS)
-	addDNSResults(domainResultsMap, args.V6DNS)
-	infoLogger.Printf("Google's results so far: %+v\n", domainResultsMap["google.com"])
-	infoLogger.Printf("Netflix's results so far: %+v\n", domainResultsMap["netflix.com"])
-
-	tlsResultsMap := make(TLSResultsMap)
-	infoLogger.Printf("Reading in v4 TLS banner grab results from %s\n", args.V4TLS)
-	addTLSResults(tlsResultsMap, args.V4TLS)
-	if len(args.V4DupTLS) > 0 {
-		// do it again with the duplicate TLS scans
-		addTLSResults(tlsResultsMap, args.V4DupTLS)
-	}
-	parseTLSResults(tlsResultsMap, domainResultsMap)
-	infoLogger.Printf("Google's results so far: %+v\n", domainResultsMap["google.com"])
-	infoLogger.Printf("Netflix's results so far: %+v\n", domainResultsMap["netflix.com"])
-
-	tlsResultsMap = make(TLSResultsMap)
-	infoLogger.Printf("Reading in v6 TLS banner grab results from %s\n", args.V6TLS)
-	addTLSResults(tlsResultsMap, args.V6TLS)
-	if len(args.V6DupTLS) > 0 {
-		// do it again with the duplicate TLS scans
-		addTLSResults(tlsResultsMap, args.V6DupTLS)
-	}
-	parseTLSResults(tlsResultsMap, domainResultsMap)
-	infoLogger.Printf("Google's results so far: %+v\n", domainResultsMap["google.com"])
-	infoLogger.Printf("Netflix's results so far: %+v\n", domainResultsMap["netflix.com"])
-
-	infoLogger.Printf("Filling in Citizen Lab data from %s\n", args.CitizenLabDirectory)
-	fillInCitizenLabData(domainResultsMap, args.CitizenLabDirectory)
-	infoLogger.Printf("Google's final results: %+v\n", domainResultsMap["google.com"])
-	infoLogger.Printf("Netflix's final results: %+v\n", domainResultsMap["netflix.com"])
+	policy, err := results.ParseTLSPolicy(args.TLSPolicy)
+	if err != nil {
+		errorLogger.Fatalf("Error with --tls_policy: %v\n", err)
+	}
+
+	verifier := new(zgrabtls.Verifier)
+	if len(args.RootStore) > 0 {
+		roots, err := zgrabtls.LoadRoots(args.RootStore)
+		if err != nil {
+			errorLogger.Fatalf("Error loading root store: %v\n", err)
+		}
+		verifier.Roots = roots
+	}
+
+	sorter := newExternalSorter(args.TmpDir, args.RunSize)
+	defer sorter.Cleanup()
+
+	fingerprints := getInputFingerprints(args)
+	var r reuse
+	var diff *differ
+	if len(args.Previous) > 0 {
+		if prevFingerprints, ok := readInputFingerprints(args.Previous); ok {
+			r.dns = fingerprints.dnsUnchanged(prevFingerprints)
+			// the previous details only have TLS results for the domains it
+			// had DNS results for, so new domains would lose theirs
+			r.tls = r.dns && fingerprints.tlsUnchanged(prevFingerprints)
+		} else {
+			infoLogger.Printf(
+				"No input fingerprints for %s, reading every input\n",
+				args.Previous,
+			)
+		}
+		infoLogger.Printf("Reading in previous details from %s\n", args.Previous)
+		addPreviousResults(sorter, args.Previous, progress)
+		if len(args.DiffFile) > 0 {
+			diff = newDiffer(args.DiffFile)
+		}
+	}
+
+	if r.dns {
+		infoLogger.Printf("DNS results haven't changed, reusing the previous ones\n")
+	} else {
+		infoLogger.Printf("Reading in v4 DNS query results from %s\n", args.V4DNS)
+		addDNSResults(sorter, args.V4DNS, false, progress)
+		infoLogger.Printf("Reading in v6 DNS query results from %s\n", args.V6DNS)
+		addDNSResults(sorter, args.V6DNS, true, progress)
+	}
+
+	if r.tls {
+		infoLogger.Printf("TLS results haven't changed, reusing the previous ones\n")
+	} else {
+		for _, path := range []string{args.V4TLS, args.V4DupTLS, args.V6TLS, args.V6DupTLS} {
+			if len(path) == 0 {
+				// the duplicate scans for timeouts are optional
+				continue
+			}
+			infoLogger.Printf("Reading in TLS banner grab results from %s\n", path)
+			addTLSResults(sorter, verifier, path, progress)
+		}
+	}
+
+	rankings := parseRankingLists(args.Rankings)
+	for _, list := range rankings {
+		infoLogger.Printf("Reading in %s ranking from %s\n", list.ranking.Source, list.path)
+		addRankings(sorter, list, progress)
+	}
+
+	infoLogger.Printf("Reading in Citizen Lab data from %s\n", args.CitizenLabDirectory)
+	lists := readCitizenLabLists(
+		args.CitizenLabDirectory,
+		normalize.Options{Registrable: args.RegistrableDomain},
+	)
 
 	infoLogger.Printf("Writing all results to: %s\n", args.Outfile)
-	writeToFile(domainResultsMap, args.Outfile)
+	written, partial := joinResults(sorter, lists, rankings, policy, r, diff, args.Outfile)
+	infoLogger.Printf(
+		"Wrote %d domains, %d with valid TLS on only some addresses\n",
+		written,
+		partial,
+	)
+	logCitizenLabStats(lists)
+	logRankingStats(rankings)
+	if diff != nil {
+		infoLogger.Printf("Changes since %s written to %s\n", args.Previous, args.DiffFile)
+		diff.Close()
+	}
+	writeInputFingerprints(fingerprints, args.Outfile)
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	normalize "github.com/timartiny/RipeProbe/normalize"
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// Formats of ranking lists
+const (
+	// formatRankDomain is "rank,domain" without a header, as Tranco, Cisco
+	// Umbrella and Alexa publish their top lists
+	formatRankDomain = "rank_domain"
+	// formatCrUX is a CrUX top list, a header then "origin,rank" where rank is
+	// a bucket (1000, 5000, ...)
+	formatCrUX = "crux"
+	// formatCSV is any CSV whose header names a domain (or origin or url)
+	// column and a rank column
+	formatCSV = "csv"
+)
+
+// rankingList is one list given with --ranking and what was read from it
+type rankingList struct {
+	path   string
+	format string
+	// ranking is the provenance every domain on the list gets, with its rank
+	// filled in
+	ranking results.Ranking
+	stats   normalize.Stats
+}
+
+// parseRankingList parses a --ranking value, comma separated key=value pairs:
+//
+//	source=tranco,path=top-1m.csv,id=X5Y7N,date=2021-09-15
+//	source=crux-br,path=br.csv,country=BR,date=2021-08
+//
+// source and path are needed. format is rank_domain, crux or csv, by default
+// crux for sources starting with crux, rank_domain for tranco, umbrella and
+// alexa and csv for anything else.
+func parseRankingList(spec string) (*rankingList, error) {
+	ret := new(rankingList)
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "source":
+			ret.ranking.Source = strings.ToLower(value)
+		case "path":
+			ret.path = value
+		case "format":
+			ret.format = strings.ToLower(value)
+		case "id":
+			ret.ranking.ListID = value
+		case "date":
+			ret.ranking.Date = value
+		case "country":
+			ret.ranking.Country = strings.ToUpper(value)
+		default:
+			return nil, fmt.Errorf("unknown key %q", kv[0])
+		}
+	}
+	if len(ret.ranking.Source) == 0 || len(ret.path) == 0 {
+		return nil, fmt.Errorf("source and path are needed, got %q", spec)
+	}
+	if strings.ContainsAny(ret.ranking.Source, " \t()") {
+		return nil, fmt.Errorf("source %q can't have spaces or parentheses", ret.ranking.Source)
+	}
+	if len(ret.format) == 0 {
+		switch {
+		case strings.HasPrefix(ret.ranking.Source, "crux"):
+			ret.format = formatCrUX
+		case ret.ranking.Source == "tranco" || ret.ranking.Source == "umbrella" ||
+			ret.ranking.Source == "alexa":
+			ret.format = formatRankDomain
+		default:
+			ret.format = formatCSV
+		}
+	}
+	switch ret.format {
+	case formatRankDomain, formatCrUX, formatCSV:
+	default:
+		return nil, fmt.Errorf("unknown format %q", ret.format)
+	}
+
+	return ret, nil
+}
+
+// parseRankingLists parses every --ranking value, a source can only be given
+// once
+func parseRankingLists(specs []string) []*rankingList {
+	var ret []*rankingList
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		list, err := parseRankingList(spec)
+		if err != nil {
+			errorLogger.Fatalf("Error with --ranking: %v\n", err)
+		}
+		if seen[list.ranking.Source] {
+			errorLogger.Fatalf("--ranking source %s given twice\n", list.ranking.Source)
+		}
+		seen[list.ranking.Source] = true
+		ret = append(ret, list)
+	}
+
+	return ret
+}
+
+// rankingColumns finds the domain and rank columns in a header, -1 when a
+// column is missing
+func rankingColumns(header []string) (int, int) {
+	domain, rank := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain", "origin", "url":
+			if domain < 0 {
+				domain = i
+			}
+		case "rank":
+			rank = i
+		}
+	}
+
+	return domain, rank
+}
+
+// addRankings adds a record of each domain's rank on list to sorter. Domains
+// are normalized like the Citizen Lab URLs, a domain that appears more than
+// once (e.g. the http and https origins in CrUX) keeps its best rank when the
+// records are joined.
+func addRankings(sorter *externalSorter, list *rankingList, progress time.Duration) {
+	in, err := openInput(list.path)
+	if err != nil {
+		errorLogger.Fatalf("Error opening ranking list: %v\n", err)
+	}
+
+	domainColumn, rankColumn := 1, 0
+	header := list.format != formatRankDomain
+	err = in.scanLines(progress, func(l []byte) {
+		if len(bytes.TrimSpace(l)) == 0 {
+			return
+		}
+		fields, err := csv.NewReader(bytes.NewReader(l)).Read()
+		if err != nil {
+			errorLogger.Printf("Skipping bad line in %s: %v\n", list.path, err)
+			return
+		}
+		if header {
+			header = false
+			domainColumn, rankColumn = rankingColumns(fields)
+			if domainColumn < 0 || rankColumn < 0 {
+				errorLogger.Fatalf(
+					"%s needs a domain (or origin or url) and a rank column, "+
+						"got %v\n",
+					list.path,
+					fields,
+				)
+			}
+			return
+		}
+		list.stats.Entries++
+		if domainColumn >= len(fields) || rankColumn >= len(fields) {
+			list.stats.Failed++
+			return
+		}
+		rank, err := strconv.Atoi(strings.TrimSpace(fields[rankColumn]))
+		if err != nil || rank <= 0 {
+			list.stats.Failed++
+			return
+		}
+		domain, err := normalize.Domain(fields[domainColumn], normalize.Options{})
+		if err != nil {
+			list.stats.Failed++
+			return
+		}
+		ranking := list.ranking
+		ranking.Rank = rank
+		addRecord(sorter, domain, record{Kind: recordRanking, Ranking: &ranking})
+	})
+	if err != nil {
+		errorLogger.Fatalf("Error reading ranking list: %v\n", err)
+	}
+	if err = in.Close(); err != nil {
+		errorLogger.Fatalf("Error closing %s: %v\n", list.path, err)
+	}
+}
+
+// addRanking keeps the best rank a domain has on each list
+func (dj *domainJoin) addRanking(r results.Ranking) {
+	for i, have := range dj.dr.Rankings {
+		if have.Source == r.Source {
+			if r.Rank < have.Rank {
+				dj.dr.Rankings[i] = r
+			}
+			return
+		}
+	}
+	dj.dr.Rankings = append(dj.dr.Rankings, r)
+	sort.Slice(dj.dr.Rankings, func(i, j int) bool {
+		return dj.dr.Rankings[i].Source < dj.dr.Rankings[j].Source
+	})
+}
+
+// countRankings counts which lists a written domain was on
+func countRankings(dr *results.DomainResults, lists []*rankingList) {
+	for _, list := range lists {
+		if _, ok := dr.RankOn(list.ranking.Source); ok {
+			list.stats.Matched++
+		}
+	}
+}
+
+// logRankingStats logs how many of each list's domains were among the
+// domains written
+func logRankingStats(lists []*rankingList) {
+	for _, list := range lists {
+		infoLogger.Printf(
+			"%s (%s): %d entries, %d couldn't be read, %d domains written "+
+				"with a rank on it\n",
+			list.ranking.Source,
+			list.path,
+			list.stats.Entries,
+			list.stats.Failed,
+			list.stats.Matched,
+		)
+	}
+}
@@ -0,0 +1,7 @@
+module github.com/timartiny/RipeProbe/cmd/resolverhistory
+
+replace github.com/timartiny/RipeProbe/results => ../../results
+
+go 1.16
+
+require github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
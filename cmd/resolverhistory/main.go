@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	infoLogger  *log.Logger
+	errorLogger *log.Logger
+)
+
+// splitPaths splits a comma separated flag, an empty flag is no paths
+func splitPaths(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// runDate is the date observations from path are recorded on: date when it
+// is given, otherwise the day path was last modified
+func runDate(path, date string) string {
+	if len(date) > 0 {
+		return date
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		errorLogger.Fatalf("Error reading file: %s, %v\n", path, err)
+	}
+
+	return info.ModTime().UTC().Format("2006-01-02")
+}
+
+func main() {
+	storePath := flag.String("store", "", "Path to the resolver history, one observation per line of JSON, created when it doesn't exist")
+	listPaths := flag.String("lists", "", "Comma separated resolver lists to add (resolverlist output, old <ip> <label> lists, or <v6 addr> <v4 addr> <cc> open resolver lists)")
+	validationPaths := flag.String("validations", "", "Comma separated resolverlist -report files to add")
+	verdictPaths := flag.String("verdicts", "", "Comma separated determineDNSCensorship -json files to add")
+	date := flag.String("date", "", "Date (YYYY-MM-DD) to record the added files on, each file's modification date when empty")
+	reportPath := flag.String("report", "", "Path to write the churn of the lists and each resolver's history to (in JSON)")
+	stablePath := flag.String("stable_out", "", "Path to write a resolver list of the stable resolvers to, for whiteboard")
+	minDays := flag.Int("min_days", 2, "Days a stable resolver has to have been observed on")
+	minUptime := flag.Float64("min_uptime", 0.9, "Share of validations and measurements a stable resolver has to have answered")
+	maxChanges := flag.Int("max_changes", 0, "Most changes (verdict, classification, ASN, country or kind) a stable resolver can have had")
+	flag.Parse()
+	infoLogger = log.New(
+		os.Stderr,
+		"INFO: ",
+		log.Ldate|log.Ltime|log.Lshortfile,
+	)
+	errorLogger = log.New(
+		os.Stderr,
+		"ERROR: ",
+		log.Ldate|log.Ltime|log.Lshortfile,
+	)
+	if len(*storePath) == 0 {
+		errorLogger.Fatalf("Must provide path to the resolver history, use -store\n")
+	}
+	if len(*date) > 0 {
+		if _, err := time.Parse("2006-01-02", *date); err != nil {
+			errorLogger.Fatalf("-date must be YYYY-MM-DD, got %s\n", *date)
+		}
+	}
+
+	store, err := loadStore(*storePath)
+	if err != nil {
+		errorLogger.Fatalf("Error loading store: %s, %v\n", *storePath, err)
+	}
+	infoLogger.Printf(
+		"loaded %d observations from %s\n", len(store.Observations), *storePath,
+	)
+
+	adders := []struct {
+		paths []string
+		add   func(path, date string) (int, error)
+	}{
+		{splitPaths(*listPaths), store.addList},
+		{splitPaths(*validationPaths), store.addValidations},
+		{splitPaths(*verdictPaths), store.addVerdicts},
+	}
+	var added int
+	for _, adder := range adders {
+		for _, path := range adder.paths {
+			d := runDate(path, *date)
+			n, err := adder.add(path, d)
+			if err != nil {
+				errorLogger.Fatalf("Error adding %s, %v\n", path, err)
+			}
+			infoLogger.Printf("added %d observations from %s on %s\n", n, path, d)
+			added += n
+		}
+	}
+	if added > 0 {
+		if err = store.save(*storePath); err != nil {
+			errorLogger.Fatalf("Error saving store: %s, %v\n", *storePath, err)
+		}
+	} else {
+		store.sortObservations()
+	}
+
+	report := buildReport(store, stability{
+		minDays:    *minDays,
+		minUptime:  *minUptime,
+		maxChanges: *maxChanges,
+	})
+	logReport(report)
+	if len(*reportPath) > 0 {
+		writeReport(report, *reportPath)
+	}
+	if len(*stablePath) > 0 {
+		writeStable(report, *stablePath)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// Change is a resolver being different from the last time it was observed
+type Change struct {
+	Date string `json:"date"`
+	// Field is what changed: verdict, classification, or the list's asn,
+	// country or kind
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// History is everything the store says about one resolver
+type History struct {
+	IP string `json:"ip"`
+	// Label is the resolver's label in its most recent list
+	Label     string `json:"label,omitempty"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	// Days is how many days the resolver was observed on, ListDays how many
+	// of them it was in a list and Present whether it was in the latest list
+	Days     int  `json:"days"`
+	ListDays int  `json:"list_days"`
+	Present  bool `json:"present"`
+	// Checks is how many times it was validated or measured, Up how many of
+	// them it answered: it wasn't dead in validation or unreliable when
+	// measured
+	Checks             int      `json:"checks"`
+	Up                 int      `json:"up"`
+	Uptime             float64  `json:"uptime"`
+	LastVerdict        string   `json:"last_verdict,omitempty"`
+	LastClassification string   `json:"last_classification,omitempty"`
+	Changes            []Change `json:"changes,omitempty"`
+	Stable             bool     `json:"stable"`
+	// Reason is why the resolver is or isn't stable, for people
+	Reason string `json:"reason"`
+
+	// latest is the resolver's record in its most recent list
+	latest *results.Resolver
+	// last is the last value of each Change field
+	last  map[string]string
+	dates map[string]bool
+}
+
+// Churn is how the resolvers in the lists changed from one list date to the
+// next, every list added for a date counts as that day's list
+type Churn struct {
+	Date    string `json:"date"`
+	Listed  int    `json:"listed"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// Report is the churn of the lists and the history of every resolver, sorted
+// by IP
+type Report struct {
+	ListDates []string   `json:"list_dates"`
+	Churn     []Churn    `json:"churn"`
+	Stable    int        `json:"stable"`
+	Resolvers []*History `json:"resolvers"`
+}
+
+// stability is what a resolver needs to be stable
+type stability struct {
+	minDays    int
+	minUptime  float64
+	maxChanges int
+}
+
+// note records a Change when value differs from field's last value, empty
+// values say nothing and are skipped
+func (h *History) note(date, field, value string) {
+	if len(value) == 0 {
+		return
+	}
+	if last, ok := h.last[field]; ok && last != value {
+		h.Changes = append(h.Changes, Change{
+			Date:  date,
+			Field: field,
+			From:  last,
+			To:    value,
+		})
+	}
+	h.last[field] = value
+}
+
+// observe adds o, the next observation in date order, to the history
+func (h *History) observe(o Observation) {
+	if len(h.FirstSeen) == 0 {
+		h.FirstSeen = o.Date
+	}
+	h.LastSeen = o.Date
+	h.dates[o.Date] = true
+	switch o.Type {
+	case ObservedListed:
+		h.latest = o.Resolver
+		h.Label = o.Resolver.Label()
+		if o.Resolver.ASN != 0 {
+			h.note(o.Date, "asn", fmt.Sprintf("%d", o.Resolver.ASN))
+		}
+		h.note(o.Date, "country", o.Resolver.Country)
+		h.note(o.Date, "kind", o.Resolver.Kind)
+	case ObservedValidated:
+		h.Checks++
+		if o.Verdict != results.VerdictDead {
+			h.Up++
+		}
+		h.LastVerdict = o.Verdict
+		h.note(o.Date, "verdict", o.Verdict)
+	case ObservedMeasured:
+		h.Checks++
+		if o.Classification != results.ClassificationUnreliable {
+			h.Up++
+		}
+		h.LastClassification = o.Classification
+		h.note(o.Date, "classification", o.Classification)
+	}
+}
+
+// judge decides whether the resolver is stable: whether it keeps answering
+// and behaving the same. A resolver that censors is as stable as a clean
+// one, censoring resolvers are what the experiment measures.
+func (h *History) judge(s stability, latestList string) {
+	h.Days = len(h.dates)
+	if h.Checks > 0 {
+		h.Uptime = float64(h.Up) / float64(h.Checks)
+	}
+	switch {
+	case !h.Present:
+		h.Reason = fmt.Sprintf("not in the latest list (%s)", latestList)
+	case h.Days < s.minDays:
+		h.Reason = fmt.Sprintf("observed on %d days, needs %d", h.Days, s.minDays)
+	case h.Checks == 0:
+		h.Reason = "never validated or measured"
+	case h.Uptime < s.minUptime:
+		h.Reason = fmt.Sprintf("up for %d of %d checks", h.Up, h.Checks)
+	case len(h.Changes) > s.maxChanges:
+		h.Reason = fmt.Sprintf("%d changes, up to %d allowed", len(h.Changes), s.maxChanges)
+	case h.LastVerdict == results.VerdictDead:
+		h.Reason = "last validated " + h.LastVerdict
+	case h.LastClassification == results.ClassificationUnreliable:
+		h.Reason = "last measured " + h.LastClassification
+	default:
+		h.Stable = true
+		h.Reason = fmt.Sprintf(
+			"observed on %d days, up for %d of %d checks",
+			h.Days,
+			h.Up,
+			h.Checks,
+		)
+	}
+}
+
+// buildReport goes through the store's observations, which have to be in
+// date order, and works out the churn and each resolver's history
+func buildReport(store *Store, s stability) *Report {
+	ret := new(Report)
+	histories := make(map[string]*History)
+	listed := make(map[string]map[string]bool)
+	for _, o := range store.Observations {
+		h, ok := histories[o.IP]
+		if !ok {
+			h = &History{
+				IP:    o.IP,
+				last:  make(map[string]string),
+				dates: make(map[string]bool),
+			}
+			histories[o.IP] = h
+		}
+		h.observe(o)
+		if o.Type != ObservedListed {
+			continue
+		}
+		if listed[o.Date] == nil {
+			listed[o.Date] = make(map[string]bool)
+			ret.ListDates = append(ret.ListDates, o.Date)
+		}
+		if !listed[o.Date][o.IP] {
+			listed[o.Date][o.IP] = true
+			h.ListDays++
+		}
+	}
+
+	var latestList string
+	previous := make(map[string]bool)
+	for _, date := range ret.ListDates {
+		c := Churn{Date: date, Listed: len(listed[date])}
+		for ip := range listed[date] {
+			if !previous[ip] {
+				c.Added++
+			}
+		}
+		for ip := range previous {
+			if !listed[date][ip] {
+				c.Removed++
+			}
+		}
+		ret.Churn = append(ret.Churn, c)
+		previous = listed[date]
+		latestList = date
+	}
+
+	for ip, h := range histories {
+		h.Present = previous[ip]
+		h.judge(s, latestList)
+		if h.Stable {
+			ret.Stable++
+		}
+		ret.Resolvers = append(ret.Resolvers, h)
+	}
+	sort.Slice(ret.Resolvers, func(i, j int) bool {
+		return ret.Resolvers[i].IP < ret.Resolvers[j].IP
+	})
+
+	return ret
+}
+
+// logReport logs the churn of each list date and how many resolvers are
+// stable
+func logReport(r *Report) {
+	for _, c := range r.Churn {
+		infoLogger.Printf(
+			"%s: %d listed, %d added, %d removed\n",
+			c.Date,
+			c.Listed,
+			c.Added,
+			c.Removed,
+		)
+	}
+	infoLogger.Printf(
+		"%d of %d resolvers are stable\n", r.Stable, len(r.Resolvers),
+	)
+}
+
+// writeReport writes the report to path as indented JSON
+func writeReport(r *Report, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		errorLogger.Fatalf("Error marshaling report, %v\n", err)
+	}
+	file.Write(b)
+	file.WriteString("\n")
+}
+
+// writeStable writes the latest list record of each stable resolver to path,
+// one line of JSON at a time, as a resolver list for whiteboard
+func writeStable(r *Report, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, h := range r.Resolvers {
+		if !h.Stable {
+			continue
+		}
+		bs, err := json.Marshal(h.latest)
+		if err != nil {
+			errorLogger.Fatalf("json.Marshal error: %v\n", err)
+		}
+		w.Write(bs)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		errorLogger.Fatalf("Error writing %s: %v\n", path, err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// listed is an observation of ip in the list of date
+func listed(ip, date, country string) Observation {
+	return Observation{
+		IP:     ip,
+		Date:   date,
+		Type:   ObservedListed,
+		Source: "/data/" + date + "/resolvers.ips",
+		Resolver: &results.Resolver{
+			IP:      ip,
+			Country: country,
+			Kind:    results.ResolverKindOpen,
+		},
+	}
+}
+
+func validated(ip, date, verdict string) Observation {
+	return Observation{
+		IP:      ip,
+		Date:    date,
+		Type:    ObservedValidated,
+		Source:  "/data/" + date + "/validation.json",
+		Verdict: verdict,
+	}
+}
+
+func measured(ip, date, classification string) Observation {
+	return Observation{
+		IP:             ip,
+		Date:           date,
+		Type:           ObservedMeasured,
+		Source:         "/data/" + date + "/verdicts.json",
+		Classification: classification,
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	const day1, day2 = "2021-09-01", "2021-09-08"
+	type want struct {
+		checks, up int
+		changes    []Change
+		stable     bool
+		reason     string
+	}
+	tests := []struct {
+		name         string
+		observations []Observation
+		churn        []Churn
+		resolvers    map[string]want
+	}{
+		{
+			name: "churn",
+			observations: []Observation{
+				listed("192.0.2.1", day1, "CN"),
+				listed("192.0.2.2", day1, "CN"),
+				listed("192.0.2.2", day2, "CN"),
+				listed("192.0.2.3", day2, "CN"),
+				validated("192.0.2.2", day2, results.VerdictValid),
+			},
+			churn: []Churn{
+				{Date: day1, Listed: 2, Added: 2},
+				{Date: day2, Listed: 2, Added: 1, Removed: 1},
+			},
+			resolvers: map[string]want{
+				"192.0.2.1": {reason: "not in the latest list"},
+				"192.0.2.2": {checks: 1, up: 1, stable: true},
+				"192.0.2.3": {reason: "observed on 1 days"},
+			},
+		},
+		{
+			name: "uptime",
+			observations: []Observation{
+				listed("192.0.2.1", day1, "CN"),
+				validated("192.0.2.1", day1, results.VerdictValid),
+				measured("192.0.2.1", day1, results.ClassificationClean),
+				listed("192.0.2.1", day2, "CN"),
+				validated("192.0.2.1", day2, results.VerdictValid),
+				measured("192.0.2.1", day2, results.ClassificationUnreliable),
+			},
+			churn: []Churn{
+				{Date: day1, Listed: 1, Added: 1},
+				{Date: day2, Listed: 1},
+			},
+			resolvers: map[string]want{
+				"192.0.2.1": {
+					checks: 4,
+					up:     3,
+					changes: []Change{{
+						Date:  day2,
+						Field: "classification",
+						From:  results.ClassificationClean,
+						To:    results.ClassificationUnreliable,
+					}},
+					reason: "up for 3 of 4 checks",
+				},
+			},
+		},
+		{
+			name: "changes",
+			observations: []Observation{
+				listed("192.0.2.1", day1, "CN"),
+				validated("192.0.2.1", day1, results.VerdictValid),
+				listed("192.0.2.1", day2, "HK"),
+				validated("192.0.2.1", day2, results.VerdictValid),
+			},
+			churn: []Churn{
+				{Date: day1, Listed: 1, Added: 1},
+				{Date: day2, Listed: 1},
+			},
+			resolvers: map[string]want{
+				"192.0.2.1": {
+					checks: 2,
+					up:     2,
+					changes: []Change{{
+						Date: day2, Field: "country", From: "CN", To: "HK",
+					}},
+					reason: "1 changes",
+				},
+			},
+		},
+		{
+			name: "censoring is stable",
+			observations: []Observation{
+				listed("192.0.2.1", day1, "CN"),
+				validated("192.0.2.1", day1, results.VerdictIncorrect),
+				measured("192.0.2.1", day1, results.ClassificationCensoring),
+				listed("192.0.2.1", day2, "CN"),
+				validated("192.0.2.1", day2, results.VerdictIncorrect),
+				measured("192.0.2.1", day2, results.ClassificationCensoring),
+			},
+			churn: []Churn{
+				{Date: day1, Listed: 1, Added: 1},
+				{Date: day2, Listed: 1},
+			},
+			resolvers: map[string]want{
+				"192.0.2.1": {checks: 4, up: 4, stable: true},
+			},
+		},
+		{
+			name: "last validated dead",
+			observations: []Observation{
+				listed("192.0.2.1", day1, "CN"),
+				validated("192.0.2.1", day1, results.VerdictValid),
+				listed("192.0.2.1", day2, "CN"),
+				validated("192.0.2.1", day2, results.VerdictDead),
+			},
+			churn: []Churn{
+				{Date: day1, Listed: 1, Added: 1},
+				{Date: day2, Listed: 1},
+			},
+			resolvers: map[string]want{
+				"192.0.2.1": {
+					checks: 2,
+					up:     1,
+					changes: []Change{{
+						Date:  day2,
+						Field: "verdict",
+						From:  results.VerdictValid,
+						To:    results.VerdictDead,
+					}},
+					reason: "up for 1 of 2 checks",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &Store{seen: make(map[string]bool)}
+			for _, o := range test.observations {
+				store.add(o)
+			}
+			store.sortObservations()
+			report := buildReport(store, stability{
+				minDays:    2,
+				minUptime:  0.9,
+				maxChanges: 0,
+			})
+
+			if !reflect.DeepEqual(report.Churn, test.churn) {
+				t.Errorf("Churn = %+v, want %+v", report.Churn, test.churn)
+			}
+			if len(report.Resolvers) != len(test.resolvers) {
+				t.Fatalf("got %d resolvers, want %d", len(report.Resolvers), len(test.resolvers))
+			}
+			for _, h := range report.Resolvers {
+				w, ok := test.resolvers[h.IP]
+				if !ok {
+					t.Errorf("unexpected resolver %s", h.IP)
+					continue
+				}
+				if h.Checks != w.checks || h.Up != w.up {
+					t.Errorf("%s: up for %d of %d checks, want %d of %d", h.IP, h.Up, h.Checks, w.up, w.checks)
+				}
+				if !reflect.DeepEqual(h.Changes, w.changes) {
+					t.Errorf("%s: Changes = %+v, want %+v", h.IP, h.Changes, w.changes)
+				}
+				if h.Stable != w.stable {
+					t.Errorf("%s: Stable = %v (%s), want %v", h.IP, h.Stable, h.Reason, w.stable)
+				}
+				if !strings.Contains(h.Reason, w.reason) {
+					t.Errorf("%s: Reason = %q, want it to contain %q", h.IP, h.Reason, w.reason)
+				}
+			}
+		})
+	}
+}
+
+// TestSameNameDifferentFiles checks files with the same name in different
+// directories don't count as the same file
+func TestSameNameDifferentFiles(t *testing.T) {
+	store := &Store{seen: make(map[string]bool)}
+	cn := validated("192.0.2.1", "2021-09-01", results.VerdictValid)
+	cn.Source = sourceOf("data/CN/report.json")
+	ir := cn
+	ir.Source = sourceOf("data/IR/report.json")
+
+	if !store.add(cn) || !store.add(ir) {
+		t.Errorf("a file with the same name was taken for the same file")
+	}
+	if store.add(cn) {
+		t.Errorf("the same file was added twice")
+	}
+}
+
+// TestSaveKeepsMode checks the store isn't left readable only by its owner
+// after being replaced
+func TestSaveKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store := &Store{seen: make(map[string]bool)}
+	store.add(listed("192.0.2.1", "2021-09-01", "CN"))
+	if err := store.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if mode := modeOf(t, path); mode != 0644 {
+		t.Errorf("new store has mode %v, want 0644", mode)
+	}
+
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := store.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if mode := modeOf(t, path); mode != 0640 {
+		t.Errorf("saved store has mode %v, want 0640", mode)
+	}
+}
+
+func modeOf(t *testing.T, path string) os.FileMode {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	return fi.Mode().Perm()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// Types of observation
+const (
+	// ObservedListed is a resolver appearing in a resolver list
+	ObservedListed = "listed"
+	// ObservedValidated is a resolver being validated by resolverlist
+	ObservedValidated = "validated"
+	// ObservedMeasured is a resolver being measured through by probes and
+	// classified by determineDNSCensorship
+	ObservedMeasured = "measured"
+)
+
+// Observation is one thing seen about a resolver on one day, the store keeps
+// one per line of JSON
+type Observation struct {
+	IP string `json:"ip"`
+	// Date is the day of the run the observation came from (YYYY-MM-DD)
+	Date string `json:"date"`
+	Type string `json:"type"`
+	// Source is the path of the file the observation came from, made
+	// absolute so different files with the same name don't collide
+	Source string `json:"source"`
+	// Resolver is the list's record of the resolver, for listed observations
+	Resolver *results.Resolver `json:"resolver,omitempty"`
+	// Verdict and MedianRTTMs are resolverlist's, for validated observations
+	Verdict     string  `json:"verdict,omitempty"`
+	MedianRTTMs float64 `json:"median_rtt_ms,omitempty"`
+	// Classification and the number of Censored and Unreliable verdicts out
+	// of Domains are determineDNSCensorship's, for measured observations
+	Classification string `json:"classification,omitempty"`
+	Censored       int    `json:"censored,omitempty"`
+	Unreliable     int    `json:"unreliable,omitempty"`
+	Domains        int    `json:"domains,omitempty"`
+}
+
+// key is what makes an observation the same one when a file is added twice
+func (o Observation) key() string {
+	return strings.Join([]string{o.IP, o.Date, o.Type, o.Source}, "|")
+}
+
+// sourceOf is the Source of the observations from the file at path
+func sourceOf(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	return abs
+}
+
+// Store is every observation of every resolver, in order of date
+type Store struct {
+	Observations []Observation
+	seen         map[string]bool
+}
+
+// loadStore reads the store at path, an empty one when there is no file yet
+func loadStore(path string) (*Store, error) {
+	ret := &Store{seen: make(map[string]bool)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var o Observation
+		if err = json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ret.add(o)
+	}
+
+	return ret, scanner.Err()
+}
+
+// add adds o unless the store already has it, returns whether it was added
+func (s *Store) add(o Observation) bool {
+	if s.seen[o.key()] {
+		return false
+	}
+	s.seen[o.key()] = true
+	s.Observations = append(s.Observations, o)
+
+	return true
+}
+
+// sortObservations orders the observations by date, then type, source and IP
+func (s *Store) sortObservations() {
+	sort.SliceStable(s.Observations, func(i, j int) bool {
+		a, b := s.Observations[i], s.Observations[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+
+		return a.IP < b.IP
+	})
+}
+
+// save writes the store to path through a temporary file, so a failed write
+// doesn't lose the history. The store keeps its mode, a new one is 0644.
+func (s *Store) save(path string) error {
+	s.sortObservations()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// TempFile creates the file 0600, keep the mode of the store being
+	// replaced instead
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, o := range s.Observations {
+		bs, err := json.Marshal(o)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		w.Write(bs)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readList reads a resolver list: resolverlist's output (JSON records or the
+// older "<ip> <label>" lines), or a list of open resolvers like
+// aug-30-2-single-resolvers-country-sorted, "<v6 addr>  <v4 addr>  <cc>"
+func readList(r io.Reader) ([]results.Resolver, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var first []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if first = strings.Fields(scanner.Text()); len(first) > 0 {
+			break
+		}
+	}
+	if len(first) != 3 || len(first[2]) != 2 {
+		return results.ReadResolvers(bytes.NewReader(b))
+	}
+
+	var ret []results.Resolver
+	scanner = bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf(
+				"line %d: expected <v6 addr> <v4 addr> <cc>, got %q",
+				line,
+				scanner.Text(),
+			)
+		}
+		v6, v4, cc := fields[0], fields[1], fields[2]
+		ret = append(ret,
+			results.Resolver{IP: v4, PairIP: v6, Country: cc, Kind: results.ResolverKindOpen},
+			results.Resolver{IP: v6, PairIP: v4, Country: cc, Kind: results.ResolverKindOpen},
+		)
+	}
+
+	return ret, scanner.Err()
+}
+
+// validation is the part of resolverlist's -report lines that is kept
+type validation struct {
+	IP          string  `json:"ip"`
+	Verdict     string  `json:"verdict"`
+	MedianRTTMs float64 `json:"median_rtt_ms"`
+}
+
+// resolverVerdict is the part of determineDNSCensorship's -json output that
+// is kept
+type resolverVerdict struct {
+	Resolver       string            `json:"resolver"`
+	Classification string            `json:"classification"`
+	Censored       int               `json:"censored"`
+	Unreliable     int               `json:"unreliable"`
+	Domains        []json.RawMessage `json:"domains"`
+}
+
+// addList adds a listed observation of every resolver in the list at path
+func (s *Store) addList(path, date string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	resolvers, err := readList(file)
+	if err != nil {
+		return 0, err
+	}
+	var added int
+	for i := range resolvers {
+		o := Observation{
+			IP:       resolvers[i].IP,
+			Date:     date,
+			Type:     ObservedListed,
+			Source:   sourceOf(path),
+			Resolver: &resolvers[i],
+		}
+		if s.add(o) {
+			added++
+		}
+	}
+
+	return added, nil
+}
+
+// addValidations adds a validated observation of every resolver in a
+// resolverlist -report file, one line of JSON per resolver
+func (s *Store) addValidations(path, date string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var added int
+	decoder := json.NewDecoder(file)
+	for {
+		var v validation
+		err = decoder.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return added, err
+		}
+		o := Observation{
+			IP:          v.IP,
+			Date:        date,
+			Type:        ObservedValidated,
+			Source:      sourceOf(path),
+			Verdict:     v.Verdict,
+			MedianRTTMs: v.MedianRTTMs,
+		}
+		if s.add(o) {
+			added++
+		}
+	}
+
+	return added, nil
+}
+
+// addVerdicts adds a measured observation of every resolver in a
+// determineDNSCensorship -json file
+func (s *Store) addVerdicts(path, date string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var verdicts []resolverVerdict
+	if err = json.Unmarshal(b, &verdicts); err != nil {
+		return 0, err
+	}
+
+	var added int
+	for _, v := range verdicts {
+		o := Observation{
+			IP:             v.Resolver,
+			Date:           date,
+			Type:           ObservedMeasured,
+			Source:         sourceOf(path),
+			Classification: v.Classification,
+			Censored:       v.Censored,
+			Unreliable:     v.Unreliable,
+			Domains:        len(v.Domains),
+		}
+		if s.add(o) {
+			added++
+		}
+	}
+
+	return added, nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Formats of geolocation database in -geo_dbs
+const (
+	geoFormatMaxMind     = "maxmind"
+	geoFormatIP2Location = "ip2location"
+	geoFormatRIR         = "rir"
+)
+
+// Rules for deciding an IP is in the country from the databases that place it
+const (
+	// ConsensusAll needs every database that places the IP to put it in the
+	// country
+	ConsensusAll = "all"
+	// ConsensusMajority needs more than half of them to
+	ConsensusMajority = "majority"
+	// ConsensusAny needs one of them to
+	ConsensusAny = "any"
+	// ConsensusFirst goes with the first of them in -geo_dbs
+	ConsensusFirst = "first"
+)
+
+// geoDB is a geolocation database that can place IPs in countries
+type geoDB interface {
+	// name is what the database is called in the -geo_report and
+	// -geo_rejects files
+	name() string
+	// country returns the ISO code of ip's country, "" when the database
+	// doesn't place it
+	country(ip net.IP) (string, error)
+	close()
+}
+
+// maxmindDB is a MaxMind Country or City mmdb
+type maxmindDB struct {
+	path   string
+	reader *geoip2.Reader
+}
+
+func (m *maxmindDB) name() string {
+	return geoFormatMaxMind + ":" + filepath.Base(m.path)
+}
+
+func (m *maxmindDB) country(ip net.IP) (string, error) {
+	record, err := m.reader.Country(ip)
+	if err != nil {
+		return "", err
+	}
+
+	return record.Country.IsoCode, nil
+}
+
+func (m *maxmindDB) close() {
+	m.reader.Close()
+}
+
+// geoRange is a range of addresses in one country, start and end are both in
+// the range and 16 bytes long
+type geoRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+// rangeDB is a geolocation database read into memory as ranges sorted by
+// their start, for the databases that are distributed as text
+type rangeDB struct {
+	label  string
+	ranges []geoRange
+}
+
+func (r *rangeDB) name() string {
+	return r.label
+}
+
+// country looks for the last range starting at or before ip, the ranges in
+// these databases don't overlap
+func (r *rangeDB) country(ip net.IP) (string, error) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return "", fmt.Errorf("not an IP address")
+	}
+	i := sort.Search(len(r.ranges), func(i int) bool {
+		return bytes.Compare(r.ranges[i].start, ip16) > 0
+	})
+	if i == 0 || bytes.Compare(ip16, r.ranges[i-1].end) > 0 {
+		return "", nil
+	}
+
+	return r.ranges[i-1].country, nil
+}
+
+func (r *rangeDB) close() {}
+
+func (r *rangeDB) sortRanges() {
+	sort.Slice(r.ranges, func(i, j int) bool {
+		return bytes.Compare(r.ranges[i].start, r.ranges[j].start) < 0
+	})
+}
+
+// maxIPv4 is the largest number an IPv4 address is in IP2Location's files
+var maxIPv4 = big.NewInt(1<<32 - 1)
+
+// ip2LocationIP turns one of IP2Location's address numbers into an address.
+// The IPv6 files have IPv4 addresses as IPv4-mapped IPv6 ones, which is what
+// net.IP uses too, so only numbers from the IPv4 files need mapping.
+func ip2LocationIP(n *big.Int, v4 bool) net.IP {
+	if v4 {
+		ret := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ret, uint32(n.Uint64()))
+		return ret.To16()
+	}
+
+	return net.IP(n.FillBytes(make([]byte, net.IPv6len)))
+}
+
+// readIP2Location reads an IP2Location-LITE DB1 (or later, only the country
+// is used) CSV file, IPv4 or IPv6: "<ip_from>","<ip_to>","<country_code>",...
+func readIP2Location(path string) (*rangeDB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := &rangeDB{label: geoFormatIP2Location + ":" + filepath.Base(path)}
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.FieldsPerRecord = -1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 || len(row[2]) != 2 {
+			// "-" is IP2Location's unknown country
+			continue
+		}
+		from, ok := new(big.Int).SetString(row[0], 10)
+		if !ok {
+			return nil, fmt.Errorf("bad ip_from %q in %s", row[0], path)
+		}
+		to, ok := new(big.Int).SetString(row[1], 10)
+		if !ok {
+			return nil, fmt.Errorf("bad ip_to %q in %s", row[1], path)
+		}
+		v4 := to.Cmp(maxIPv4) <= 0
+		ret.ranges = append(ret.ranges, geoRange{
+			start:   ip2LocationIP(from, v4),
+			end:     ip2LocationIP(to, v4),
+			country: strings.ToUpper(row[2]),
+		})
+	}
+	ret.sortRanges()
+
+	return ret, nil
+}
+
+// addRIRStats adds the allocated and assigned ranges of a RIR's delegated
+// stats file (delegated-<registry>-latest or -extended-latest) to db, lines
+// are "<registry>|<cc>|<type>|<start>|<value>|<date>|<status>[|...]"
+func addRIRStats(db *rangeDB, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		// the version and summary lines don't have an ipv4 or ipv6 type
+		// and a country
+		if len(fields) < 7 || (fields[2] != "ipv4" && fields[2] != "ipv6") {
+			continue
+		}
+		cc := strings.ToUpper(fields[1])
+		if len(cc) != 2 || cc == "ZZ" {
+			continue
+		}
+		if fields[6] != "allocated" && fields[6] != "assigned" {
+			continue
+		}
+		start := net.ParseIP(fields[3])
+		value, err := strconv.ParseUint(fields[4], 10, 64)
+		if start == nil || err != nil {
+			return fmt.Errorf("bad range %s|%s in %s", fields[3], fields[4], path)
+		}
+		start = start.To16()
+		end := make(net.IP, net.IPv6len)
+		copy(end, start)
+		if fields[2] == "ipv4" {
+			// value is the number of addresses
+			last := binary.BigEndian.Uint32(start[12:]) + uint32(value) - 1
+			binary.BigEndian.PutUint32(end[12:], last)
+		} else {
+			// value is the prefix length
+			mask := net.CIDRMask(int(value), 8*net.IPv6len)
+			if mask == nil {
+				return fmt.Errorf("bad prefix length %d in %s", value, path)
+			}
+			for i := range end {
+				end[i] |= ^mask[i]
+			}
+		}
+		db.ranges = append(db.ranges, geoRange{start: start, end: end, country: cc})
+	}
+
+	return scanner.Err()
+}
+
+// openGeoDBs opens the comma separated "<format>:<path>" databases of
+// -geo_dbs, in order. Each registry's delegated stats file only covers that
+// registry's addresses, so the rir files are read into one database, in the
+// place of the first of them.
+func openGeoDBs(spec string) ([]geoDB, error) {
+	var ret []geoDB
+	var rir *rangeDB
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("expected <format>:<path>, got %q", entry)
+		}
+		format, path := parts[0], parts[1]
+		switch format {
+		case geoFormatMaxMind:
+			reader, err := geoip2.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			ret = append(ret, &maxmindDB{path: path, reader: reader})
+		case geoFormatIP2Location:
+			db, err := readIP2Location(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			ret = append(ret, db)
+		case geoFormatRIR:
+			if rir == nil {
+				rir = &rangeDB{label: geoFormatRIR}
+				ret = append(ret, rir)
+			}
+			if err := addRIRStats(rir, path); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unknown format %s, expected %s, %s or %s",
+				format,
+				geoFormatMaxMind,
+				geoFormatIP2Location,
+				geoFormatRIR,
+			)
+		}
+	}
+	if rir != nil {
+		rir.sortRanges()
+	}
+
+	return ret, nil
+}
+
+// Geolocation is what the databases said about an IP. The IPs they disagree
+// on are written to the -geo_report file and the ones too few of them place
+// to the -geo_rejects file, one line of JSON each.
+type Geolocation struct {
+	IP    string `json:"ip"`
+	Label string `json:"label"`
+	// Countries is each database's country for the IP, "" when it doesn't
+	// place it
+	Countries map[string]string `json:"countries"`
+	// Errors are the databases that failed to look the IP up
+	Errors map[string]string `json:"errors,omitempty"`
+	// Placed is how many of the databases placed the IP
+	Placed int `json:"placed"`
+	// Agree is true when every database that placed the IP placed it in the
+	// same country
+	Agree     bool `json:"agree"`
+	InCountry bool `json:"in_country"`
+	// Rejected is true when too few databases placed the IP to decide
+	Rejected bool   `json:"rejected"`
+	Reason   string `json:"reason"`
+}
+
+// geolocator decides whether IPs are in a country with the consensus rule
+// over its databases
+type geolocator struct {
+	dbs       []geoDB
+	consensus string
+	// minDBs is how many databases have to place an IP to decide on it
+	minDBs int
+}
+
+// newGeolocator checks consensus is one of the rules
+func newGeolocator(dbs []geoDB, consensus string, minDBs int) (*geolocator, error) {
+	switch consensus {
+	case ConsensusAll, ConsensusMajority, ConsensusAny, ConsensusFirst:
+	default:
+		return nil, fmt.Errorf(
+			"unknown consensus %s, expected %s, %s, %s or %s",
+			consensus,
+			ConsensusAll,
+			ConsensusMajority,
+			ConsensusAny,
+			ConsensusFirst,
+		)
+	}
+	if minDBs < 1 || minDBs > len(dbs) {
+		return nil, fmt.Errorf(
+			"minimum databases has to be between 1 and %d, got %d",
+			len(dbs),
+			minDBs,
+		)
+	}
+
+	return &geolocator{dbs: dbs, consensus: consensus, minDBs: minDBs}, nil
+}
+
+// locate looks ipStr up in every database and decides whether it is in cc
+func (g *geolocator) locate(ipStr, label, cc string) Geolocation {
+	ret := Geolocation{
+		IP:        ipStr,
+		Label:     label,
+		Countries: make(map[string]string),
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		ret.Rejected = true
+		ret.Reason = "not an IP address"
+		return ret
+	}
+	// the countries of the databases that placed the IP, in -geo_dbs order
+	var placed []string
+	for _, db := range g.dbs {
+		country, err := db.country(ip)
+		if err != nil {
+			if ret.Errors == nil {
+				ret.Errors = make(map[string]string)
+			}
+			ret.Errors[db.name()] = err.Error()
+		}
+		ret.Countries[db.name()] = country
+		if len(country) > 0 {
+			placed = append(placed, country)
+		}
+	}
+	ret.Placed = len(placed)
+	ret.Agree = true
+	for _, country := range placed {
+		if country != placed[0] {
+			ret.Agree = false
+		}
+	}
+	if ret.Placed < g.minDBs {
+		ret.Rejected = true
+		ret.Reason = fmt.Sprintf(
+			"placed by %d of %d databases, needs %d",
+			ret.Placed,
+			len(g.dbs),
+			g.minDBs,
+		)
+		return ret
+	}
+
+	var inCC int
+	for _, country := range placed {
+		if country == cc {
+			inCC++
+		}
+	}
+	switch g.consensus {
+	case ConsensusAll:
+		ret.InCountry = inCC == len(placed)
+	case ConsensusMajority:
+		ret.InCountry = 2*inCC > len(placed)
+	case ConsensusAny:
+		ret.InCountry = inCC > 0
+	case ConsensusFirst:
+		ret.InCountry = placed[0] == cc
+	}
+	ret.Reason = fmt.Sprintf(
+		"%d of %d placing databases put it in %s (%s)",
+		inCC,
+		len(placed),
+		cc,
+		g.consensus,
+	)
+
+	return ret
+}
+
+// removeNonCountryIPs drops the IPs that aren't in cc, and the ones too few
+// databases place, from ipMap. It logs how many IPs there were of each and
+// returns every IP's Geolocation, sorted by IP.
+func removeNonCountryIPs(cc string, ipMap map[string]string, g *geolocator) []Geolocation {
+	var ret []Geolocation
+	var kept, elsewhere, rejected, disagreed int
+	for ip, label := range ipMap {
+		geo := g.locate(ip, label, cc)
+		ret = append(ret, geo)
+		if !geo.Agree {
+			disagreed++
+		}
+		switch {
+		case geo.Rejected:
+			rejected++
+			delete(ipMap, ip)
+		case !geo.InCountry:
+			elsewhere++
+			delete(ipMap, ip)
+		default:
+			kept++
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP < ret[j].IP })
+	infoLogger.Printf(
+		"Kept %d IPs in %s, dropped %d placed elsewhere and rejected %d "+
+			"too few databases could place, the databases disagreed on %d\n",
+		kept,
+		cc,
+		elsewhere,
+		rejected,
+		disagreed,
+	)
+
+	return ret
+}
+
+// writeGeolocations writes the geolocations keep returns true for to path,
+// one line of JSON at a time
+func writeGeolocations(geos []Geolocation, path string, keep func(Geolocation) bool) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("failed to create file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	for _, geo := range geos {
+		if !keep(geo) {
+			continue
+		}
+		bs, err := json.Marshal(geo)
+		if err != nil {
+			errorLogger.Fatalf("json.Marshal error: %v\n", err)
+		}
+		file.WriteString(string(bs) + "\n")
+	}
+}
@@ -2,9 +2,19 @@ module github.com/timartiny/RipeProbe/cmd/resolverlist
 
 replace github.com/timartiny/RipeProbe/RipeExperiment => ../../ripeexperiment
 
+replace github.com/timartiny/RipeProbe/consistency => ../../consistency
+
+replace github.com/timartiny/RipeProbe/resolve => ../../resolve
+
+replace github.com/timartiny/RipeProbe/results => ../../results
+
 go 1.16
 
 require (
-	github.com/oschwald/geoip2-golang v1.5.0 // indirect
+	github.com/oschwald/geoip2-golang v1.5.0
 	github.com/timartiny/RipeProbe/RipeExperiment v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/consistency v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/resolve v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
+	golang.org/x/net v0.0.0-20190912160710-24e19bdeb0f2
 )
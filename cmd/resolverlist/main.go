@@ -4,15 +4,19 @@ import (
 	"bufio"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
 	experiment "github.com/timartiny/RipeProbe/RipeExperiment"
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	resolve "github.com/timartiny/RipeProbe/resolve"
+	results "github.com/timartiny/RipeProbe/results"
 )
 
 var (
@@ -65,69 +69,91 @@ func getDomainsAndIPs(data []experiment.LookupResult) map[string]string {
 	return ipsToDomain
 }
 
-// remove non cc country IPs by using a geoip2/geolite2 DB to look up IPs
-func removeNonCountryIPs(cc string, ipMap map[string]string, dbPath string) {
-	if len(cc) == 0 {
-		infoLogger.Printf("No country code provided (-c) so keeping all ips\n")
-		return
-	}
-	db, err := geoip2.Open(dbPath)
+// addResolvers adds every resolver in cc (every one when cc is empty) to ipMap
+// and returns them as v4/v6 pairs, which to keep is only picked after
+// validation. Each line of the file is "<v6 addr>  <v4 addr>  <country_code>",
+// a resolver is labelled with its line's country and kind.
+func addResolvers(
+	orPath string, ipMap map[string]string, cc, kind string,
+) []candidate {
+	orFile, err := os.Open(orPath)
 	if err != nil {
-		errorLogger.Fatalf("Failed to open database: %s, %v\n", dbPath, err)
+		errorLogger.Printf("error opening file: %s, %v\n", orPath, err)
+		return nil
 	}
-	defer db.Close()
+	defer orFile.Close()
 
-	for k := range ipMap {
-		ip := net.ParseIP(k)
-		record, err := db.Country(ip)
-		if err != nil {
-			errorLogger.Fatalf("error finding country code for %s, %v\n", k, err)
+	var ret []candidate
+	orScanner := bufio.NewScanner(orFile)
+	for orScanner.Scan() {
+		split := strings.Split(orScanner.Text(), "  ")
+		if len(split) < 3 {
+			continue
 		}
-
-		if record.Country.IsoCode != cc {
-			delete(ipMap, k)
+		country := strings.TrimSpace(split[2])
+		// without a country there is nothing to label the resolver with
+		if len(country) == 0 || (len(cc) > 0 && country != cc) {
+			continue
 		}
+		ret = append(ret, candidate{
+			V4:      split[1],
+			V6:      split[0],
+			Label:   results.Resolver{Country: country, Kind: kind}.Label(),
+			Country: country,
+		})
 	}
-
-}
-
-func writeData(ipMap map[string]string, outPath string) {
-	file, err := os.Create(outPath)
-	if err != nil {
-		errorLogger.Fatalf("failed to create file: %s\nerr: %v\ndata: %v\n", outPath, err, ipMap)
+	for _, c := range ret {
+		ipMap[c.V4] = c.Label
+		ipMap[c.V6] = c.Label
 	}
-	defer file.Close()
 
-	for ip, dom := range ipMap {
-		file.WriteString(fmt.Sprintf("%s %s\n", ip, dom))
-	}
+	return ret
 }
 
-func addResolvers(orPath string, ipMap map[string]string, cc string, num int) {
-	orFile, err := os.Open(orPath)
-	if err != nil {
-		errorLogger.Printf("error opening file: %s, %v\n", orPath, err)
-		return
-	}
-	defer orFile.Close()
-
-	resolverDom := fmt.Sprintf("%s_Resolver", cc)
-	orScanner := bufio.NewScanner(orFile)
-	for orScanner.Scan() && num > 0 {
-		split := strings.Split(orScanner.Text(), "  ")
-		if split[2] == cc {
-			ipMap[split[0]] = resolverDom
-			ipMap[split[1]] = resolverDom
+// listedAddrs returns the addresses of resolvers that are still in ipMap,
+// with their labels
+func listedAddrs(ipMap map[string]string, resolvers []candidate) map[string]string {
+	ret := make(map[string]string)
+	for _, r := range resolvers {
+		for _, a := range r.addrs() {
+			if label, ok := ipMap[a]; ok {
+				ret[a] = label
+			}
 		}
 	}
+
+	return ret
 }
 
 func main() {
-	const NUMRESOLVERS = 5
 	jsonPath := flag.String("lookup", "", "Path to JSON file that has measurement data")
 	countryCode := flag.String("c", "", "Country code to check IPs against")
 	openResolverPath := flag.String("resolvers", "", "Path to file containing open resolvers that are assumed to be correct, with country code")
 	outPath := flag.String("out", "", "Path to write resolver list to")
+	numResolvers := flag.Int("num_resolvers", 5, "Most open resolvers to pick from -resolvers (after validation), a v4/v6 pair counts once, 0 for all of them")
+	perASN := flag.Int("per_asn", 0, "Most resolvers to pick from one ASN (needs -asn_db), 0 for no limit")
+	total := flag.Int("total", 0, "Most resolvers to pick, a v4/v6 pair counts once, 0 for no limit")
+	pairsOnly := flag.Bool("pairs_only", false, "Only pick resolvers with both a v4 and a v6 address")
+	seed := flag.Int64("seed", 0, "Seed for picking resolvers, the current time when 0")
+	resolversKind := flag.String("resolvers_kind", results.ResolverKindOpen, "Kind of the resolvers in -resolvers, open or isp")
+	cityPath := flag.String("city_db", "", "Path to a MaxMind City mmdb, to record the city (and country) of each resolver")
+	rdns := flag.Bool("rdns", false, "Look up the reverse DNS name of each resolver")
+	controlsPath := flag.String("controls", "", "Comma separated control answer files (ZDNS output or querylist's full details), validates the -resolvers resolvers against them when given")
+	controlDomains := flag.String("control_domains", "", "Comma separated domains to ask each resolver for when validating, each needs control answers")
+	asnPath := flag.String("asn_db", "", "Path to a MaxMind ASN mmdb, to limit resolvers per ASN and, with -controls, to compare answers by ASN")
+	rounds := flag.Int("rounds", 3, "Times to ask each resolver for each control domain when validating")
+	interval := flag.Duration("round_interval", 5*time.Second, "Time between validation rounds")
+	timeout := flag.Duration("timeout", 2*time.Second, "Time to wait for each validation query")
+	maxRTT := flag.Duration("max_rtt", time.Second, "Slowest median response time a valid resolver can have, 0 for any")
+	minCorrect := flag.Float64("min_correct", 1, "Share of a resolver's answers that have to be consistent with the control answers")
+	dnsPort := flag.String("dns_port", "53", "Port to send validation queries to (e.g. for local stub resolvers)")
+	workers := flag.Int("workers", 50, "Number of resolvers to validate at a time")
+	reportPath := flag.String("report", "", "Path to write how each resolver did in validation to (in JSON)")
+	geoDBs := flag.String("geo_dbs", "maxmind:data/geolite-country.mmdb", "Comma separated geolocation databases to check IPs against -c with, <format>:<path> with format maxmind, ip2location or rir (a RIR's delegated stats file)")
+	geoConsensus := flag.String("geo_consensus", ConsensusAll, "How many of the databases that place an IP have to put it in -c: all, majority, any or first")
+	geoMinDBs := flag.Int("geo_min_dbs", 1, "Number of databases that have to place an IP, IPs placed by fewer are rejected")
+	geoReportPath := flag.String("geo_report", "", "Path to write the IPs the geolocation databases disagree on to (in JSON)")
+	geoRejectsPath := flag.String("geo_rejects", "", "Path to write the IPs too few geolocation databases place to (in JSON)")
 	flag.Parse()
 	infoLogger = log.New(
 		os.Stderr,
@@ -139,12 +165,124 @@ func main() {
 		"ERROR: ",
 		log.Ldate|log.Ltime|log.Lshortfile,
 	)
+	if *resolversKind != results.ResolverKindOpen && *resolversKind != results.ResolverKindISP {
+		errorLogger.Fatalf("-resolvers_kind must be open or isp, got %s\n", *resolversKind)
+	}
+	if *perASN > 0 && len(*asnPath) == 0 {
+		errorLogger.Fatalf("-per_asn needs an ASN database from -asn_db\n")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	infoLogger.Printf("Picking resolvers with seed %d\n", *seed)
+	rng := rand.New(rand.NewSource(*seed))
+
 	data := getData(*jsonPath)
 	ipsToDomain := getDomainsAndIPs(data)
-	removeNonCountryIPs(*countryCode, ipsToDomain, "data/geolite-country.mmdb")
+	if len(*countryCode) > 0 {
+		dbs, err := openGeoDBs(*geoDBs)
+		if err != nil {
+			errorLogger.Fatalf("Failed to open geolocation databases, %v\n", err)
+		}
+		for _, db := range dbs {
+			defer db.close()
+		}
+		g, err := newGeolocator(dbs, *geoConsensus, *geoMinDBs)
+		if err != nil {
+			errorLogger.Fatalf("Error with -geo_consensus or -geo_min_dbs, %v\n", err)
+		}
+		geos := removeNonCountryIPs(*countryCode, ipsToDomain, g)
+		if len(*geoReportPath) > 0 {
+			writeGeolocations(geos, *geoReportPath, func(geo Geolocation) bool {
+				return !geo.Agree
+			})
+		}
+		if len(*geoRejectsPath) > 0 {
+			writeGeolocations(geos, *geoRejectsPath, func(geo Geolocation) bool {
+				return geo.Rejected
+			})
+		}
+	} else {
+		infoLogger.Printf("No country code provided (-c) so keeping all ips\n")
+	}
+	var openResolvers []candidate
 	if len(*openResolverPath) > 0 {
 		infoLogger.Printf("Now will add open resolvers, should be very quick\n")
-		addResolvers(*openResolverPath, ipsToDomain, *countryCode, NUMRESOLVERS)
+		openResolvers = addResolvers(
+			*openResolverPath, ipsToDomain, *countryCode, *resolversKind,
+		)
+	}
+	if len(*controlsPath) > 0 {
+		domains := strings.Split(*controlDomains, ",")
+		if len(*controlDomains) == 0 {
+			errorLogger.Fatalf("-controls needs domains to ask for with -control_domains\n")
+		}
+		checker, err := consistency.Load(*asnPath, strings.Split(*controlsPath, ","))
+		if err != nil {
+			errorLogger.Fatalf("Error loading control answers, %v\n", err)
+		}
+		defer checker.Close()
+		resolver := resolve.New()
+		resolver.Port = *dnsPort
+		resolver.Timeout = *timeout
+		v, err := newValidator(resolver, checker, domains)
+		if err != nil {
+			errorLogger.Fatalf("Error with -control_domains, %v\n", err)
+		}
+		v.rounds = *rounds
+		v.interval = *interval
+		v.maxRTT = *maxRTT
+		v.minCorrect = *minCorrect
+		v.workers = *workers
+		// only the -resolvers addresses are meant to be resolvers, the ones
+		// found through the lookups are kept to spot on-path injection
+		listed := listedAddrs(ipsToDomain, openResolvers)
+		infoLogger.Printf(
+			"Validating %d resolvers with %d rounds of %d control domains\n",
+			len(listed),
+			v.rounds,
+			len(domains),
+		)
+		validations := v.validateAll(listed)
+		removeInvalidResolvers(ipsToDomain, validations)
+		if len(*reportPath) > 0 {
+			writeReport(validations, *reportPath)
+		}
+	} else if len(*reportPath) > 0 {
+		errorLogger.Fatalf("-report needs -controls to validate against\n")
+	}
+
+	var asnDB *consistency.ASNDB
+	if len(*asnPath) > 0 {
+		var err error
+		if asnDB, err = consistency.OpenASNDB(*asnPath); err != nil {
+			errorLogger.Fatalf("Failed to open database: %s, %v\n", *asnPath, err)
+		}
+		defer asnDB.Close()
+	}
+	candidates := makeCandidates(ipsToDomain, openResolvers, asnDB)
+	picked := sampleCandidates(
+		candidates, *perASN, *numResolvers, *total, *pairsOnly, rng,
+	)
+	logCandidates(picked, len(candidates))
+
+	a := &annotator{
+		asnDB:      asnDB,
+		country:    *countryCode,
+		rdns:       *rdns,
+		timeout:    *timeout,
+		listKind:   *resolversKind,
+		listSource: filepath.Base(*openResolverPath),
+		listDate:   fileDate(*openResolverPath),
+		lookupDate: fileDate(*jsonPath),
+	}
+	if len(*cityPath) > 0 {
+		cityDB, err := geoip2.Open(*cityPath)
+		if err != nil {
+			errorLogger.Fatalf("Failed to open database: %s, %v\n", *cityPath, err)
+		}
+		defer cityDB.Close()
+		a.cityDB = cityDB
 	}
-	writeData(ipsToDomain, *outPath)
+	writeResolvers(a.records(picked), *outPath)
 }
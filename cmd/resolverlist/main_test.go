@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+func TestAddResolvers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolvers.txt")
+	lines := "2001:db8::1  192.0.2.1  CN\n" +
+		"2001:db8::2  192.0.2.2  IR\n" +
+		"2001:db8::3  192.0.2.3  \n" +
+		"2001:db8::4  192.0.2.4\n"
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatalf("writing resolvers: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		cc     string
+		kind   string
+		labels map[string]string
+	}{
+		{
+			name: "one country",
+			cc:   "CN",
+			kind: results.ResolverKindOpen,
+			labels: map[string]string{
+				"192.0.2.1": "CN_Resolver", "2001:db8::1": "CN_Resolver",
+			},
+		},
+		{
+			name: "no country labels by line",
+			kind: results.ResolverKindOpen,
+			labels: map[string]string{
+				"192.0.2.1": "CN_Resolver", "2001:db8::1": "CN_Resolver",
+				"192.0.2.2": "IR_Resolver", "2001:db8::2": "IR_Resolver",
+			},
+		},
+		{
+			name: "isp",
+			cc:   "IR",
+			kind: results.ResolverKindISP,
+			labels: map[string]string{
+				"192.0.2.2": "IR_ISP_Resolver", "2001:db8::2": "IR_ISP_Resolver",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ipMap := make(map[string]string)
+			resolvers := addResolvers(path, ipMap, test.cc, test.kind)
+			if !reflect.DeepEqual(ipMap, test.labels) {
+				t.Errorf("labels %v, want %v", ipMap, test.labels)
+			}
+			for _, r := range resolvers {
+				label := results.Resolver{Country: r.Country, Kind: test.kind}.Label()
+				if len(r.Country) == 0 || r.Label != label {
+					t.Errorf("resolver %+v, want its line's country in its label", r)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// annotator fills in what is known about each picked address to make the
+// resolver list's records
+type annotator struct {
+	asnDB  *consistency.ASNDB
+	cityDB *geoip2.Reader
+	// country is the -c country every address was checked to be in
+	country string
+	// rdns looks up each address's name, waiting up to timeout
+	rdns    bool
+	timeout time.Duration
+	// listKind is the kind of the resolvers in the -resolvers file
+	listKind string
+	// listSource and listDate are the -resolvers file's name and date,
+	// lookupDate is the date of the -lookup file
+	listSource string
+	listDate   string
+	lookupDate string
+}
+
+// fileDate is the day path was last modified, the closest there is to when
+// what is in it was found
+func fileDate(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	return info.ModTime().UTC().Format("2006-01-02")
+}
+
+// record makes the record of ip, one of c's addresses, pair is c's other one
+func (a *annotator) record(c candidate, ip, pair string) results.Resolver {
+	ret := results.Resolver{
+		IP:            ip,
+		PairIP:        pair,
+		Country:       a.country,
+		Source:        c.Label,
+		DiscoveryDate: a.lookupDate,
+		Kind:          results.ResolverKindInfra,
+	}
+	if c.Listed {
+		ret.Source = a.listSource
+		ret.DiscoveryDate = a.listDate
+		ret.Kind = a.listKind
+		if len(ret.Country) == 0 {
+			ret.Country = c.Country
+		}
+	}
+	parsed := net.ParseIP(ip)
+	if a.asnDB != nil {
+		if asn, ok := a.asnDB.Lookup(parsed); ok {
+			ret.ASN = asn.Number
+			ret.Org = asn.Org
+		}
+	}
+	if a.cityDB != nil {
+		if city, err := a.cityDB.City(parsed); err == nil {
+			if len(ret.Country) == 0 {
+				ret.Country = city.Country.IsoCode
+			}
+			ret.City = city.City.Names["en"]
+		}
+	}
+	if a.rdns {
+		ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		cancel()
+		if err == nil && len(names) > 0 {
+			ret.RDNS = strings.TrimSuffix(names[0], ".")
+		}
+	}
+
+	return ret
+}
+
+// records makes the records of every address of the candidates, a pair's v4
+// record right before its v6 record
+func (a *annotator) records(candidates []candidate) []results.Resolver {
+	var ret []results.Resolver
+	for _, c := range candidates {
+		if len(c.V4) > 0 {
+			ret = append(ret, a.record(c, c.V4, c.V6))
+		}
+		if len(c.V6) > 0 {
+			ret = append(ret, a.record(c, c.V6, c.V4))
+		}
+	}
+
+	return ret
+}
+
+// writeResolvers writes each record to outPath, one line of JSON at a time
+func writeResolvers(resolvers []results.Resolver, outPath string) {
+	file, err := os.Create(outPath)
+	if err != nil {
+		errorLogger.Fatalf("failed to create file: %s, %v\n", outPath, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, r := range resolvers {
+		bs, err := json.Marshal(r)
+		if err != nil {
+			errorLogger.Fatalf("json.Marshal error: %v\n", err)
+		}
+		w.Write(bs)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		errorLogger.Fatalf("Error writing %s: %v\n", outPath, err)
+	}
+}
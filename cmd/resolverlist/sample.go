@@ -0,0 +1,176 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+
+	consistency "github.com/timartiny/RipeProbe/consistency"
+)
+
+// candidate is one resolver that can be picked: its v4 and v6 addresses,
+// either of which can be empty, and the label it is written with
+type candidate struct {
+	V4    string
+	V6    string
+	Label string
+	// Listed is set for the resolvers from the -resolvers file, the rest
+	// were found through Label's lookups
+	Listed bool
+	// Country is the country a listed resolver's line gave
+	Country string
+	// ASN is the ASN of the v4 address, or of the v6 address when there is no
+	// v4 one. 0 when it isn't known.
+	ASN uint
+}
+
+// paired returns true when the candidate has both a v4 and a v6 address
+func (c candidate) paired() bool {
+	return len(c.V4) > 0 && len(c.V6) > 0
+}
+
+// addrs returns the candidate's addresses, v4 first
+func (c candidate) addrs() []string {
+	var ret []string
+	for _, a := range []string{c.V4, c.V6} {
+		if len(a) > 0 {
+			ret = append(ret, a)
+		}
+	}
+
+	return ret
+}
+
+// asnOf looks up the ASN of ip in db, 0 when there is no db or no ASN for it
+func asnOf(db *consistency.ASNDB, ip string) uint {
+	if db == nil {
+		return 0
+	}
+	asn, ok := db.Lookup(net.ParseIP(ip))
+	if !ok {
+		return 0
+	}
+
+	return asn.Number
+}
+
+// isV4 returns true for IPv4 addresses
+func isV4(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() != nil
+}
+
+// makeCandidates turns the addresses left in ipMap into candidates. The open
+// resolvers come paired already and keep whichever of their addresses are
+// still in ipMap. The other addresses are candidates on their own, nothing
+// says a v4 and a v6 address found through the same domain are the same
+// server.
+func makeCandidates(
+	ipMap map[string]string, resolvers []candidate, db *consistency.ASNDB,
+) []candidate {
+	var ret []candidate
+	used := make(map[string]bool)
+	for _, r := range resolvers {
+		c := candidate{Label: r.Label, Listed: true, Country: r.Country}
+		if _, ok := ipMap[r.V4]; ok && len(r.V4) > 0 {
+			c.V4 = r.V4
+		}
+		if _, ok := ipMap[r.V6]; ok && len(r.V6) > 0 {
+			c.V6 = r.V6
+		}
+		if len(c.addrs()) == 0 {
+			continue
+		}
+		for _, a := range c.addrs() {
+			used[a] = true
+		}
+		c.ASN = asnOf(db, c.addrs()[0])
+		ret = append(ret, c)
+	}
+
+	// sorted so the candidates are in the same order every run
+	var ips []string
+	for ip := range ipMap {
+		if !used[ip] {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		c := candidate{Label: ipMap[ip], ASN: asnOf(db, ip)}
+		if isV4(ip) {
+			c.V4 = ip
+		} else {
+			c.V6 = ip
+		}
+		ret = append(ret, c)
+	}
+
+	return ret
+}
+
+// sampleCandidates shuffles candidates with rng and takes them in that order
+// while there are fewer than perASN from their ASN, fewer than listed from
+// the -resolvers file and fewer than total altogether. A cap of 0 is no cap,
+// and candidates without a known ASN are never capped per ASN. With
+// pairsOnly only candidates with both a v4 and a v6 address are taken.
+func sampleCandidates(
+	candidates []candidate,
+	perASN, listed, total int,
+	pairsOnly bool,
+	rng *rand.Rand,
+) []candidate {
+	shuffled := make([]candidate, len(candidates))
+	copy(shuffled, candidates)
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	var ret []candidate
+	perASNCount := make(map[uint]int)
+	var listedCount int
+	for _, c := range shuffled {
+		if total > 0 && len(ret) >= total {
+			break
+		}
+		if pairsOnly && !c.paired() {
+			continue
+		}
+		if perASN > 0 && c.ASN != 0 && perASNCount[c.ASN] >= perASN {
+			continue
+		}
+		if c.Listed {
+			if listed > 0 && listedCount >= listed {
+				continue
+			}
+			listedCount++
+		}
+		perASNCount[c.ASN]++
+		ret = append(ret, c)
+	}
+
+	return ret
+}
+
+// logCandidates logs how many resolvers were picked, how many of them are
+// pairs and how many ASNs they cover
+func logCandidates(candidates []candidate, from int) {
+	var pairs int
+	asns := make(map[uint]bool)
+	for _, c := range candidates {
+		if c.paired() {
+			pairs++
+		}
+		if c.ASN != 0 {
+			asns[c.ASN] = true
+		}
+	}
+	infoLogger.Printf(
+		"Picked %d of %d resolvers, %d with both a v4 and a v6 address, "+
+			"in %d known ASNs\n",
+		len(candidates),
+		from,
+		pairs,
+		len(asns),
+	)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestMakeCandidatesPairsListedOnly checks only the -resolvers lines are
+// paired, a domain's v4 and v6 addresses stay apart
+func TestMakeCandidatesPairsListedOnly(t *testing.T) {
+	ipMap := map[string]string{
+		"192.0.2.1":    "CN_Resolver",
+		"2001:db8::1":  "CN_Resolver",
+		"198.51.100.1": "a.com",
+		"2001:db8::a":  "a.com",
+	}
+	resolvers := []candidate{
+		{V4: "192.0.2.1", V6: "2001:db8::1", Label: "CN_Resolver"},
+		// dropped by validation
+		{V4: "192.0.2.2", V6: "2001:db8::2", Label: "CN_Resolver"},
+	}
+
+	candidates := makeCandidates(ipMap, resolvers, nil)
+	if len(candidates) != 3 {
+		t.Fatalf("got %d candidates, want 3: %+v", len(candidates), candidates)
+	}
+	for _, c := range candidates {
+		if c.paired() != c.Listed {
+			t.Errorf("candidate %+v: paired %v, listed %v", c, c.paired(), c.Listed)
+		}
+	}
+}
+
+func TestSampleCandidatesListedCap(t *testing.T) {
+	var candidates []candidate
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		candidates = append(candidates, candidate{V4: ip, Listed: true})
+	}
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2"} {
+		candidates = append(candidates, candidate{V4: ip, Label: "a.com"})
+	}
+
+	picked := sampleCandidates(candidates, 0, 2, 0, false, rand.New(rand.NewSource(1)))
+	var listed int
+	for _, c := range picked {
+		if c.Listed {
+			listed++
+		}
+	}
+	if listed != 2 || len(picked) != 4 {
+		t.Errorf("picked %d, %d of them listed, want 4 and 2", len(picked), listed)
+	}
+}
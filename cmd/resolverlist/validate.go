@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	resolve "github.com/timartiny/RipeProbe/resolve"
+	results "github.com/timartiny/RipeProbe/results"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Outcomes of a single probe
+const (
+	outcomeCorrect     = "correct"
+	outcomeIncorrect   = "incorrect"
+	outcomeNoRecursion = "no-recursion"
+	outcomeTimeout     = "timeout"
+	outcomeRCodePrefix = "rcode-"
+)
+
+// Validation is how a candidate resolver did on the probes, one is written
+// per candidate to the -report file
+type Validation struct {
+	IP string `json:"ip"`
+	// Key is the address as the candidate map has it, which need not be the
+	// canonical form in IP
+	Key string `json:"-"`
+	// Label is what the resolver list calls the address, the domain it was
+	// found through or <country_code>_Resolver
+	Label   string `json:"label"`
+	Version int    `json:"version"`
+	Probes  int    `json:"probes"`
+	// Answered is how many probes got a response, whatever its RCode
+	Answered           int  `json:"answered"`
+	RecursionAvailable bool `json:"recursion_available"`
+	Correct            int  `json:"correct"`
+	Incorrect          int  `json:"incorrect"`
+	// MedianRTTMs is the median response time of the answered probes
+	MedianRTTMs float64 `json:"median_rtt_ms"`
+	Stable      bool    `json:"stable"`
+	Verdict     string  `json:"verdict"`
+	// Reason is a description of the verdict for people
+	Reason string `json:"reason"`
+}
+
+// validator probes candidate resolvers with recursive queries for control
+// domains and decides which are usable. Every query goes to the resolver's
+// Port, so it can be run against local stub resolvers.
+type validator struct {
+	resolver *resolve.Resolver
+	checker  *consistency.Checker
+	domains  []string
+	// rounds is how many times each domain is asked, interval apart
+	rounds   int
+	interval time.Duration
+	maxRTT   time.Duration
+	// minCorrect is the share of answered control lookups that have to
+	// agree with the control answers
+	minCorrect float64
+	workers    int
+}
+
+// newValidator checks every domain has control answers to compare to
+func newValidator(
+	resolver *resolve.Resolver, checker *consistency.Checker, domains []string,
+) (*validator, error) {
+	for _, domain := range domains {
+		if len(checker.Controls.Get(domain)) == 0 {
+			return nil, fmt.Errorf("no control answers for %s", domain)
+		}
+	}
+
+	return &validator{
+		resolver: resolver,
+		checker:  checker,
+		domains:  domains,
+		rounds:   1,
+		workers:  1,
+	}, nil
+}
+
+// probe asks ip for the A records of domain once and returns the outcome and
+// the response time
+func (v *validator) probe(ip net.IP, domain string) (string, time.Duration) {
+	start := time.Now()
+	resp, err := v.resolver.QueryRecursive(
+		context.Background(), ip, domain, dnsmessage.TypeA,
+	)
+	rtt := time.Since(start)
+	if err != nil {
+		return outcomeTimeout, 0
+	}
+	if !resp.RecursionAvailable || resp.RCode == dnsmessage.RCodeRefused {
+		return outcomeNoRecursion, rtt
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return outcomeRCodePrefix + strings.ToLower(resp.RCode.String()), rtt
+	}
+	var ips []net.IP
+	for _, rr := range resp.Answers {
+		if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IP(a.A[:]))
+		}
+	}
+	if v.checker.Compare(domain, ips).Consistent() {
+		return outcomeCorrect, rtt
+	}
+
+	return outcomeIncorrect, rtt
+}
+
+// validate probes one candidate resolver for every domain, rounds times
+func (v *validator) validate(ip net.IP, label string) Validation {
+	ret := Validation{IP: ip.String(), Label: label, Version: 6}
+	if ip.To4() != nil {
+		ret.Version = 4
+	}
+	// outcomes of each domain's probes, answering every probe with the same
+	// outcome every round is stable
+	outcomes := make(map[string]map[string]bool)
+	var rtts []time.Duration
+	var noRecursion int
+	for round := 0; round < v.rounds; round++ {
+		if round > 0 {
+			time.Sleep(v.interval)
+		}
+		for _, domain := range v.domains {
+			outcome, rtt := v.probe(ip, domain)
+			ret.Probes++
+			if outcomes[domain] == nil {
+				outcomes[domain] = make(map[string]bool)
+			}
+			outcomes[domain][outcome] = true
+			if outcome == outcomeTimeout {
+				continue
+			}
+			ret.Answered++
+			rtts = append(rtts, rtt)
+			switch outcome {
+			case outcomeCorrect:
+				ret.Correct++
+			case outcomeIncorrect:
+				ret.Incorrect++
+			case outcomeNoRecursion:
+				noRecursion++
+			}
+		}
+	}
+	ret.RecursionAvailable = ret.Answered > 0 && noRecursion < ret.Answered
+	ret.Stable = ret.Answered == ret.Probes
+	for _, seen := range outcomes {
+		if len(seen) > 1 {
+			ret.Stable = false
+		}
+	}
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		ret.MedianRTTMs = float64(rtts[len(rtts)/2]) / float64(time.Millisecond)
+	}
+
+	checked := ret.Correct + ret.Incorrect
+	switch {
+	case ret.Answered == 0:
+		ret.Verdict = results.VerdictDead
+		ret.Reason = fmt.Sprintf("no answer to %d probes", ret.Probes)
+	case !ret.RecursionAvailable:
+		ret.Verdict = results.VerdictNotRecursive
+		ret.Reason = "recursion not available or refused"
+	case checked == 0:
+		ret.Verdict = results.VerdictIncorrect
+		ret.Reason = "every answer was an error"
+	case float64(ret.Correct)/float64(checked) < v.minCorrect:
+		ret.Verdict = results.VerdictIncorrect
+		ret.Reason = fmt.Sprintf(
+			"%d of %d answers consistent with the controls",
+			ret.Correct,
+			checked,
+		)
+	case !ret.Stable:
+		ret.Verdict = results.VerdictUnstable
+		ret.Reason = "answers changed between rounds"
+		if ret.Answered < ret.Probes {
+			ret.Reason = fmt.Sprintf(
+				"%d of %d probes answered", ret.Answered, ret.Probes,
+			)
+		}
+	case v.maxRTT > 0 && ret.MedianRTTMs > float64(v.maxRTT)/float64(time.Millisecond):
+		ret.Verdict = results.VerdictSlow
+		ret.Reason = fmt.Sprintf("median response time %.0fms", ret.MedianRTTMs)
+	default:
+		ret.Verdict = results.VerdictValid
+		ret.Reason = fmt.Sprintf(
+			"%d of %d answers consistent, median response time %.0fms",
+			ret.Correct,
+			checked,
+			ret.MedianRTTMs,
+		)
+	}
+
+	return ret
+}
+
+// validateAll validates every address in ipMap, workers at a time, and
+// returns the validations sorted by IP
+func (v *validator) validateAll(ipMap map[string]string) []Validation {
+	jobs := make(chan string)
+	validations := make(chan Validation)
+	var wg sync.WaitGroup
+	for i := 0; i < v.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ipStr := range jobs {
+				ip := net.ParseIP(ipStr)
+				if ip == nil {
+					validations <- Validation{
+						IP:      ipStr,
+						Key:     ipStr,
+						Label:   ipMap[ipStr],
+						Verdict: results.VerdictDead,
+						Reason:  "not an IP address",
+					}
+					continue
+				}
+				val := v.validate(ip, ipMap[ipStr])
+				val.Key = ipStr
+				validations <- val
+			}
+		}()
+	}
+	go func() {
+		for ip := range ipMap {
+			jobs <- ip
+		}
+		close(jobs)
+		wg.Wait()
+		close(validations)
+	}()
+
+	var ret []Validation
+	for val := range validations {
+		ret = append(ret, val)
+		if len(ret)%100 == 0 {
+			infoLogger.Printf("Validated %d of %d resolvers\n", len(ret), len(ipMap))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP < ret[j].IP })
+
+	return ret
+}
+
+// removeInvalidResolvers drops the candidates that weren't valid from ipMap
+// and logs how many got each verdict per IP version, and how many weren't
+// IP addresses at all
+func removeInvalidResolvers(ipMap map[string]string, validations []Validation) {
+	counts := make(map[string]map[int]int)
+	var notIPs int
+	for _, val := range validations {
+		if counts[val.Verdict] == nil {
+			counts[val.Verdict] = make(map[int]int)
+		}
+		if val.Version == 0 {
+			notIPs++
+		} else {
+			counts[val.Verdict][val.Version]++
+		}
+		if val.Verdict != results.VerdictValid {
+			delete(ipMap, val.Key)
+		}
+	}
+	if notIPs > 0 {
+		infoLogger.Printf("not IP addresses: %d\n", notIPs)
+	}
+	for _, verdict := range []string{
+		results.VerdictValid, results.VerdictDead, results.VerdictNotRecursive, results.VerdictIncorrect,
+		results.VerdictUnstable, results.VerdictSlow,
+	} {
+		infoLogger.Printf(
+			"%s: %d v4, %d v6\n",
+			verdict,
+			counts[verdict][4],
+			counts[verdict][6],
+		)
+	}
+}
+
+// writeReport writes each validation to path, one line of JSON at a time
+func writeReport(validations []Validation, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("failed to create file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	for _, val := range validations {
+		bs, err := json.Marshal(val)
+		if err != nil {
+			errorLogger.Fatalf("json.Marshal error: %v\n", err)
+		}
+		file.WriteString(string(bs) + "\n")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	resolve "github.com/timartiny/RipeProbe/resolve"
+	results "github.com/timartiny/RipeProbe/results"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testDomain = "example.com"
+
+// controlIP is the control answer for testDomain
+var controlIP = net.ParseIP("192.0.2.1")
+
+// answer is how a stub resolver answers its nth query (from 0), a nil
+// message is no answer at all
+type answer func(n int) *dnsmessage.Message
+
+// newStub starts a stub resolver on 127.0.0.1 answering with a and returns
+// the port it listens on
+func newStub(t *testing.T, a answer, delay time.Duration) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var count int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err = query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			resp := a(int(atomic.AddInt32(&count, 1) - 1))
+			if resp == nil {
+				continue
+			}
+			resp.ID = query.ID
+			resp.Response = true
+			resp.Questions = query.Questions
+			b, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			time.Sleep(delay)
+			conn.WriteTo(b, addr)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	return port
+}
+
+// answerWith is a recursive resolver's answer of ip for testDomain
+func answerWith(ip string) *dnsmessage.Message {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionAvailable: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(testDomain + "."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.AResource{A: a},
+		}},
+	}
+}
+
+func always(m *dnsmessage.Message) answer {
+	return func(int) *dnsmessage.Message { return m }
+}
+
+func newTestValidator(t *testing.T, port string) *validator {
+	resolver := resolve.New()
+	resolver.Port = port
+	resolver.Timeout = 200 * time.Millisecond
+	checker := consistency.NewChecker(nil)
+	checker.Controls.Add(testDomain, controlIP)
+	v, err := newValidator(resolver, checker, []string{testDomain})
+	if err != nil {
+		t.Fatalf("newValidator: %v", err)
+	}
+	v.rounds = 3
+	v.maxRTT = 100 * time.Millisecond
+	v.minCorrect = 1
+
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  answer
+		delay   time.Duration
+		verdict string
+	}{
+		{
+			name:    "valid",
+			answer:  always(answerWith("192.0.2.1")),
+			verdict: results.VerdictValid,
+		},
+		{
+			name:    "dead",
+			answer:  always(nil),
+			verdict: results.VerdictDead,
+		},
+		{
+			name: "recursion not available",
+			answer: always(&dnsmessage.Message{
+				Header: dnsmessage.Header{Authoritative: true},
+			}),
+			verdict: results.VerdictNotRecursive,
+		},
+		{
+			name: "refused",
+			answer: always(&dnsmessage.Message{
+				Header: dnsmessage.Header{
+					RecursionAvailable: true,
+					RCode:              dnsmessage.RCodeRefused,
+				},
+			}),
+			verdict: results.VerdictNotRecursive,
+		},
+		{
+			name:    "incorrect",
+			answer:  always(answerWith("203.0.113.66")),
+			verdict: results.VerdictIncorrect,
+		},
+		{
+			name: "answers change",
+			answer: func(n int) *dnsmessage.Message {
+				if n == 1 {
+					return &dnsmessage.Message{
+						Header: dnsmessage.Header{
+							RecursionAvailable: true,
+							RCode:              dnsmessage.RCodeServerFailure,
+						},
+					}
+				}
+				return answerWith("192.0.2.1")
+			},
+			verdict: results.VerdictUnstable,
+		},
+		{
+			name: "misses probes",
+			answer: func(n int) *dnsmessage.Message {
+				if n == 1 {
+					return nil
+				}
+				return answerWith("192.0.2.1")
+			},
+			verdict: results.VerdictUnstable,
+		},
+		{
+			name:    "slow",
+			answer:  always(answerWith("192.0.2.1")),
+			delay:   150 * time.Millisecond,
+			verdict: results.VerdictSlow,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestValidator(t, newStub(t, test.answer, test.delay))
+			val := v.validate(net.ParseIP("127.0.0.1"), "CN_Resolver")
+			if val.Verdict != test.verdict {
+				t.Errorf("Verdict = %s (%s), want %s", val.Verdict, val.Reason, test.verdict)
+			}
+			if val.Version != 4 || val.Probes != 3 {
+				t.Errorf("Version %d, %d probes, want 4 and 3", val.Version, val.Probes)
+			}
+		})
+	}
+}
+
+// TestRemoveInvalidResolvers checks invalid addresses are removed by the key
+// they had in the map, not their canonical form
+func TestRemoveInvalidResolvers(t *testing.T) {
+	infoLogger = log.New(ioutil.Discard, "", 0)
+	ipMap := map[string]string{
+		"1.2.3.4":          "CN_Resolver",
+		"2001:DB8::0001":   "CN_Resolver",
+		"::ffff:192.0.2.9": "CN_Resolver",
+		"not-an-ip":        "CN_Resolver",
+	}
+	validations := []Validation{
+		{IP: "1.2.3.4", Key: "1.2.3.4", Version: 4, Verdict: results.VerdictValid},
+		{IP: "2001:db8::1", Key: "2001:DB8::0001", Version: 6, Verdict: results.VerdictDead},
+		{IP: "192.0.2.9", Key: "::ffff:192.0.2.9", Version: 4, Verdict: results.VerdictIncorrect},
+		{IP: "not-an-ip", Key: "not-an-ip", Verdict: results.VerdictDead},
+	}
+
+	removeInvalidResolvers(ipMap, validations)
+	if len(ipMap) != 1 || len(ipMap["1.2.3.4"]) == 0 {
+		t.Errorf("left %v, want only 1.2.3.4", ipMap)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// Filter says whether a domain should be selected
+type Filter func(dr *results.DomainResults) bool
+
+// token is one word, operator or parenthesis of a filter
+type token struct {
+	text string
+	pos  int
+}
+
+// isWordRune is true for the runes that make up field names and values
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-*", r)
+}
+
+// tokenize splits a filter into words, comparison operators, "(", ")", "!",
+// "&&" and "||".
+func tokenize(s string) ([]token, error) {
+	var ret []token
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			ret = append(ret, token{string(r), i})
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, fmt.Errorf("expected %c%c at %d", r, r, i)
+			}
+			ret = append(ret, token{string(runes[i : i+2]), i})
+			i += 2
+		case r == '<' || r == '>' || r == '=' || r == '!':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				ret = append(ret, token{string(runes[i : i+2]), i})
+				i += 2
+			} else {
+				ret = append(ret, token{string(r), i})
+				i++
+			}
+		case isWordRune(r):
+			start := i
+			for i < len(runes) && isWordRune(runes[i]) {
+				i++
+			}
+			ret = append(ret, token{string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", r, i)
+		}
+	}
+
+	return ret, nil
+}
+
+// parser is a recursive descent parser over the tokens of a filter:
+//
+//	expr  = and { ("or" | "||") and }
+//	and   = unary { ("and" | "&&") unary }
+//	unary = ("not" | "!") unary | "(" expr ")" | term
+//	term  = field [ op value ]
+type parser struct {
+	tokens []token
+	next   int
+	policy results.TLSPolicy
+}
+
+func (p *parser) peek() string {
+	if p.next >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.next].text
+}
+
+func (p *parser) pos() int {
+	if p.next >= len(p.tokens) {
+		return -1
+	}
+
+	return p.tokens[p.next].pos
+}
+
+func (p *parser) expr() (Filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(dr *results.DomainResults) bool { return l(dr) || right(dr) }
+	}
+
+	return left, nil
+}
+
+func (p *parser) and() (Filter, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(dr *results.DomainResults) bool { return l(dr) && right(dr) }
+	}
+
+	return left, nil
+}
+
+func (p *parser) unary() (Filter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next++
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(dr *results.DomainResults) bool { return !f(dr) }, nil
+	case "(":
+		p.next++
+		f, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("expected ) at %d", p.pos())
+		}
+		p.next++
+		return f, nil
+	case "":
+		return nil, fmt.Errorf("filter ends early")
+	}
+
+	return p.term()
+}
+
+// isOp is true for the comparison operators
+func isOp(s string) bool {
+	switch s {
+	case "=", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+
+	return false
+}
+
+// boolFields are the fields that can be used on their own, or compared to
+// true or false
+var boolFields = map[string]func(dr *results.DomainResults, p results.TLSPolicy) bool{
+	"has_v4": func(dr *results.DomainResults, _ results.TLSPolicy) bool { return dr.HasV4 },
+	"has_v6": func(dr *results.DomainResults, _ results.TLSPolicy) bool { return dr.HasV6 },
+	"has_v4_tls": func(dr *results.DomainResults, p results.TLSPolicy) bool {
+		return supportsTLS(dr.V4TLS, dr.HasV4TLS, p)
+	},
+	"has_v6_tls": func(dr *results.DomainResults, p results.TLSPolicy) bool {
+		return supportsTLS(dr.V6TLS, dr.HasV6TLS, p)
+	},
+	"global": func(dr *results.DomainResults, _ results.TLSPolicy) bool {
+		return dr.CitizenLabGlobalList
+	},
+}
+
+// supportsTLS applies the policy to the TLS summary. Details files written
+// before querylist kept the summaries only have the flag it decided on
+func supportsTLS(s results.TLSSummary, has bool, p results.TLSPolicy) bool {
+	if s.Valid+s.Invalid == 0 {
+		return has
+	}
+
+	return s.Supports(p)
+}
+
+// intFields are the fields compared to a number
+var intFields = map[string]func(dr *results.DomainResults) int{
+	"rank":           func(dr *results.DomainResults) int { return dr.Rank },
+	"v4_tls_valid":   func(dr *results.DomainResults) int { return dr.V4TLS.Valid },
+	"v4_tls_invalid": func(dr *results.DomainResults) int { return dr.V4TLS.Invalid },
+	"v6_tls_valid":   func(dr *results.DomainResults) int { return dr.V6TLS.Valid },
+	"v6_tls_invalid": func(dr *results.DomainResults) int { return dr.V6TLS.Invalid },
+}
+
+// listFields are the fields holding a list, "field=value" is true when value
+// is in the list and "field=*" when the list isn't empty
+var listFields = map[string]func(dr *results.DomainResults) []string{
+	"country":  func(dr *results.DomainResults) []string { return dr.CitizenLabCountryList },
+	"category": func(dr *results.DomainResults) []string { return dr.CitizenLabCategories },
+}
+
+// fieldAliases lets the JSON names from querylist's output be used too
+var fieldAliases = map[string]string{
+	"tranco_rank":              "rank",
+	"citizen_lab_global_list":  "global",
+	"citizen_lab_country_list": "country",
+	"citizen_lab_categories":   "category",
+}
+
+func (p *parser) term() (Filter, error) {
+	start := p.pos()
+	field := strings.ToLower(p.peek())
+	if field == ")" || isOp(field) {
+		return nil, fmt.Errorf("expected a field at %d, got %s", start, field)
+	}
+	p.next++
+	if alias, ok := fieldAliases[field]; ok {
+		field = alias
+	}
+	op, value := "", ""
+	if isOp(p.peek()) {
+		op = p.peek()
+		p.next++
+		value = p.peek()
+		if len(value) == 0 || value == "(" || value == ")" || isOp(value) {
+			return nil, fmt.Errorf("expected a value for %s at %d", field, p.pos())
+		}
+		p.next++
+	}
+
+	if get, ok := boolFields[field]; ok {
+		want := true
+		switch {
+		case len(op) == 0:
+		case op == "=" || op == "!=":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %d compares to true or false", field, start)
+			}
+			want = b == (op == "=")
+		default:
+			return nil, fmt.Errorf("%s at %d can only use = or !=", field, start)
+		}
+		policy := p.policy
+		return func(dr *results.DomainResults) bool {
+			return get(dr, policy) == want
+		}, nil
+	}
+	if len(op) == 0 {
+		return nil, fmt.Errorf("%s at %d needs a comparison", field, start)
+	}
+
+	if get, ok := listFields[field]; ok {
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("%s at %d can only use = or !=", field, start)
+		}
+		in := func(dr *results.DomainResults) bool {
+			list := get(dr)
+			if value == "*" {
+				return len(list) > 0
+			}
+			return contains(list, value)
+		}
+		if op == "!=" {
+			return func(dr *results.DomainResults) bool { return !in(dr) }, nil
+		}
+		return in, nil
+	}
+
+	if get, ok := intFields[field]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s at %d compares to a number", field, start)
+		}
+		return func(dr *results.DomainResults) bool {
+			return compare(get(dr), op, n)
+		}, nil
+	}
+
+	if strings.HasPrefix(field, "rank.") {
+		// the rank on one of the lists given to querylist with --ranking,
+		// false for domains that aren't on it
+		source := strings.TrimPrefix(field, "rank.")
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s at %d compares to a number", field, start)
+		}
+		return func(dr *results.DomainResults) bool {
+			rank, ok := dr.RankOn(source)
+			return ok && compare(rank, op, n)
+		}, nil
+	}
+
+	if field == "domain" {
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("domain at %d can only use = or !=", start)
+		}
+		// "domain=example.com" also matches subdomains of example.com
+		value = strings.ToLower(value)
+		return func(dr *results.DomainResults) bool {
+			d := strings.ToLower(dr.Domain)
+			match := d == value || strings.HasSuffix(d, "."+value)
+			return match == (op == "=")
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field %s at %d", field, start)
+}
+
+// compare applies op to a and b
+func compare(a int, op string, b int) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+
+	return false
+}
+
+// contains is a case insensitive search of list for s
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseFilter parses a filter such as
+//
+//	rank<=10000 and has_v4_tls and (country=CN or category=NEWS)
+//
+// or, with the ranks from querylist's --ranking lists,
+//
+//	rank.crux-br<=5000 and has_v4_tls and has_v6_tls
+//
+// An empty filter selects every domain. has_v4_tls and has_v6_tls are decided
+// by policy.
+func ParseFilter(s string, policy results.TLSPolicy) (Filter, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return func(*results.DomainResults) bool { return true }, nil
+	}
+	p := &parser{tokens: tokens, policy: policy}
+	f, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s at %d", p.peek(), p.pos())
+	}
+
+	return f, nil
+}
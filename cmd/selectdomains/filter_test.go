@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	results "github.com/timartiny/RipeProbe/results"
+)
+
+// testDomains are the domains filters are run over in the tests
+var testDomains = []*results.DomainResults{
+	{
+		Domain:                "news.example",
+		Rank:                  10,
+		Rankings:              []results.Ranking{{Source: "crux-br", Rank: 1000}},
+		HasV4:                 true,
+		HasV6:                 true,
+		CitizenLabGlobalList:  true,
+		CitizenLabCountryList: []string{"CN"},
+		CitizenLabCategories:  []string{"NEWS"},
+		V4TLS:                 results.TLSSummary{Valid: 2},
+		V6TLS:                 results.TLSSummary{Valid: 1, Invalid: 1},
+	},
+	{
+		Domain:               "www.shop.example",
+		Rank:                 500,
+		HasV4:                true,
+		CitizenLabCategories: []string{"COMM"},
+		V4TLS:                results.TLSSummary{Invalid: 1},
+	},
+	{
+		Domain:                "rights.example",
+		Rank:                  20000,
+		Rankings:              []results.Ranking{{Source: "crux-br", Rank: 5000}},
+		HasV6:                 true,
+		CitizenLabCountryList: []string{"IR", "CN"},
+		CitizenLabCategories:  []string{"HUMR"},
+		V6TLS:                 results.TLSSummary{Valid: 1},
+	},
+}
+
+// selected returns the domains of testDomains f selects
+func selected(f Filter) []string {
+	var ret []string
+	for _, dr := range testDomains {
+		if f(dr) {
+			ret = append(ret, dr.Domain)
+		}
+	}
+
+	return ret
+}
+
+func TestParseFilter(t *testing.T) {
+	const news, shop, rights = "news.example", "www.shop.example", "rights.example"
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{"empty", "", []string{news, shop, rights}},
+		{"bool field", "has_v4", []string{news, shop}},
+		{"bool compared", "has_v6=false", []string{shop}},
+		{"bool not equal", "has_v6 != true", []string{shop}},
+		{"not", "not global", []string{shop, rights}},
+		{"bang", "!has_v4", []string{rights}},
+		{"not binds tighter than and", "!has_v4 && has_v6", []string{rights}},
+		{"not of parentheses", "!(has_v4 && has_v6)", []string{shop, rights}},
+		{"and binds tighter than or", "global or has_v4 and rank>100", []string{news, shop}},
+		{"or first in parentheses", "(global or has_v4) and rank>100", []string{shop}},
+		{"nested parentheses", "((rank<100 || rank>10000) && (has_v6))", []string{news, rights}},
+		{"rank less", "rank<500", []string{news}},
+		{"rank less or equal", "rank<=500", []string{news, shop}},
+		{"rank greater", "rank>500", []string{rights}},
+		{"rank greater or equal", "rank >= 500", []string{shop, rights}},
+		{"rank equal", "rank=500", []string{shop}},
+		{"rank not equal", "rank!=500", []string{news, rights}},
+		{"json name", "tranco_rank<100", []string{news}},
+		{"ranking list", "rank.crux-br<=1000", []string{news}},
+		{"not on ranking list", "!rank.crux-br>0", []string{shop}},
+		{"tls counts", "v4_tls_valid>=1 or v6_tls_invalid>0", []string{news}},
+		{"list field", "country=cn", []string{news, rights}},
+		{"list field not equal", "country!=IR", []string{news, shop}},
+		{"wildcard", "country=*", []string{news, rights}},
+		{"not wildcard", "country!=*", []string{shop}},
+		{"category", "category=NEWS or category=HUMR", []string{news, rights}},
+		{"domain and subdomains", "domain=shop.example", []string{shop}},
+		{"domain not equal", "domain!=example", nil},
+		{"tls policy", "has_v6_tls", []string{rights}},
+		{"keywords and symbols", "global and not (rank > 100) || category = COMM", []string{news, shop}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ParseFilter(test.filter, results.TLSPolicyAll)
+			if err != nil {
+				t.Fatalf("ParseFilter(%q): %v", test.filter, err)
+			}
+			if got := selected(f); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%q selected %v, want %v", test.filter, got, test.want)
+			}
+		})
+	}
+}
+
+// TestTLSPolicy checks has_v6_tls follows the policy it was parsed with
+func TestTLSPolicy(t *testing.T) {
+	f, err := ParseFilter("has_v6_tls", results.TLSPolicy{Any: true})
+	if err != nil {
+		t.Fatalf("ParseFilter: %v", err)
+	}
+	want := []string{"news.example", "rights.example"}
+	if got := selected(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("selected %v, want %v", got, want)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"single ampersand", "has_v4 & has_v6"},
+		{"single bar", "has_v4 | has_v6"},
+		{"unexpected rune", "rank<10 ; has_v4"},
+		{"unclosed parenthesis", "(has_v4 and has_v6"},
+		{"extra parenthesis", "has_v4)"},
+		{"empty parentheses", "()"},
+		{"ends early", "has_v4 and"},
+		{"not alone", "not"},
+		{"missing value", "rank<"},
+		{"operator for a value", "rank<="},
+		{"missing field", "=10"},
+		{"unknown field", "popularity<10"},
+		{"rank needs a comparison", "rank"},
+		{"rank not a number", "rank<ten"},
+		{"ranking list not a number", "rank.crux-br<high"},
+		{"bool not true or false", "has_v4=yes"},
+		{"bool ordered", "has_v4<1"},
+		{"list ordered", "country>CN"},
+		{"domain ordered", "domain<example"},
+		{"two terms", "has_v4 has_v6"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseFilter(test.filter, results.TLSPolicyAll); err == nil {
+				t.Errorf("ParseFilter(%q) succeeded, want an error", test.filter)
+			}
+		})
+	}
+}
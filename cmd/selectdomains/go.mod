@@ -0,0 +1,10 @@
+module github.com/timartiny/RipeProbe/cmd/selectdomains
+
+replace github.com/timartiny/RipeProbe/results => ../../results
+
+go 1.16
+
+require (
+	github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
+	github.com/zmap/zflags v1.4.0-beta.1
+)
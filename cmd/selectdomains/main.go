@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	results "github.com/timartiny/RipeProbe/results"
+	flags "github.com/zmap/zflags"
+)
+
+var infoLogger *log.Logger
+var errorLogger *log.Logger
+
+// Groups a selected domain can be in
+const (
+	GroupCensored = "censored"
+	GroupControl  = "control"
+)
+
+type SelectDomainsFlags struct {
+	DetailsFile string `long:"details_file" description:"Path to querylist's full details output" required:"true" json:"details_file"`
+	Censored    string `long:"censored" description:"Filter for the domains expected to be censored, e.g. 'country=CN and has_v4_tls and has_v6_tls'" required:"true" json:"censored"`
+	Control     string `long:"control" description:"Filter for the control domains, by default every domain that isn't selected by --censored" json:"control"`
+	TLSPolicy   string `long:"tls_policy" default:"all" description:"When has_v4_tls/has_v6_tls are true: all (every address has a valid certificate), any, or a fraction of the addresses such as 0.5" json:"tls_policy"`
+	Count       int    `long:"count" description:"Number of domains to select from each group, 0 for as many as both groups have" json:"count"`
+	ByRank      bool   `long:"by_rank" description:"Take the best ranked domains of each group instead of a random sample" json:"by_rank"`
+	RankSource  string `long:"rank_source" description:"Ranking list (a --ranking source given to querylist, e.g. crux-br) to rank domains by instead of the Tranco rank" json:"rank_source"`
+	Seed        int64  `long:"seed" description:"Seed for the random sample, the current time when 0" json:"seed"`
+	Outfile     string `long:"out_file" description:"File to write the selected domains to, one per line" required:"true" json:"out_file"`
+	GroupsFile  string `long:"groups_file" description:"File to write which group each selected domain is in (in JSON)" json:"groups_file"`
+}
+
+// Selection is a selected domain and the group it was selected for
+type Selection struct {
+	Domain string `json:"domain"`
+	Group  string `json:"group"`
+	Rank   int    `json:"tranco_rank,omitempty"`
+	// SourceRank is the rank on --rank_source, when one was given
+	SourceRank int `json:"source_rank,omitempty"`
+}
+
+// setupArgs grabs the commandline arguments and puts them in a usable struct
+func setupArgs(args []string) SelectDomainsFlags {
+	var ret SelectDomainsFlags
+	posArgs, _, _, err := flags.ParseArgs(&ret, args)
+
+	if err != nil {
+		errorLogger.Printf("Error parsing args: %v\n", err)
+		os.Exit(1)
+	}
+	if len(posArgs) > 0 {
+		infoLogger.Printf("Extra arguments provided, but not used: %v\n", args)
+	}
+	if ret.Count < 0 {
+		errorLogger.Fatalf("--count can't be negative, got %d\n", ret.Count)
+	}
+
+	return ret
+}
+
+// readDetails reads querylist's full details file
+func readDetails(path string) []*results.DomainResults {
+	file, err := os.Open(path)
+	if err != nil {
+		errorLogger.Fatalf("Error opening file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	drs, err := results.ReadDomainResults(file)
+	if err != nil {
+		errorLogger.Fatalf("Error reading %s, %v\n", path, err)
+	}
+
+	return drs
+}
+
+// group splits drs into the domains matching censored and those matching
+// control. A domain matching both is only a censored domain.
+func group(
+	drs []*results.DomainResults, censored, control Filter,
+) ([]*results.DomainResults, []*results.DomainResults) {
+	var censoredDRs, controlDRs []*results.DomainResults
+	for _, dr := range drs {
+		switch {
+		case censored(dr):
+			censoredDRs = append(censoredDRs, dr)
+		case control(dr):
+			controlDRs = append(controlDRs, dr)
+		}
+	}
+
+	return censoredDRs, controlDRs
+}
+
+// rankOf returns a domain's rank on source, its Tranco rank when source is
+// empty and 0 when it has no rank
+func rankOf(dr *results.DomainResults, source string) int {
+	if len(source) == 0 {
+		return dr.Rank
+	}
+	rank, _ := dr.RankOn(source)
+
+	return rank
+}
+
+// byRank sorts drs best ranked on source first, domains without a rank go last
+func byRank(drs []*results.DomainResults, source string) {
+	sort.SliceStable(drs, func(i, j int) bool {
+		ri, rj := rankOf(drs[i], source), rankOf(drs[j], source)
+		if ri == 0 || rj == 0 {
+			return rj == 0 && ri != 0
+		}
+		return ri < rj
+	})
+}
+
+// sample returns n of drs, either the n best ranked on source or n chosen at
+// random
+func sample(
+	drs []*results.DomainResults,
+	n int,
+	rank bool,
+	source string,
+	rng *rand.Rand,
+) []*results.DomainResults {
+	ret := make([]*results.DomainResults, len(drs))
+	copy(ret, drs)
+	if rank {
+		byRank(ret, source)
+	} else {
+		rng.Shuffle(len(ret), func(i, j int) { ret[i], ret[j] = ret[j], ret[i] })
+	}
+	ret = ret[:n]
+	byRank(ret, source)
+
+	return ret
+}
+
+// writeDomains writes each selected domain on its own line, the format
+// whiteboard and inCountryLookup read
+func writeDomains(selections []Selection, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	for _, s := range selections {
+		file.WriteString(s.Domain + "\n")
+	}
+}
+
+// writeGroups writes each selection to path, one line of JSON at a time
+func writeGroups(selections []Selection, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	for _, s := range selections {
+		bs, err := json.Marshal(s)
+		if err != nil {
+			errorLogger.Fatalf("json.Marshal error: %v\n", err)
+		}
+		file.WriteString(string(bs) + "\n")
+	}
+}
+
+func main() {
+	infoLogger = log.New(
+		os.Stderr,
+		"INFO: ",
+		log.Ldate|log.Ltime|log.Lshortfile,
+	)
+	errorLogger = log.New(
+		os.Stderr,
+		"ERROR: ",
+		log.Ldate|log.Ltime|log.Lshortfile,
+	)
+
+	args := setupArgs(os.Args[1:])
+
+	policy, err := results.ParseTLSPolicy(args.TLSPolicy)
+	if err != nil {
+		errorLogger.Fatalf("Error with --tls_policy: %v\n", err)
+	}
+	censored, err := ParseFilter(args.Censored, policy)
+	if err != nil {
+		errorLogger.Fatalf("Error parsing --censored filter, %v\n", err)
+	}
+	control := func(dr *results.DomainResults) bool { return true }
+	if len(args.Control) > 0 {
+		if control, err = ParseFilter(args.Control, policy); err != nil {
+			errorLogger.Fatalf("Error parsing --control filter, %v\n", err)
+		}
+	}
+
+	drs := readDetails(args.DetailsFile)
+	censoredDRs, controlDRs := group(drs, censored, control)
+	infoLogger.Printf(
+		"%d domains read, %d match --censored, %d match --control\n",
+		len(drs),
+		len(censoredDRs),
+		len(controlDRs),
+	)
+
+	n := len(censoredDRs)
+	if len(controlDRs) < n {
+		n = len(controlDRs)
+	}
+	if args.Count > 0 {
+		if args.Count > n {
+			infoLogger.Printf(
+				"Asked for %d domains per group, only %d are available\n",
+				args.Count,
+				n,
+			)
+		} else {
+			n = args.Count
+		}
+	}
+	if n == 0 {
+		errorLogger.Fatalf("No domains to select, a group is empty\n")
+	}
+
+	seed := args.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if !args.ByRank {
+		infoLogger.Printf("Sampling with seed %d\n", seed)
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	var selections []Selection
+	for _, g := range []struct {
+		name string
+		drs  []*results.DomainResults
+	}{{GroupCensored, censoredDRs}, {GroupControl, controlDRs}} {
+		for _, dr := range sample(g.drs, n, args.ByRank, args.RankSource, rng) {
+			s := Selection{Domain: dr.Domain, Group: g.name, Rank: dr.Rank}
+			if len(args.RankSource) > 0 {
+				s.SourceRank = rankOf(dr, args.RankSource)
+			}
+			selections = append(selections, s)
+		}
+	}
+	infoLogger.Printf(
+		"Selected %d censored and %d control domains, writing to %s\n",
+		n,
+		n,
+		args.Outfile,
+	)
+
+	writeDomains(selections, args.Outfile)
+	if len(args.GroupsFile) > 0 {
+		writeGroups(selections, args.GroupsFile)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	classify "github.com/timartiny/RipeProbe/classify"
+)
+
+// ResolverBreakdown is a single resolver's events summed across every probe
+// that used it, split by the record type that was requested.
+type ResolverBreakdown struct {
+	Resolver string     `json:"resolver"`
+	V4       EventTable `json:"v4"`
+	V6       EventTable `json:"v6"`
+}
+
+// ProbeBreakdown is a single probe's events summed across every resolver it
+// was asked to use, split by the record type that was requested.
+type ProbeBreakdown struct {
+	Probe        string     `json:"probe"`
+	V4           EventTable `json:"v4"`
+	V6           EventTable `json:"v6"`
+	TimeoutRatio float64    `json:"timeout_ratio"`
+}
+
+// OutlierResolver ranks a resolver by how far its anomaly rate (anything that
+// is not valid-tls or consistent-asn) sits from the mean of all the resolvers
+// in the same table
+type OutlierResolver struct {
+	Resolver    string  `json:"resolver"`
+	Total       int     `json:"total"`
+	AnomalyRate float64 `json:"anomaly_rate"`
+	ZScore      float64 `json:"z_score"`
+}
+
+// Breakdown holds the drill-down reports for one of the Triplets that
+// getTable otherwise collapses into two totals.
+type Breakdown struct {
+	Name          string              `json:"name"`
+	Resolvers     []ResolverBreakdown `json:"resolvers,omitempty"`
+	AAAAOnly      []ResolverBreakdown `json:"aaaa_only_injectors,omitempty"`
+	TimeoutProbes []ProbeBreakdown    `json:"timeout_probes,omitempty"`
+	Outliers      []OutlierResolver   `json:"outliers,omitempty"`
+}
+
+// BreakdownOptions says which reports to build and the thresholds to use.
+type BreakdownOptions struct {
+	Resolvers    bool
+	AAAAOnly     bool
+	Timeouts     bool
+	Outliers     bool
+	TimeoutRatio float64
+	NumOutliers  int
+}
+
+// Any returns true if at least one report has been requested
+func (bo BreakdownOptions) Any() bool {
+	return bo.Resolvers || bo.AAAAOnly || bo.Timeouts || bo.Outliers
+}
+
+// parseReports turns the comma separated -report flag into BreakdownOptions
+func parseReports(reports string) (BreakdownOptions, error) {
+	var ret BreakdownOptions
+	if len(reports) == 0 {
+		return ret, nil
+	}
+	for _, report := range strings.Split(reports, ",") {
+		switch strings.TrimSpace(report) {
+		case "resolvers":
+			ret.Resolvers = true
+		case "aaaa-only":
+			ret.AAAAOnly = true
+		case "timeouts":
+			ret.Timeouts = true
+		case "outliers":
+			ret.Outliers = true
+		case "all":
+			ret.Resolvers = true
+			ret.AAAAOnly = true
+			ret.Timeouts = true
+			ret.Outliers = true
+		case "":
+			continue
+		default:
+			return ret, fmt.Errorf("unknown report: %s", report)
+		}
+	}
+
+	return ret, nil
+}
+
+// addSingle adds each event in single to the v4 or v6 table based on the
+// record type it was stored under.
+func addSingle(v4Table, v6Table EventTable, single Single) {
+	for key, eventPtr := range single {
+		switch recordType(key) {
+		case "v4":
+			v4Table.Merge(eventPtr.Counts)
+		case "v6":
+			v6Table.Merge(eventPtr.Counts)
+		}
+	}
+}
+
+// injected returns the number of responses that gave addresses that weren't
+// valid for the domain: invalid and bogon IPs, known injections and
+// blockpages
+func injected(et EventTable) int {
+	return et[classify.InvalidIP] + et[classify.BogonIP] +
+		et[classify.KnownInjection] + et[classify.Blockpage]
+}
+
+// getResolverBreakdowns sums up every probe's events for each resolver,
+// sorted by resolver IP.
+func getResolverBreakdowns(trip Triplet) []ResolverBreakdown {
+	resolverMap := make(map[string]*ResolverBreakdown)
+	for _, pair := range trip {
+		for resolver, single := range pair {
+			rb, ok := resolverMap[resolver]
+			if !ok {
+				rb = &ResolverBreakdown{
+					Resolver: resolver,
+					V4:       EventTable{},
+					V6:       EventTable{},
+				}
+				resolverMap[resolver] = rb
+			}
+			addSingle(rb.V4, rb.V6, single)
+		}
+	}
+
+	ret := make([]ResolverBreakdown, 0, len(resolverMap))
+	for _, rb := range resolverMap {
+		ret = append(ret, *rb)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Resolver < ret[j].Resolver
+	})
+
+	return ret
+}
+
+// getAAAAOnlyInjectors returns the resolvers that gave injected answers
+// (see injected) for AAAA requests but never for A requests.
+func getAAAAOnlyInjectors(resolvers []ResolverBreakdown) []ResolverBreakdown {
+	var ret []ResolverBreakdown
+	for _, rb := range resolvers {
+		if injected(rb.V6) > 0 && injected(rb.V4) == 0 {
+			ret = append(ret, rb)
+		}
+	}
+
+	return ret
+}
+
+// getTimeoutProbes returns the probes where at least ratio of all of their
+// responses were timeouts, sorted by probe ID.
+func getTimeoutProbes(trip Triplet, ratio float64) []ProbeBreakdown {
+	var ret []ProbeBreakdown
+	for probe, pair := range trip {
+		pb := ProbeBreakdown{Probe: probe, V4: EventTable{}, V6: EventTable{}}
+		for _, single := range pair {
+			addSingle(pb.V4, pb.V6, single)
+		}
+		total := pb.V4.Total() + pb.V6.Total()
+		if total == 0 {
+			continue
+		}
+		timeouts := pb.V4[classify.Timeout] + pb.V6[classify.Timeout]
+		pb.TimeoutRatio = float64(timeouts) / float64(total)
+		if pb.TimeoutRatio >= ratio {
+			ret = append(ret, pb)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Probe < ret[j].Probe
+	})
+
+	return ret
+}
+
+// getOutliers ranks resolvers by the z-score of their anomaly rate and returns
+// at most num of them, most anomalous first.
+func getOutliers(resolvers []ResolverBreakdown, num int) []OutlierResolver {
+	var ret []OutlierResolver
+	var sum float64
+	for _, rb := range resolvers {
+		total := rb.V4.Total() + rb.V6.Total()
+		if total == 0 {
+			continue
+		}
+		var valid int
+		for _, c := range classify.Categories {
+			if c.Valid() {
+				valid += rb.V4[c] + rb.V6[c]
+			}
+		}
+		rate := float64(total-valid) / float64(total)
+		sum += rate
+		ret = append(ret, OutlierResolver{
+			Resolver:    rb.Resolver,
+			Total:       total,
+			AnomalyRate: rate,
+		})
+	}
+	if len(ret) == 0 {
+		return ret
+	}
+
+	mean := sum / float64(len(ret))
+	var variance float64
+	for _, or := range ret {
+		variance += (or.AnomalyRate - mean) * (or.AnomalyRate - mean)
+	}
+	stdDev := math.Sqrt(variance / float64(len(ret)))
+	for i := range ret {
+		if stdDev > 0 {
+			ret[i].ZScore = (ret[i].AnomalyRate - mean) / stdDev
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].ZScore != ret[j].ZScore {
+			return ret[i].ZScore > ret[j].ZScore
+		}
+		return ret[i].Resolver < ret[j].Resolver
+	})
+	if num > 0 && len(ret) > num {
+		ret = ret[:num]
+	}
+
+	return ret
+}
+
+// getBreakdown builds each of the reports requested in opts for trip
+func getBreakdown(name string, trip Triplet, opts BreakdownOptions) Breakdown {
+	ret := Breakdown{Name: name}
+	resolvers := getResolverBreakdowns(trip)
+	if opts.Resolvers {
+		ret.Resolvers = resolvers
+	}
+	if opts.AAAAOnly {
+		ret.AAAAOnly = getAAAAOnlyInjectors(resolvers)
+	}
+	if opts.Timeouts {
+		ret.TimeoutProbes = getTimeoutProbes(trip, opts.TimeoutRatio)
+	}
+	if opts.Outliers {
+		ret.Outliers = getOutliers(resolvers, opts.NumOutliers)
+	}
+
+	return ret
+}
+
+func printResolverRows(rbs []ResolverBreakdown) {
+	fmt.Printf("Resolver\t\t| AF")
+	for _, c := range classify.Categories {
+		fmt.Printf("\t| %s", c)
+	}
+	fmt.Printf("\t| Total\n")
+	for _, rb := range rbs {
+		for _, row := range []struct {
+			af    string
+			table EventTable
+		}{{"v4", rb.V4}, {"v6", rb.V6}} {
+			fmt.Printf("%s\t| %s", rb.Resolver, row.af)
+			for _, c := range classify.Categories {
+				fmt.Printf("\t| %d", row.table[c])
+			}
+			fmt.Printf("\t| %d\n", row.table.Total())
+		}
+	}
+}
+
+func printBreakdown(b Breakdown, opts BreakdownOptions) {
+	if opts.Resolvers {
+		infoLogger.Printf("%s, Resolver x Record Type Table\n", b.Name)
+		printResolverRows(b.Resolvers)
+	}
+	if opts.AAAAOnly {
+		infoLogger.Printf(
+			"%s, %d Resolvers with injected answers only for AAAA requests\n",
+			b.Name,
+			len(b.AAAAOnly),
+		)
+		printResolverRows(b.AAAAOnly)
+	}
+	if opts.Timeouts {
+		infoLogger.Printf(
+			"%s, %d Probes with at least %.2f of responses timing out\n",
+			b.Name,
+			len(b.TimeoutProbes),
+			opts.TimeoutRatio,
+		)
+		fmt.Printf("Probe\t| v4 Timeout\t| v6 Timeout\t| Total\t| Ratio\n")
+		for _, pb := range b.TimeoutProbes {
+			fmt.Printf(
+				"%s\t| %d\t\t| %d\t\t| %d\t| %f\n",
+				pb.Probe,
+				pb.V4[classify.Timeout],
+				pb.V6[classify.Timeout],
+				pb.V4.Total()+pb.V6.Total(),
+				pb.TimeoutRatio,
+			)
+		}
+	}
+	if opts.Outliers {
+		infoLogger.Printf("%s, Top %d outlier Resolvers\n", b.Name, len(b.Outliers))
+		fmt.Printf("Resolver\t\t| Total\t| Anomaly Rate\t| z-score\n")
+		for _, or := range b.Outliers {
+			fmt.Printf(
+				"%s\t| %d\t| %f\t| %f\n",
+				or.Resolver,
+				or.Total,
+				or.AnomalyRate,
+				or.ZScore,
+			)
+		}
+	}
+}
+
+// Report is everything that is written out with -json
+type Report struct {
+	// Partial is set when the run was interrupted, the report then only
+	// covers the responses whose IPs were all checked
+	Partial    bool        `json:"partial,omitempty"`
+	Breakdowns []Breakdown `json:"breakdowns,omitempty"`
+	Matrices   []Matrix    `json:"matrices,omitempty"`
+}
+
+// writeReport writes the report to path as JSON
+func writeReport(report Report, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		errorLogger.Fatalf("Error creating file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		errorLogger.Fatalf("Error marshaling report, %v\n", err)
+	}
+	file.Write(b)
+	file.WriteString("\n")
+}
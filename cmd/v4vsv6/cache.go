@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// loadCertCache reads the certificates written by saveCertCache, IPs that
+// didn't serve one are kept with a nil certificate.
+func loadCertCache(path string) IPCertMap {
+	ret := make(IPCertMap)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ret
+	}
+	if err != nil {
+		errorLogger.Fatalf("Error reading file: %s, %v\n", path, err)
+	}
+
+	var saved map[string][]byte
+	if err = json.Unmarshal(b, &saved); err != nil {
+		errorLogger.Fatalf("Error unmarshaling cache, %v\n", err)
+	}
+	for ip, der := range saved {
+		if len(der) == 0 {
+			ret[ip] = nil
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			errorLogger.Fatalf("Error parsing certificate for %s, %v\n", ip, err)
+		}
+		ret[ip] = cert
+	}
+
+	return ret
+}
+
+// saveCertCache writes the DER of every IP's certificate to path as JSON
+// ({ip: base64 DER}, null when the IP didn't serve one)
+func saveCertCache(icm IPCertMap, path string) {
+	saved := make(map[string][]byte)
+	for ip, cert := range icm {
+		if cert == nil {
+			saved[ip] = nil
+			continue
+		}
+		saved[ip] = cert.Raw
+	}
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		errorLogger.Fatalf("Error marshaling cache, %v\n", err)
+	}
+	if err = ioutil.WriteFile(path, b, 0644); err != nil {
+		errorLogger.Fatalf("Error writing file: %s, %v\n", path, err)
+	}
+}
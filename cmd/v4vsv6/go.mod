@@ -2,6 +2,20 @@ module github.com/timartiny/RipeProbe/cmd/v4vsv6
 
 replace github.com/timartiny/RipeProbe/results => ../../results
 
+replace github.com/timartiny/RipeProbe/classify => ../../classify
+
+replace github.com/timartiny/RipeProbe/fingerprint => ../../fingerprint
+
+replace github.com/timartiny/RipeProbe/blockpage => ../../blockpage
+
+replace github.com/timartiny/RipeProbe/consistency => ../../consistency
+
 go 1.16
 
-require github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
+require (
+	github.com/timartiny/RipeProbe/blockpage v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/classify v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/consistency v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/fingerprint v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
+)
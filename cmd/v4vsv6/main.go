@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -11,10 +12,16 @@ import (
 	"math"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	blockpage "github.com/timartiny/RipeProbe/blockpage"
+	classify "github.com/timartiny/RipeProbe/classify"
+	consistency "github.com/timartiny/RipeProbe/consistency"
+	fingerprint "github.com/timartiny/RipeProbe/fingerprint"
 	results "github.com/timartiny/RipeProbe/results"
 )
 
@@ -36,25 +43,26 @@ func (i DomainToIPList) String() string {
 	return ret
 }
 
+// Event tallies the classified responses for one probe, resolver and Single
+// key. Data holds every answer recorded for each domain and Responses the
+// same answers grouped by response code, until verifyIPs classifies each
+// group into Counts.
 type Event struct {
-	ValidIP   int
-	InvalidIP int
-	Timeout   int
-	NoAns     int
-	ValidNS   int
-	InvalidNS int
-	SOA       int
+	Counts    classify.Counts
 	Data      DomainToIPList
+	Responses map[string][]results.Response
+}
+
+func newEvent() *Event {
+	e := new(Event)
+	e.Counts = make(classify.Counts)
+	e.Data = make(DomainToIPList)
+	e.Responses = make(map[string][]results.Response)
+	return e
 }
 
 func (e *Event) Update(otherE *Event) {
-	e.ValidIP += otherE.ValidIP
-	e.InvalidIP += otherE.InvalidIP
-	e.Timeout += otherE.Timeout
-	e.NoAns += otherE.NoAns
-	e.ValidNS += otherE.ValidNS
-	e.InvalidNS += otherE.InvalidNS
-	e.SOA += otherE.SOA
+	e.Counts.Merge(otherE.Counts)
 
 	for key, values := range otherE.Data {
 		if _, ok := e.Data[key]; !ok {
@@ -63,17 +71,35 @@ func (e *Event) Update(otherE *Event) {
 			e.Data[key] = mergeSlices(values, e.Data[key])
 		}
 	}
+	for key, responses := range otherE.Responses {
+		for _, resp := range responses {
+			e.addResponse(key, resp)
+		}
+	}
+}
+
+// addResponse adds resp to domain's responses, merged into the one with the
+// same response code if there is one
+func (e *Event) addResponse(domain string, resp results.Response) {
+	for i, existing := range e.Responses[domain] {
+		if existing.RCode == resp.RCode {
+			e.Responses[domain][i].Answers = mergeSlices(
+				resp.Answers, existing.Answers,
+			)
+			return
+		}
+	}
+	e.Responses[domain] = append(e.Responses[domain], results.Response{
+		RCode:   resp.RCode,
+		Answers: append([]string(nil), resp.Answers...),
+	})
 }
 
 func (e Event) String() string {
 	var ret string
-	ret += fmt.Sprintf("\t\tValidIP: %d\n", e.ValidIP)
-	ret += fmt.Sprintf("\t\tInvalidIP: %d\n", e.InvalidIP)
-	ret += fmt.Sprintf("\t\tTimeout: %d\n", e.Timeout)
-	ret += fmt.Sprintf("\t\tNo Answer or Authority Given: %d\n", e.NoAns)
-	ret += fmt.Sprintf("\t\tValidNS: %d\n", e.ValidNS)
-	ret += fmt.Sprintf("\t\tInvalidNS: %d\n", e.InvalidNS)
-	ret += fmt.Sprintf("\t\tSOA: %d\n", e.SOA)
+	for _, c := range classify.Categories {
+		ret += fmt.Sprintf("\t\t%s: %d\n", c, e.Counts[c])
+	}
 	ret += fmt.Sprintf("\t\tData: %v", e.Data)
 	return ret
 }
@@ -97,9 +123,34 @@ func mergeSlices(v1, v2 []string) []string {
 
 type ProbeResults []results.ProbeResult
 type QueryResults []results.QueryResult
-type Queries map[string][]string
 
-type Single map[string]*Event // t['v4']= &Event{}
+// Keys for a Single, named after the results.ProbeResult fields they come
+// from: the transport used to reach the resolver then the record type asked
+// for ("v4" is an A record, "v6" is a AAAA record).
+const (
+	V4ToV4 = "v4_to_v4"
+	V4ToV6 = "v4_to_v6"
+	V6ToV4 = "v6_to_v4"
+	V6ToV6 = "v6_to_v6"
+)
+
+// transportAndRecord splits a Single key into its transport and record type
+func transportAndRecord(key string) (string, string) {
+	split := strings.Split(key, "_to_")
+	if len(split) != 2 {
+		return "", key
+	}
+
+	return split[0], split[1]
+}
+
+// recordType returns the record type ("v4" or "v6") a Single key requested
+func recordType(key string) string {
+	_, record := transportAndRecord(key)
+	return record
+}
+
+type Single map[string]*Event // t['v4_to_v4']= &Event{}
 
 func (s Single) String() string {
 	var ret string
@@ -120,7 +171,7 @@ func (s Single) Merge(otherS Single) {
 	}
 }
 
-type Pair map[string]Single // t['resolver']['v4']= &Event{}
+type Pair map[string]Single // t['resolver']['v4_to_v4']= &Event{}
 
 func (p Pair) String() string {
 	var ret string
@@ -141,7 +192,7 @@ func (p Pair) Merge(otherP Pair) {
 	}
 }
 
-type Triplet map[string]Pair // t['probe']['resolver']['v4']= &Event{}
+type Triplet map[string]Pair // t['probe']['resolver']['v4_to_v4']= &Event{}
 
 func (t Triplet) String() string {
 	var ret string
@@ -173,18 +224,16 @@ func getStruct(path string) ProbeResults {
 	return res
 }
 
-func getEvent(domain string, answers []string, dataChan chan<- string) *Event {
-	e := new(Event)
-	e.Data = map[string][]string{}
-	for _, answer := range answers {
-		if strings.Contains(answer, "timeout") {
-			e.Timeout++
-		} else if strings.Contains(answer, "Authority") {
-			e.NoAns++
-		} else {
+func getEvent(domain string, responses []results.Response, dataChan chan<- string) *Event {
+	e := newEvent()
+	for _, resp := range responses {
+		for _, answer := range resp.Answers {
 			e.Data[domain] = append(e.Data[domain], answer)
-			dataChan <- answer
+			if net.ParseIP(answer) != nil {
+				dataChan <- answer
+			}
 		}
+		e.addResponse(domain, resp)
 	}
 
 	return e
@@ -200,27 +249,25 @@ func contains(arr []string, s string) bool {
 	return false
 }
 
-func queriesToSingle(queries Queries, vType string, uncensoredDomains []string, dc chan<- string) (Single, Single) {
+func queriesToSingle(qResult results.QueryResult, key string, uncensoredDomains []string, dc chan<- string) (Single, Single) {
 	uncensoredSingle := Single{}
-	uncensoredSingle[vType] = new(Event)
-	uncensoredSingle[vType].Data = make(DomainToIPList)
+	uncensoredSingle[key] = newEvent()
 	single := Single{}
-	single[vType] = new(Event)
-	single[vType].Data = make(DomainToIPList)
+	single[key] = newEvent()
 
-	for domain, answers := range queries {
-		tEvent := getEvent(domain, answers, dc)
+	for domain := range qResult.Queries {
+		tEvent := getEvent(domain, qResult.Responses(domain), dc)
 		if contains(uncensoredDomains, domain) {
-			uncensoredSingle[vType].Update(tEvent)
+			uncensoredSingle[key].Update(tEvent)
 		} else {
-			single[vType].Update(tEvent)
+			single[key].Update(tEvent)
 		}
 	}
 
 	return single, uncensoredSingle
 }
 
-func queryResultsToPair(qResults QueryResults, vType string, uncensoredDomains []string, dc chan<- string) (Pair, Pair, Pair, Pair) {
+func queryResultsToPair(qResults QueryResults, key string, uncensoredDomains []string, dc chan<- string) (Pair, Pair, Pair, Pair) {
 	uncensoredPair := Pair{}
 	uncensoredOpenPair := Pair{}
 	pair := Pair{}
@@ -229,9 +276,9 @@ func queryResultsToPair(qResults QueryResults, vType string, uncensoredDomains [
 	for _, qResult := range qResults {
 		rIP := qResult.ResolverIP
 		if strings.Contains(qResult.ResolverType, "Resolver") {
-			openPair[rIP], uncensoredOpenPair[rIP] = queriesToSingle(qResult.Queries, vType, uncensoredDomains, dc)
+			openPair[rIP], uncensoredOpenPair[rIP] = queriesToSingle(qResult, key, uncensoredDomains, dc)
 		} else {
-			pair[rIP], uncensoredPair[rIP] = queriesToSingle(qResult.Queries, vType, uncensoredDomains, dc)
+			pair[rIP], uncensoredPair[rIP] = queriesToSingle(qResult, key, uncensoredDomains, dc)
 		}
 	}
 
@@ -251,23 +298,23 @@ func resultsToTriplets(pResults ProbeResults, uncensoredDomains []string, dc cha
 			)
 		}
 		trip[pID], openTrip[pID], uncensoredTrip[pID], uncensoredOpenTrip[pID] =
-			queryResultsToPair(pResult.V4ToV4, "v4", uncensoredDomains, dc)
+			queryResultsToPair(pResult.V4ToV4, V4ToV4, uncensoredDomains, dc)
 		tPair, tOpenPair, tuPair, tuOpenPair := queryResultsToPair(
-			pResult.V4ToV6, "v6", uncensoredDomains, dc,
+			pResult.V4ToV6, V4ToV6, uncensoredDomains, dc,
 		)
 		trip[pID].Merge(tPair)
 		openTrip[pID].Merge(tOpenPair)
 		uncensoredTrip[pID].Merge(tuPair)
 		uncensoredOpenTrip[pID].Merge(tuOpenPair)
 		tPair, tOpenPair, tuPair, tuOpenPair = queryResultsToPair(
-			pResult.V6ToV4, "v4", uncensoredDomains, dc,
+			pResult.V6ToV4, V6ToV4, uncensoredDomains, dc,
 		)
 		trip[pID].Merge(tPair)
 		openTrip[pID].Merge(tOpenPair)
 		uncensoredTrip[pID].Merge(tuPair)
 		uncensoredOpenTrip[pID].Merge(tuOpenPair)
 		tPair, tOpenPair, tuPair, tuOpenPair = queryResultsToPair(
-			pResult.V6ToV6, "v6", uncensoredDomains, dc,
+			pResult.V6ToV6, V6ToV6, uncensoredDomains, dc,
 		)
 		trip[pID].Merge(tPair)
 		openTrip[pID].Merge(tOpenPair)
@@ -279,68 +326,124 @@ func resultsToTriplets(pResults ProbeResults, uncensoredDomains []string, dc cha
 	return trip, openTrip, uncensoredTrip, uncensoredOpenTrip
 }
 
+// IPandCert is the certificate an IP served, Cert is nil when the IP didn't
+// complete a TLS handshake.
 type IPandCert struct {
 	IP   string
 	Cert *x509.Certificate
 }
+
+// IPCertMap holds every IP that was checked, IPs without a certificate are
+// kept (as nil) so they aren't checked again on -resume.
 type IPCertMap map[string]*x509.Certificate
 
+// lookupIP grabs the certificate ip serves. Nothing is sent if ctx is
+// cancelled before the handshake finishes, so the IP is checked again on
+// -resume.
 func lookupIP(
+	ctx context.Context,
 	ip string,
 	ipCertChan chan<- *IPandCert,
 	wg *sync.WaitGroup,
 ) {
 	defer wg.Done()
+	iac := &IPandCert{IP: ip}
 	config := tls.Config{ServerName: "fake.com", InsecureSkipVerify: true}
 	timeout := time.Duration(90) * time.Second
-	dialConn, err := net.DialTimeout(
-		"tcp", net.JoinHostPort(ip, "443"), timeout,
+	dialer := &net.Dialer{Timeout: timeout}
+	dialConn, err := dialer.DialContext(
+		ctx, "tcp", net.JoinHostPort(ip, "443"),
 	)
 	if err != nil {
 		// errorLogger.Printf("net.DialTimeout error: %+v\n", err)
+		if ctx.Err() == nil {
+			ipCertChan <- iac
+		}
 		return
 	}
 
 	tlsConn := tls.Client(dialConn, &config)
 	defer tlsConn.Close()
 
+	// the handshake can't take a context, closing the connection stops it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			dialConn.Close()
+		case <-done:
+		}
+	}()
+
 	dialConn.SetReadDeadline(time.Now().Add(timeout))
 	err = tlsConn.Handshake()
-	if err != nil {
-		// errorLogger.Printf("tlsConn.Handshake error: %+v\n", err)
+	if ctx.Err() != nil {
 		return
 	}
-	iac := new(IPandCert)
-	iac.IP = ip
-	iac.Cert = tlsConn.ConnectionState().PeerCertificates[0]
+	if err == nil {
+		iac.Cert = tlsConn.ConnectionState().PeerCertificates[0]
+	}
+	// errorLogger.Printf("tlsConn.Handshake error: %+v\n", err)
 	ipCertChan <- iac
 }
 
+// checkData starts a TLS lookup for every unique IP that doesn't match a
+// fingerprint in db, those are classified without any network checks. IPs in
+// known were checked by a previous run and are skipped, as is everything once
+// ctx is cancelled.
 func checkData(
+	ctx context.Context,
 	dataInChan <-chan string,
 	ipCertChan chan<- *IPandCert,
 	wg *sync.WaitGroup,
+	db *fingerprint.Database,
+	known IPCertMap,
 ) {
 	checkMap := make(map[string]bool)
 	total := 0
+	fingerprinted := 0
+	resumed := 0
 
 	for data := range dataInChan {
 		if _, ok := checkMap[data]; !ok {
 			checkMap[data] = true
 			if ip := net.ParseIP(data); ip != nil {
+				if _, ok := db.Match(ip); ok {
+					fingerprinted++
+					continue
+				}
+				if _, ok := known[data]; ok {
+					resumed++
+					continue
+				}
+				if ctx.Err() != nil {
+					continue
+				}
 				wg.Add(1)
 				total += 1
-				go lookupIP(data, ipCertChan, wg)
+				go lookupIP(ctx, data, ipCertChan, wg)
 			}
 		}
 	}
-	infoLogger.Printf("dataInChan closed, saw %v unique IPs\n", total)
+	infoLogger.Printf(
+		"dataInChan closed, saw %v unique IPs to check, %v matching a "+
+			"fingerprint and %v already checked\n",
+		total,
+		fingerprinted,
+		resumed,
+	)
 }
 
 func collectIPResults(
-	ipCertChan <-chan *IPandCert, ipCertMapChan chan<- IPCertMap,
+	ipCertChan <-chan *IPandCert,
+	ipCertMapChan chan<- IPCertMap,
+	known IPCertMap,
 ) {
 	icm := make(IPCertMap)
+	for ip, cert := range known {
+		icm[ip] = cert
+	}
 	for x := range ipCertChan {
 		if _, ok := icm[x.IP]; ok {
 			errorLogger.Printf("Should never be here, we've seen an IP twice\n")
@@ -368,116 +471,126 @@ func counter(countChan <-chan string) {
 	}
 }
 
-type DataResult int
-
-const (
-	ValidIP DataResult = iota
-	InvalidIP
-	NS
-	SOA
-)
-
-func verifyIPs(trip Triplet, ipCertMap IPCertMap) {
+// dropUnchecked removes the responses in trip with an address that is
+// neither in ipCertMap nor matched by db, which an interrupt left unchecked,
+// and returns how many responses were kept and dropped
+func dropUnchecked(trip Triplet, ipCertMap IPCertMap, db *fingerprint.Database) (int, int) {
+	var kept, dropped int
 	for _, pair := range trip {
 		for _, single := range pair {
 			for _, eventPtr := range single {
-				for dom, ips := range eventPtr.Data {
-					var domResult DataResult
-					for _, ip := range ips {
-						if cert, ok := ipCertMap[ip]; ok {
-							err := cert.VerifyHostname(dom)
-							if err != nil {
-								domResult = InvalidIP
-							} else {
-								if dom == "facebook.com" || dom == "twitter.com" {
-									continue
-								}
-								domResult = ValidIP
-								infoLogger.Printf("Got valid IP for %s: %s\n", dom, ip)
-								break
-							}
-						} else {
-							if net.ParseIP(ip) != nil {
-								domResult = InvalidIP
-							} else if strings.Contains(ip, "SOA") {
-								domResult = SOA
-							} else {
-								domResult = NS
-								infoLogger.Printf("Got something: %s for %s\n", ip, dom)
-							}
+				for dom, responses := range eventPtr.Responses {
+					var checked []results.Response
+					for _, resp := range responses {
+						if allChecked(resp.Answers, ipCertMap, db) {
+							checked = append(checked, resp)
 						}
 					}
-					switch domResult {
-					case ValidIP:
-						eventPtr.ValidIP++
-					case InvalidIP:
-						eventPtr.InvalidIP++
-					case NS:
-						eventPtr.ValidNS++
-					case SOA:
-						eventPtr.SOA++
+					kept += len(checked)
+					dropped += len(responses) - len(checked)
+					if len(checked) == 0 {
+						delete(eventPtr.Responses, dom)
+					} else {
+						eventPtr.Responses[dom] = checked
 					}
 				}
-
 			}
 		}
 	}
 
+	return kept, dropped
 }
 
-type EventTable struct {
-	ValidIP   int
-	InvalidIP int
-	Timeout   int
-	NoAns     int
-	SOA       int
-	NS        int
-}
-
-func (et EventTable) Total() int {
-	var total int
+// allChecked returns true when every address in answers was checked or
+// matches a fingerprint
+func allChecked(answers []string, ipCertMap IPCertMap, db *fingerprint.Database) bool {
+	for _, answer := range answers {
+		ip := net.ParseIP(answer)
+		if ip == nil {
+			continue
+		}
+		if _, ok := ipCertMap[answer]; ok {
+			continue
+		}
+		if _, ok := db.Match(ip); !ok {
+			return false
+		}
+	}
 
-	total += et.ValidIP
-	total += et.InvalidIP
-	total += et.Timeout
-	total += et.NoAns
-	total += et.SOA
-	total += et.NS
+	return true
+}
 
-	return total
+// verifyIPs classifies every domain's answers in trip, IPs are matched
+// against db first, then an IP is valid if the certificate it served (in
+// ipCertMap) is valid for the domain. If none are valid they are compared to
+// control answers when consistent is not nil, then checked for blockpages when
+// checker is not nil.
+func verifyIPs(
+	ctx context.Context,
+	trip Triplet,
+	ipCertMap IPCertMap,
+	db *fingerprint.Database,
+	consistent *consistency.Checker,
+	checker *blockpage.Checker,
+) {
+	classifier := classify.Classifier{
+		Fingerprints: db,
+		Verify: func(dom string, ips []net.IP) bool {
+			if dom == "facebook.com" || dom == "twitter.com" {
+				return false
+			}
+			for _, ip := range ips {
+				cert := ipCertMap[ip.String()]
+				if cert == nil {
+					continue
+				}
+				if cert.VerifyHostname(dom) == nil {
+					infoLogger.Printf("Got valid IP for %s: %s\n", dom, ip)
+					return true
+				}
+			}
+			return false
+		},
+	}
+	if consistent != nil {
+		classifier.Consistent = consistent.Consistent
+	}
+	if checker != nil {
+		classifier.Blockpage = func(dom string, ips []net.IP) (bool, string) {
+			return checker.CheckAny(ctx, dom, ips)
+		}
+	}
+	for _, pair := range trip {
+		for _, single := range pair {
+			for _, eventPtr := range single {
+				for dom, responses := range eventPtr.Responses {
+					for _, resp := range responses {
+						result := classifier.Classify(classify.Response{
+							Domain:  dom,
+							Answers: resp.Answers,
+							RCode:   resp.RCode,
+						})
+						if result.Category == classify.Malformed {
+							infoLogger.Printf("Got something: %s for %s\n", result.Reason, dom)
+						}
+						eventPtr.Counts.Add(result.Category)
+					}
+				}
+			}
+		}
+	}
 }
 
+// EventTable is the classified responses summed over a Triplet
+type EventTable = classify.Counts
+
 func getTable(trip Triplet) (EventTable, EventTable) {
-	var (
-		v4EventTable EventTable
-		v6EventTable EventTable
-	)
+	v4EventTable := EventTable{}
+	v6EventTable := EventTable{}
 
 	for _, pair := range trip {
 		for _, single := range pair {
-			for vType, eventPtr := range single {
-				switch vType {
-				case "v4":
-					v4EventTable.ValidIP += eventPtr.ValidIP
-					v4EventTable.InvalidIP += eventPtr.InvalidIP
-					v4EventTable.Timeout += eventPtr.Timeout
-					v4EventTable.NoAns += eventPtr.NoAns
-					v4EventTable.NS += eventPtr.ValidNS
-					v4EventTable.SOA += eventPtr.SOA
-					// this should be zero atm, but for future use maybe
-					v4EventTable.NS += eventPtr.InvalidNS
-				case "v6":
-					v6EventTable.ValidIP += eventPtr.ValidIP
-					v6EventTable.InvalidIP += eventPtr.InvalidIP
-					v6EventTable.Timeout += eventPtr.Timeout
-					v6EventTable.NoAns += eventPtr.NoAns
-					v6EventTable.NS += eventPtr.ValidNS
-					v6EventTable.SOA += eventPtr.SOA
-					// this should be zero atm, but for future use maybe
-					v6EventTable.NS += eventPtr.InvalidNS
-				}
-
-			}
+			addSingle(v4EventTable, v6EventTable, single)
 		}
 	}
 
@@ -486,94 +599,65 @@ func getTable(trip Triplet) (EventTable, EventTable) {
 
 func printTable(v4Table, v6Table EventTable) {
 	fmt.Printf("\t\t| v4\t| v6\t| Total\n")
-	fmt.Printf("ValidIP\t\t| %d\t| %d\t| %d\n", v4Table.ValidIP, v6Table.ValidIP, v4Table.ValidIP+v6Table.ValidIP)
-	fmt.Printf("InvalidIP\t| %d\t| %d\t| %d\n", v4Table.InvalidIP, v6Table.InvalidIP, v4Table.InvalidIP+v6Table.InvalidIP)
-	fmt.Printf("Timeout\t\t| %d\t| %d\t| %d\n", v4Table.Timeout, v6Table.Timeout, v4Table.Timeout+v6Table.Timeout)
-	fmt.Printf("NoAns\t\t| %d\t| %d\t| %d\n", v4Table.NoAns, v6Table.NoAns, v4Table.NoAns+v6Table.NoAns)
-	fmt.Printf("SOA\t\t| %d\t| %d\t| %d\n", v4Table.SOA, v6Table.SOA, v4Table.SOA+v6Table.SOA)
-	fmt.Printf("NS\t\t| %d\t| %d\t| %d\n", v4Table.NS, v6Table.NS, v4Table.NS+v6Table.NS)
-	fmt.Printf("Total\t\t| %d\t| %d\t| %d\n", v4Table.Total(), v6Table.Total(), v4Table.Total()+v6Table.Total())
+	for _, c := range classify.Categories {
+		fmt.Printf(
+			"%-14s\t| %d\t| %d\t| %d\n",
+			c, v4Table[c], v6Table[c], v4Table[c]+v6Table[c],
+		)
+	}
+	fmt.Printf(
+		"%-14s\t| %d\t| %d\t| %d\n",
+		"Total",
+		v4Table.Total(),
+		v6Table.Total(),
+		v4Table.Total()+v6Table.Total(),
+	)
 }
 
+// printPTable prints each cell's contribution to the chi-squared statistic
+// (scaled down by 100) for whether the outcome depends on the record type
 func printPTable(v4Table, v6Table EventTable) {
 	v4Total := v4Table.Total()
 	v6Total := v6Table.Total()
 	denom := v4Total + v6Total
 	fmt.Printf("\t\t| v4\t\t| v6\t\t| Total\n")
-	validTotal := float64(v4Table.ValidIP + v6Table.ValidIP)
-	v4ValidExpected := float64(v4Total) * (validTotal / float64(denom))
-	v4ValidNum := float64(v4Table.ValidIP) - v4ValidExpected
-	v4ValidNum = v4ValidNum * v4ValidNum
-	v4Valid := v4ValidNum / v4ValidExpected
-	v4Valid = v4Valid / 100.0
-	v6ValidExpected := float64(v6Total) * (validTotal / float64(denom))
-	v6ValidNum := float64(v6Table.ValidIP) - v6ValidExpected
-	v6ValidNum = v6ValidNum * v6ValidNum
-	v6Valid := v6ValidNum / v6ValidExpected
-	v6Valid = v6Valid / 100.0
-	if math.IsNaN(v4Valid) {
-		v4Valid = 0.0
-	}
-	if math.IsNaN(v6Valid) {
-		v6Valid = 0.0
-	}
-	fmt.Printf("ValidIP\t\t| %f\t| %f\t| %f\n", v4Valid, v6Valid, v4Valid+v6Valid)
-	invalidTotal := float64(v4Table.InvalidIP + v6Table.InvalidIP)
-	v4InvalidExpected := float64(v4Total) * (invalidTotal / float64(denom))
-	v4InvalidNum := float64(v4Table.InvalidIP) - v4InvalidExpected
-	v4InvalidNum = v4InvalidNum * v4InvalidNum
-	v4Invalid := v4InvalidNum / v4InvalidExpected
-	v4Invalid = v4Invalid / 100.0
-	v6InvalidExpected := float64(v6Total) * (invalidTotal / float64(denom))
-	v6InvalidNum := float64(v6Table.InvalidIP) - v6InvalidExpected
-	v6InvalidNum = v6InvalidNum * v6InvalidNum
-	v6Invalid := v6InvalidNum / v6InvalidExpected
-	v6Invalid = v6Invalid / 100.0
-	fmt.Printf("InvalidIP\t| %f\t| %f\t| %f\n", v4Invalid, v6Invalid, v4Invalid+v6Invalid)
-	timeoutTotal := float64(v4Table.Timeout + v6Table.Timeout)
-	v4TimeoutExpected := float64(v4Total) * (timeoutTotal / float64(denom))
-	v4TimeoutNum := float64(v4Table.Timeout) - v4TimeoutExpected
-	v4TimeoutNum = v4TimeoutNum * v4TimeoutNum
-	v4Timeout := v4TimeoutNum / v4TimeoutExpected
-	v4Timeout = v4Timeout / 100.0
-	v6TimeoutExpected := float64(v6Total) * (timeoutTotal / float64(denom))
-	v6TimeoutNum := float64(v6Table.Timeout) - v6TimeoutExpected
-	v6TimeoutNum = v6TimeoutNum * v6TimeoutNum
-	v6Timeout := v6TimeoutNum / v6TimeoutExpected
-	v6Timeout = v6Timeout / 100.0
-	fmt.Printf("Timeout\t\t| %f\t| %f\t| %f\n", v4Timeout, v6Timeout, v4Timeout+v6Timeout)
-	noAnsTotal := float64(v4Table.NoAns + v6Table.NoAns)
-	v4NoAnsExpected := float64(v4Total) * (noAnsTotal / float64(denom))
-	v4NoAnsNum := float64(v4Table.NoAns) - v4NoAnsExpected
-	v4NoAnsNum = v4NoAnsNum * v4NoAnsNum
-	v4NoAns := v4NoAnsNum / v4NoAnsExpected
-	v4NoAns = v4NoAns / 100.0
-	v6NoAnsExpected := float64(v6Total) * (noAnsTotal / float64(denom))
-	v6NoAnsNum := float64(v6Table.NoAns) - v6NoAnsExpected
-	v6NoAnsNum = v6NoAnsNum * v6NoAnsNum
-	v6NoAns := v6NoAnsNum / v6NoAnsExpected
-	v6NoAns = v6NoAns / 100.0
-	fmt.Printf("NoAns\t\t| %f\t| %f\t| %f\n", v4NoAns, v6NoAns, v4NoAns+v6NoAns)
-	nsTotal := float64(v4Table.NS + v6Table.NS)
-	v4NSExpected := float64(v4Total) * (nsTotal / float64(denom))
-	v4NSNum := float64(v4Table.NS) - v4NSExpected
-	v4NSNum = v4NSNum * v4NSNum
-	v4NS := v4NSNum / v4NSExpected
-	v4NS = v4NS / 100.0
-	v6NSExpected := float64(v6Total) * (nsTotal / float64(denom))
-	v6NSNum := float64(v6Table.NS) - v6NSExpected
-	v6NSNum = v6NSNum * v6NSNum
-	v6NS := v6NSNum / v6NSExpected
-	v6NS = v6NS / 100.0
-	fmt.Printf("NS\t\t| %f\t| %f\t| %f\n", v4NS, v6NS, v4NS+v6NS)
-	v4TableTotal := v4Valid + v4Invalid + v4Timeout + v4NoAns + v4NS
-	v6TableTotal := v6Valid + v6Invalid + v6Timeout + v6NoAns + v6NS
+	var v4TableTotal, v6TableTotal float64
+	for _, c := range classify.Categories {
+		rowTotal := float64(v4Table[c] + v6Table[c])
+		v4Expected := float64(v4Total) * (rowTotal / float64(denom))
+		v4Num := float64(v4Table[c]) - v4Expected
+		v4Cell := (v4Num * v4Num) / v4Expected / 100.0
+		v6Expected := float64(v6Total) * (rowTotal / float64(denom))
+		v6Num := float64(v6Table[c]) - v6Expected
+		v6Cell := (v6Num * v6Num) / v6Expected / 100.0
+		if math.IsNaN(v4Cell) {
+			v4Cell = 0.0
+		}
+		if math.IsNaN(v6Cell) {
+			v6Cell = 0.0
+		}
+		fmt.Printf("%-14s\t| %f\t| %f\t| %f\n", c, v4Cell, v6Cell, v4Cell+v6Cell)
+		v4TableTotal += v4Cell
+		v6TableTotal += v6Cell
+	}
 	fmt.Printf("Total:\t\t| %f\t| %f\t| %f\n", v4TableTotal, v6TableTotal, v4TableTotal+v6TableTotal)
 }
 
 func main() {
 	resultsPath := flag.String("r", "", "Path to results file")
 	uncensoredDomains := flag.String("u", "", "comma separated list of domains that are uncensored")
+	fingerprintsPath := flag.String("fingerprints", "", "Path to a file of known injected addresses (<address or CIDR> <kind> <label> per line), bogons are always checked")
+	asnPath := flag.String("asn_db", "", "Path to a MaxMind ASN mmdb, used with -controls to compare answered IPs by ASN")
+	controlsPath := flag.String("controls", "", "Comma separated paths to ZDNS output (e.g. querylist's --v4_dns and --v6_dns files) or querylist's full details output to compare IPs without a valid certificate to by IP, /24 (/48) and, with -asn_db, ASN")
+	checkBlockpages := flag.Bool("blockpage", false, "Fetch HTTP/HTTPS pages from IPs without a valid certificate and check for blockpages")
+	blockpagePath := flag.String("blockpage_fingerprints", "", "Path to a JSON file of extra blockpage fingerprints, implies -blockpage")
+	reports := flag.String("report", "", "comma separated list of drill-down reports to print: resolvers, aaaa-only, timeouts, outliers, or all")
+	matrix := flag.Bool("matrix", false, "Print each table split by query transport (IPv4/IPv6 to the resolver) and record type (A/AAAA)")
+	jsonPath := flag.String("json", "", "Path to write the drill-down reports and matrices to (in JSON)")
+	cachePath := flag.String("cache", "", "Path to write the certificate each IP served to at the end (or when interrupted)")
+	resume := flag.Bool("resume", false, "Read the -cache of a previous (interrupted) run and skip the IPs it already checked")
+	timeoutRatio := flag.Float64("timeout_ratio", 0.9, "Fraction of a probe's responses that must be timeouts for the timeouts report")
+	numOutliers := flag.Int("outliers", 10, "Number of resolvers to list in the outliers report")
 	flag.Parse()
 	infoLogger = log.New(
 		os.Stderr,
@@ -594,12 +678,78 @@ func main() {
 		doms = []string{*uncensoredDomains}
 	}
 	infoLogger.Printf("Uncensored Domains: %v\n", doms)
+	db := fingerprint.Default()
+	if len(*fingerprintsPath) > 0 {
+		var err error
+		db, err = fingerprint.Load(*fingerprintsPath)
+		if err != nil {
+			errorLogger.Fatalf("Error loading fingerprints, %v\n", err)
+		}
+		infoLogger.Printf(
+			"Loaded %d fingerprints from %s\n",
+			len(db.Fingerprints()),
+			*fingerprintsPath,
+		)
+	}
+	var consistent *consistency.Checker
+	if len(*asnPath) > 0 && len(*controlsPath) == 0 {
+		errorLogger.Fatalf("-asn_db needs control answers from -controls\n")
+	}
+	if len(*controlsPath) > 0 {
+		var err error
+		consistent, err = consistency.Load(*asnPath, strings.Split(*controlsPath, ","))
+		if err != nil {
+			errorLogger.Fatalf("Error loading control answers, %v\n", err)
+		}
+		defer consistent.Close()
+		infoLogger.Printf("loaded control answers for %d domains\n", len(consistent.Controls))
+	}
+	var checker *blockpage.Checker
+	if *checkBlockpages || len(*blockpagePath) > 0 {
+		lib := blockpage.DefaultLibrary()
+		if len(*blockpagePath) > 0 {
+			var err error
+			lib, err = blockpage.LoadLibrary(*blockpagePath)
+			if err != nil {
+				errorLogger.Fatalf("Error loading blockpage fingerprints, %v\n", err)
+			}
+		}
+		checker = blockpage.NewChecker(lib)
+		checker.Logger = infoLogger
+	}
+	breakdownOpts, err := parseReports(*reports)
+	if err != nil {
+		errorLogger.Fatalf("Error parsing -report, %v\n", err)
+	}
+	breakdownOpts.TimeoutRatio = *timeoutRatio
+	breakdownOpts.NumOutliers = *numOutliers
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal kills the process as usual
+		stop()
+		infoLogger.Printf("Interrupted, stopping TLS lookups\n")
+	}()
+	if *resume && len(*cachePath) == 0 {
+		errorLogger.Fatalf("-resume needs the -cache from the previous run\n")
+	}
+	known := make(IPCertMap)
+	if *resume {
+		known = loadCertCache(*cachePath)
+		infoLogger.Printf(
+			"loaded %d checked IPs from %s\n", len(known), *cachePath,
+		)
+	}
+
 	var wg sync.WaitGroup
 	dataInChan := make(chan string)
 	ipCertChan := make(chan *IPandCert)
 	ipCertMapChan := make(chan IPCertMap)
-	go checkData(dataInChan, ipCertChan, &wg)
-	go collectIPResults(ipCertChan, ipCertMapChan)
+	go checkData(ctx, dataInChan, ipCertChan, &wg, db, known)
+	go collectIPResults(ipCertChan, ipCertMapChan, known)
 
 	fullProbeResults := getStruct(*resultsPath)
 	restTriplet, restOpenTriplet, uncensoredTriplet, uncensoredOpenTriplet :=
@@ -609,12 +759,57 @@ func main() {
 	wg.Wait()
 	close(ipCertChan)
 	ipCertMap := <-ipCertMapChan
-	infoLogger.Printf("got results for %d ips\n", len(ipCertMap))
+	var withCert int
+	for _, cert := range ipCertMap {
+		if cert != nil {
+			withCert++
+		}
+	}
+	infoLogger.Printf(
+		"got results for %d ips, %d served a certificate\n",
+		len(ipCertMap),
+		withCert,
+	)
+	if len(*cachePath) > 0 {
+		saveCertCache(ipCertMap, *cachePath)
+	}
+	trips := []Triplet{
+		restTriplet, restOpenTriplet, uncensoredTriplet, uncensoredOpenTriplet,
+	}
+	var report Report
+	if ctx.Err() != nil {
+		if len(*cachePath) > 0 {
+			infoLogger.Printf(
+				"Interrupted, checked IPs saved to %s, run again with "+
+					"-resume to finish\n",
+				*cachePath,
+			)
+		} else {
+			infoLogger.Printf(
+				"Interrupted, pass -cache to keep checked IPs between runs\n",
+			)
+		}
+		// only what was checked is classified, and no blockpages are
+		// fetched after the interrupt
+		var kept, dropped int
+		for _, trip := range trips {
+			k, d := dropUnchecked(trip, ipCertMap, db)
+			kept += k
+			dropped += d
+		}
+		infoLogger.Printf(
+			"Partial results cover the %d responses whose IPs were all "+
+				"checked, %d left out\n",
+			kept,
+			dropped,
+		)
+		report.Partial = true
+		checker = nil
+	}
 	infoLogger.Printf("Verifying ips/domains\n")
-	verifyIPs(restTriplet, ipCertMap)
-	verifyIPs(restOpenTriplet, ipCertMap)
-	verifyIPs(uncensoredTriplet, ipCertMap)
-	verifyIPs(uncensoredOpenTriplet, ipCertMap)
+	for _, trip := range trips {
+		verifyIPs(ctx, trip, ipCertMap, db, consistent, checker)
+	}
 	infoLogger.Printf("Generating event x (v4/v6) tables\n")
 	v4RestTable, v6RestTable := getTable(restTriplet)
 	v4RestOpenTable, v6RestOpenTable := getTable(restOpenTriplet)
@@ -628,6 +823,31 @@ func main() {
 	printTable(v4UncensoredTable, v6UncensoredTable)
 	infoLogger.Printf("%v, Open Resolver Table\n", doms)
 	printTable(v4UncensoredOpenTable, v6UncensoredOpenTable)
+	names := []string{
+		"'Censored' Domains, Domain Resolver",
+		"'Censored' Domains, Open Resolver",
+		fmt.Sprintf("%v, Domain Resolver", doms),
+		fmt.Sprintf("%v, Open Resolver", doms),
+	}
+	if *matrix {
+		for i, trip := range trips {
+			m := getMatrix(names[i], trip)
+			infoLogger.Printf("%s, Transport x Record Type Table\n", m.Name)
+			printMatrix(m)
+			report.Matrices = append(report.Matrices, m)
+		}
+	}
+	if breakdownOpts.Any() {
+		for i, trip := range trips {
+			b := getBreakdown(names[i], trip, breakdownOpts)
+			printBreakdown(b, breakdownOpts)
+			report.Breakdowns = append(report.Breakdowns, b)
+		}
+	}
+	if len(*jsonPath) > 0 {
+		infoLogger.Printf("Writing reports to %s\n", *jsonPath)
+		writeReport(report, *jsonPath)
+	}
 	// infoLogger.Printf("'Censored' Domains p-Table\n")
 	// printPTable(v4RestTable, v6RestTable)
 	// infoLogger.Printf("%v p-Table\n", )
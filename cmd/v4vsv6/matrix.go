@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	classify "github.com/timartiny/RipeProbe/classify"
+)
+
+// matrixKeys is the order the transport x record type cells are printed in
+var matrixKeys = []string{V4ToV4, V4ToV6, V6ToV4, V6ToV6}
+
+// Matrix keeps the query transport (IPv4 or IPv6 to the resolver) separate
+// from the record type requested (A or AAAA) so the effect of each can be
+// compared. The effects are the difference in rates, for each row, between
+// IPv6 and IPv4 transport (averaged over record types) and between AAAA and A
+// records (averaged over transports).
+type Matrix struct {
+	Name            string                        `json:"name"`
+	Cells           map[string]EventTable         `json:"cells"`
+	TransportEffect map[classify.Category]float64 `json:"transport_effect"`
+	RecordEffect    map[classify.Category]float64 `json:"record_effect"`
+}
+
+// getMatrix sums trip into one EventTable for each transport x record type
+func getMatrix(name string, trip Triplet) Matrix {
+	ret := Matrix{
+		Name:            name,
+		Cells:           make(map[string]EventTable),
+		TransportEffect: make(map[classify.Category]float64),
+		RecordEffect:    make(map[classify.Category]float64),
+	}
+	for _, key := range matrixKeys {
+		ret.Cells[key] = EventTable{}
+	}
+
+	for _, pair := range trip {
+		for _, single := range pair {
+			for key, eventPtr := range single {
+				ret.Cells[key].Merge(eventPtr.Counts)
+			}
+		}
+	}
+
+	for _, row := range classify.Categories {
+		v4A := ret.Cells[V4ToV4].Rate(row)
+		v4AAAA := ret.Cells[V4ToV6].Rate(row)
+		v6A := ret.Cells[V6ToV4].Rate(row)
+		v6AAAA := ret.Cells[V6ToV6].Rate(row)
+		ret.TransportEffect[row] = (v6A+v6AAAA)/2 - (v4A+v4AAAA)/2
+		ret.RecordEffect[row] = (v4AAAA+v6AAAA)/2 - (v4A+v6A)/2
+	}
+
+	return ret
+}
+
+func printMatrix(m Matrix) {
+	fmt.Printf("\t\t| v4->A\t\t| v4->AAAA\t| v6->A\t\t| v6->AAAA\t| Transport\t| Record\n")
+	for _, row := range classify.Categories {
+		fmt.Printf("%-14s\t", row)
+		for _, key := range matrixKeys {
+			et := m.Cells[key]
+			fmt.Printf("| %d (%.1f%%)\t", et[row], 100*et.Rate(row))
+		}
+		fmt.Printf(
+			"| %+.1f pp\t| %+.1f pp\n",
+			100*m.TransportEffect[row],
+			100*m.RecordEffect[row],
+		)
+	}
+	fmt.Printf("%-14s\t", "Total")
+	for _, key := range matrixKeys {
+		fmt.Printf("| %d\t\t", m.Cells[key].Total())
+	}
+	fmt.Printf("|\t\t|\n")
+}
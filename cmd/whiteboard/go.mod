@@ -2,9 +2,12 @@ module github.com/timartiny/RipeProbe/cmd/whiteboard
 
 replace github.com/timartiny/RipeProbe/RipeExperiment => ../../ripeexperiment
 
+replace github.com/timartiny/RipeProbe/results => ../../results
+
 go 1.16
 
 require (
 	github.com/keltia/ripe-atlas v0.0.0-20190416222805-da828cc7507d
 	github.com/timartiny/RipeProbe/RipeExperiment v0.0.0-00010101000000-000000000000
+	github.com/timartiny/RipeProbe/results v0.0.0-00010101000000-000000000000
 )
@@ -7,11 +7,11 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"strings"
 	"time"
 
 	atlas "github.com/keltia/ripe-atlas"
 	experiment "github.com/timartiny/RipeProbe/RipeExperiment"
+	results "github.com/timartiny/RipeProbe/results"
 )
 
 const MAX_MEASUREMENTS = 100
@@ -142,12 +142,26 @@ func getListofStrings(path string) []string {
 	return ret
 }
 
+// getResolverIPs reads the IPs from resolverlist's output, either its JSON
+// records or the older "<ip> <label>" lines
 func getResolverIPs(path string) []string {
 	var ret []string
-	fullLines := getListofStrings(path)
-	for _, line := range fullLines {
-		split := strings.Split(line, " ")
-		ret = append(ret, split[0])
+	if len(path) <= 0 {
+		errorLogger.Fatalf("Must provide path to resolver IPs, use -r")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		errorLogger.Fatalf("Error opening file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	resolvers, err := results.ReadResolvers(file)
+	if err != nil {
+		errorLogger.Fatalf("Error reading resolvers from %s, %v\n", path, err)
+	}
+	for _, r := range resolvers {
+		ret = append(ret, r.IP)
 	}
 
 	return ret
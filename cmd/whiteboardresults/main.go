@@ -39,8 +39,9 @@ func getBytesByID(id string) []byte {
 	return ret
 }
 
-func parseABuf(abuf string) (map[string][]string, int) {
+func parseABuf(abuf string) (map[string][]string, map[string]results.RCodeList, int) {
 	resMap := make(map[string][]string)
+	rcodeMap := make(map[string]results.RCodeList)
 	var numAs int
 	resBytes, err := base64.StdEncoding.DecodeString(abuf)
 	if err != nil {
@@ -52,7 +53,7 @@ func parseABuf(abuf string) (map[string][]string, int) {
 	if err != nil {
 		if fmt.Sprintf("%v", err) == "DNS packet too short" {
 			errorLogger.Printf("DNS Packet was too short\n")
-			return resMap, numAs
+			return resMap, rcodeMap, numAs
 		} else {
 			errorLogger.Fatalf("Failed to decode dns packet: %v\n", err)
 		}
@@ -93,7 +94,13 @@ func parseABuf(abuf string) (map[string][]string, int) {
 		errorLogger.Printf("Got no resonses?\n")
 		errorLogger.Println(abuf)
 	}
-	return resMap, numAs
+	rcode := strings.TrimSpace(dns.ResponseCode.String())
+	for name, answers := range resMap {
+		for range answers {
+			rcodeMap[name] = append(rcodeMap[name], rcode)
+		}
+	}
+	return resMap, rcodeMap, numAs
 }
 
 func writeDetails(data []results.ProbeResult, firstId, secondId string) {
@@ -145,10 +152,32 @@ func getMeasIDs(path string) []string {
 	return ret
 }
 
+// alignedRCodes returns the response codes of name's answers in qr, with ""
+// for the answers that didn't come with one (failed measurements)
+func alignedRCodes(qr results.QueryResult, name string) results.RCodeList {
+	ret := append(results.RCodeList(nil), qr.RCodes[name]...)
+	for len(ret) < len(qr.Queries[name]) {
+		ret = append(ret, "")
+	}
+
+	return ret
+}
+
 func addToQueryResult(qrs []results.QueryResult, newQR results.QueryResult) []results.QueryResult {
-	for _, qr := range qrs {
+	for i, qr := range qrs {
 		if qr.ResolverIP == newQR.ResolverIP {
+			if len(newQR.RCodes) > 0 && qr.RCodes == nil {
+				qrs[i].RCodes = make(map[string]results.RCodeList)
+			}
 			for newK, newV := range newQR.Queries {
+				if qrs[i].RCodes != nil {
+					// keep RCodes[newK][j] the response code of
+					// Queries[newK][j]
+					qrs[i].RCodes[newK] = append(
+						alignedRCodes(qrs[i], newK),
+						alignedRCodes(newQR, newK)...,
+					)
+				}
 				qr.Queries[newK] = append(qr.Queries[newK], newV...)
 			}
 			return qrs
@@ -187,7 +216,7 @@ func getFailedMeasurementData(id int) (string, string) {
 	return nAs, domain
 }
 
-func addToResult(currResult results.ProbeResult, newResults results.MeasurementResult, resolverMap map[string]string) results.ProbeResult {
+func addToResult(currResult results.ProbeResult, newResults results.MeasurementResult, resolverMap map[string]results.Resolver) results.ProbeResult {
 	if badProbes[newResults.PrbID] {
 		return currResult
 	}
@@ -205,7 +234,10 @@ func addToResult(currResult results.ProbeResult, newResults results.MeasurementR
 
 	var queryRes results.QueryResult
 	queryRes.ResolverIP = newResults.DestAddr
-	queryRes.ResolverType = resolverMap[newResults.DestAddr]
+	if resolver, ok := resolverMap[newResults.DestAddr]; ok {
+		queryRes.ResolverType = resolver.Label()
+		queryRes.Resolver = &resolver
+	}
 	if len(newResults.Error) > 0 {
 		numAs, domain := getFailedMeasurementData(newResults.MsmID)
 		queries := make(map[string][]string)
@@ -233,7 +265,7 @@ func addToResult(currResult results.ProbeResult, newResults results.MeasurementR
 		}
 
 	} else {
-		queries, numAs := parseABuf(newResults.Result.Abuf)
+		queries, rcodes, numAs := parseABuf(newResults.Result.Abuf)
 		if len(queries) == 0 {
 			errorLogger.Printf(
 				"Got no queries from Probe: %d on Measurement: %d\n",
@@ -255,6 +287,7 @@ func addToResult(currResult results.ProbeResult, newResults results.MeasurementR
 			}
 		}
 		queryRes.Queries = queries
+		queryRes.RCodes = rcodes
 		if newResults.AF == 4 && numAs == 1 {
 			currResult.V4ToV4 = addToQueryResult(currResult.V4ToV4, queryRes)
 		} else if newResults.AF == 4 && numAs == 4 {
@@ -271,7 +304,7 @@ func addToResult(currResult results.ProbeResult, newResults results.MeasurementR
 	return currResult
 }
 
-func updateResults(currResults IDtoResults, id string, resolverMap map[string]string) IDtoResults {
+func updateResults(currResults IDtoResults, id string, resolverMap map[string]results.Resolver) IDtoResults {
 	measBytes := getBytesByID(id)
 	var measResults []results.MeasurementResult
 	err := json.Unmarshal(measBytes, &measResults)
@@ -312,12 +345,26 @@ func getListofStrings(path string) []string {
 	return ret
 }
 
-func getResolvers(path string) map[string]string {
-	ret := make(map[string]string)
-	fullLines := getListofStrings(path)
-	for _, line := range fullLines {
-		split := strings.Split(line, " ")
-		ret[split[0]] = split[1]
+// getResolvers reads resolverlist's output, either its JSON records or the
+// older "<ip> <label>" lines, keyed by IP
+func getResolvers(path string) map[string]results.Resolver {
+	ret := make(map[string]results.Resolver)
+	if len(path) <= 0 {
+		errorLogger.Fatalf("Must provide path to resolver IPs, use -r")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		errorLogger.Fatalf("Error opening file: %s, %v\n", path, err)
+	}
+	defer file.Close()
+
+	resolvers, err := results.ReadResolvers(file)
+	if err != nil {
+		errorLogger.Fatalf("Error reading resolvers from %s, %v\n", path, err)
+	}
+	for _, r := range resolvers {
+		ret[r.IP] = r
 	}
 
 	return ret
@@ -0,0 +1,290 @@
+package consistency
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// ASN is the autonomous system an address is announced from
+type ASN struct {
+	Number uint   `json:"number"`
+	Org    string `json:"org"`
+}
+
+// ASNDB looks up the ASN of addresses in a MaxMind (GeoLite2) ASN database
+type ASNDB struct {
+	reader *geoip2.Reader
+}
+
+// OpenASNDB opens the ASN mmdb at path
+func OpenASNDB(path string) (*ASNDB, error) {
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASNDB{reader: reader}, nil
+}
+
+// Close closes the underlying database
+func (db *ASNDB) Close() error {
+	return db.reader.Close()
+}
+
+// Lookup returns the ASN of ip, false when the database doesn't have one
+func (db *ASNDB) Lookup(ip net.IP) (ASN, bool) {
+	record, err := db.reader.ASN(ip)
+	if err != nil || record.AutonomousSystemNumber == 0 {
+		return ASN{}, false
+	}
+
+	return ASN{
+		Number: record.AutonomousSystemNumber,
+		Org:    record.AutonomousSystemOrganization,
+	}, true
+}
+
+// Controls are the addresses each domain resolved to from an uncensored
+// vantage point, keyed by domain.
+type Controls map[string][]net.IP
+
+// Add records ips as control answers for domain
+func (cs Controls) Add(domain string, ips ...net.IP) {
+	domain = normalize(domain)
+	for _, ip := range ips {
+		found := false
+		for _, have := range cs[domain] {
+			if have.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			cs[domain] = append(cs[domain], ip)
+		}
+	}
+}
+
+// Get returns the control answers for domain
+func (cs Controls) Get(domain string) []net.IP {
+	return cs[normalize(domain)]
+}
+
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// Comparison is how a set of answers for a domain lines up with the control
+// answers for the same domain.
+type Comparison struct {
+	// NoControl is set when there are no control answers for the domain
+	NoControl  bool `json:"no_control,omitempty"`
+	IPOverlap  bool `json:"ip_overlap"`
+	ASNOverlap bool `json:"asn_overlap"`
+	OrgOverlap bool `json:"org_overlap"`
+	// PrefixOverlap is set when an answer shares a /24 (IPv4) or /48 (IPv6)
+	// with a control answer
+	PrefixOverlap bool `json:"prefix_overlap"`
+	// ASNs are the ASNs of the answers that could be looked up
+	ASNs []ASN `json:"asns,omitempty"`
+}
+
+// Consistent returns true when the answers share an address, a prefix, an ASN
+// or an organization with the control answers.
+func (c Comparison) Consistent() bool {
+	return c.IPOverlap || c.PrefixOverlap || c.ASNOverlap || c.OrgOverlap
+}
+
+// prefix returns the /24 of an IPv4 address or the /48 of an IPv6 address
+func prefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(48, 128)
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Checker compares answered addresses to control answers. An address that
+// isn't one of the controls can still be consistent if it is in the same /24
+// (/48 for IPv6) or announced by the same AS, or an AS of the same
+// organization, as one of them, which is how CDNs hand out different addresses
+// to different vantage points. ASNs are only compared when ASNs is not nil.
+type Checker struct {
+	ASNs     *ASNDB
+	Controls Controls
+}
+
+// NewChecker returns a Checker looking up ASNs in db with no controls yet
+func NewChecker(db *ASNDB) *Checker {
+	return &Checker{ASNs: db, Controls: make(Controls)}
+}
+
+// Close closes the ASN database, if there is one
+func (c *Checker) Close() error {
+	if c.ASNs == nil {
+		return nil
+	}
+
+	return c.ASNs.Close()
+}
+
+// lookupAll returns each distinct ASN of the addresses in ips
+func (c *Checker) lookupAll(ips []net.IP) []ASN {
+	var ret []ASN
+	if c.ASNs == nil {
+		return ret
+	}
+	seen := make(map[uint]bool)
+	for _, ip := range ips {
+		if asn, ok := c.ASNs.Lookup(ip); ok && !seen[asn.Number] {
+			seen[asn.Number] = true
+			ret = append(ret, asn)
+		}
+	}
+
+	return ret
+}
+
+// Compare lines ips up against the control answers for domain
+func (c *Checker) Compare(domain string, ips []net.IP) Comparison {
+	var ret Comparison
+	controls := c.Controls.Get(domain)
+	ret.ASNs = c.lookupAll(ips)
+	if len(controls) == 0 {
+		ret.NoControl = true
+		return ret
+	}
+
+	for _, ip := range ips {
+		for _, control := range controls {
+			if ip.Equal(control) {
+				ret.IPOverlap = true
+			}
+			if prefix(control).Contains(ip) {
+				ret.PrefixOverlap = true
+			}
+		}
+	}
+
+	controlASNs := c.lookupAll(controls)
+	for _, asn := range ret.ASNs {
+		for _, control := range controlASNs {
+			if asn.Number == control.Number {
+				ret.ASNOverlap = true
+			}
+			if len(asn.Org) > 0 && strings.EqualFold(asn.Org, control.Org) {
+				ret.OrgOverlap = true
+			}
+		}
+	}
+
+	return ret
+}
+
+// Consistent compares ips to the control answers for domain and gives a
+// reason either way. It fits classify.Classifier's Consistent field.
+func (c *Checker) Consistent(domain string, ips []net.IP) (bool, string) {
+	comp := c.Compare(domain, ips)
+	switch {
+	case comp.NoControl:
+		return false, fmt.Sprintf("no control answers for %s", domain)
+	case comp.IPOverlap:
+		return true, "an address matches the control answers"
+	case comp.PrefixOverlap:
+		return true, "an address is in the same prefix as the control answers"
+	case comp.ASNOverlap:
+		return true, fmt.Sprintf("same ASN as the control answers, %s", asnList(comp.ASNs))
+	case comp.OrgOverlap:
+		return true, fmt.Sprintf("same organization as the control answers, %s", asnList(comp.ASNs))
+	}
+
+	if c.ASNs == nil {
+		return false, "addresses and prefixes differ from the control answers"
+	}
+
+	return false, fmt.Sprintf(
+		"ASN(s) differ from the control answers, %s", asnList(comp.ASNs),
+	)
+}
+
+func asnList(asns []ASN) string {
+	if len(asns) == 0 {
+		return "no ASN found"
+	}
+	var strs []string
+	for _, asn := range asns {
+		strs = append(strs, fmt.Sprintf("AS%d (%s)", asn.Number, asn.Org))
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// Load opens the ASN database at asnPath, if given, and reads control answers
+// from each of the ZDNS output files in zdnsPaths. The Checker has to be
+// closed when it's no longer needed.
+func Load(asnPath string, zdnsPaths []string) (*Checker, error) {
+	var db *ASNDB
+	if len(asnPath) > 0 {
+		var err error
+		if db, err = OpenASNDB(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	c := NewChecker(db)
+	for _, path := range zdnsPaths {
+		if err := c.Controls.LoadZDNS(path); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return c, nil
+}
+
+// Tally counts how the Comparisons of many responses went. A Comparison can
+// overlap in more than one way so the overlaps can add up to more than
+// Compared.
+type Tally struct {
+	Compared      int `json:"compared"`
+	IPOverlap     int `json:"ip_overlap"`
+	PrefixOverlap int `json:"prefix_overlap"`
+	ASNOverlap    int `json:"asn_overlap"`
+	Consistent    int `json:"consistent"`
+	NoControl     int `json:"no_control"`
+}
+
+// Add counts comp in t
+func (t *Tally) Add(comp Comparison) {
+	if comp.NoControl {
+		t.NoControl++
+		return
+	}
+	t.Compared++
+	if comp.IPOverlap {
+		t.IPOverlap++
+	}
+	if comp.PrefixOverlap {
+		t.PrefixOverlap++
+	}
+	if comp.ASNOverlap || comp.OrgOverlap {
+		t.ASNOverlap++
+	}
+	if comp.Consistent() {
+		t.Consistent++
+	}
+}
+
+// Merge adds all of other's counts to t
+func (t *Tally) Merge(other Tally) {
+	t.Compared += other.Compared
+	t.IPOverlap += other.IPOverlap
+	t.PrefixOverlap += other.PrefixOverlap
+	t.ASNOverlap += other.ASNOverlap
+	t.Consistent += other.Consistent
+	t.NoControl += other.NoControl
+}
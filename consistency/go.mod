@@ -0,0 +1,5 @@
+module github.com/timartiny/RipeProbe/consistency
+
+go 1.16
+
+require github.com/oschwald/geoip2-golang v1.5.0
@@ -0,0 +1,92 @@
+package consistency
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// zdnsResult is the part of a line of ZDNS output that holds the answers
+type zdnsResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Data   struct {
+		Answers []struct {
+			Type   string `json:"type"`
+			Answer string `json:"answer"`
+		} `json:"answers"`
+	} `json:"data"`
+}
+
+// detailsLookup is a lookup in a line of querylist's full details output
+type detailsLookup struct {
+	Addresses []struct {
+		Answer string `json:"answer"`
+	} `json:"addresses"`
+}
+
+// details is the part of a line of querylist's full details output that holds
+// the answers
+type details struct {
+	Domain string        `json:"domain"`
+	V4DNS  detailsLookup `json:"v4_dns"`
+	V6DNS  detailsLookup `json:"v6_dns"`
+}
+
+// LoadZDNS adds the A and AAAA answers in a ZDNS output file (one JSON object
+// per line, as used by querylist) to cs. querylist's full details output works
+// too, its lines are told apart by having a domain instead of a name. A line
+// that isn't JSON is an error, so a truncated or wrong file isn't taken for
+// one with fewer controls.
+func (cs Controls) LoadZDNS(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var d details
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if len(d.Domain) > 0 {
+			for _, lookup := range []detailsLookup{d.V4DNS, d.V6DNS} {
+				for _, address := range lookup.Addresses {
+					if ip := net.ParseIP(address.Answer); ip != nil {
+						cs.Add(d.Domain, ip)
+					}
+				}
+			}
+			continue
+		}
+
+		var result zdnsResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if result.Status != "" && result.Status != "NOERROR" {
+			continue
+		}
+		for _, answer := range result.Data.Answers {
+			if answer.Type != "A" && answer.Type != "AAAA" {
+				continue
+			}
+			if ip := net.ParseIP(answer.Answer); ip != nil {
+				cs.Add(result.Name, ip)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,60 @@
+package consistency
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeControls(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "controls.json")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("writing controls: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadZDNS(t *testing.T) {
+	path := writeControls(t,
+		`{"name":"example.com","status":"NOERROR","data":{"answers":[{"type":"CNAME","answer":"cdn.example.net"},{"type":"A","answer":"192.0.2.1"}]}}`,
+		`{"name":"example.org","status":"NXDOMAIN","data":{}}`,
+		``,
+		`{"domain":"example.net","v4_dns":{"addresses":[{"answer":"198.51.100.1"}]},"v6_dns":{"addresses":[{"answer":"2001:db8::1"}]}}`,
+	)
+	cs := make(Controls)
+	if err := cs.LoadZDNS(path); err != nil {
+		t.Fatalf("LoadZDNS: %v", err)
+	}
+	if got := cs.Get("example.com"); len(got) != 1 || got[0].String() != "192.0.2.1" {
+		t.Errorf("example.com controls %v, want 192.0.2.1", got)
+	}
+	if got := cs.Get("example.org"); len(got) != 0 {
+		t.Errorf("example.org controls %v from an NXDOMAIN", got)
+	}
+	if got := cs.Get("example.net"); len(got) != 2 {
+		t.Errorf("example.net controls %v, want both addresses", got)
+	}
+}
+
+func TestLoadZDNSMalformed(t *testing.T) {
+	path := writeControls(t,
+		`{"name":"example.com","status":"NOERROR","data":{"answers":[{"type":"A","answer":"192.0.2.1"}]}}`,
+		`{"name":"example.org","status":`,
+	)
+	err := make(Controls).LoadZDNS(path)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadZDNS = %v, want an error on line 2", err)
+	}
+
+	if _, err = Load("", []string{path}); err == nil {
+		t.Errorf("Load of a malformed controls file succeeded")
+	}
+}
+
+func TestCloseWithoutASNDB(t *testing.T) {
+	if err := NewChecker(nil).Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package fingerprint
+
+import (
+	"net"
+)
+
+// builtins are the special purpose ranges (RFC 6890 and friends) that should
+// never be handed out as the address of a public website.
+var builtins []Fingerprint
+
+func init() {
+	for _, b := range []struct {
+		cidr  string
+		kind  Kind
+		label string
+	}{
+		{"0.0.0.0/8", Bogon, "this network"},
+		{"10.0.0.0/8", Private, "private"},
+		{"100.64.0.0/10", Private, "shared address space"},
+		{"127.0.0.0/8", Bogon, "loopback"},
+		{"169.254.0.0/16", Bogon, "link local"},
+		{"172.16.0.0/12", Private, "private"},
+		{"192.0.0.0/24", Reserved, "IETF protocol assignments"},
+		{"192.0.2.0/24", Reserved, "documentation"},
+		{"192.168.0.0/16", Private, "private"},
+		{"198.18.0.0/15", Reserved, "benchmarking"},
+		{"198.51.100.0/24", Reserved, "documentation"},
+		{"203.0.113.0/24", Reserved, "documentation"},
+		{"224.0.0.0/4", Bogon, "multicast"},
+		{"240.0.0.0/4", Reserved, "reserved"},
+		{"::/128", Bogon, "unspecified"},
+		{"::1/128", Bogon, "loopback"},
+		{"100::/64", Reserved, "discard only"},
+		{"2001:db8::/32", Reserved, "documentation"},
+		{"fc00::/7", Private, "unique local"},
+		{"fe80::/10", Bogon, "link local"},
+		{"ff00::/8", Bogon, "multicast"},
+	} {
+		_, network, err := net.ParseCIDR(b.cidr)
+		if err != nil {
+			panic(err)
+		}
+		builtins = append(builtins, Fingerprint{
+			Network: network,
+			Kind:    b.kind,
+			Label:   b.label,
+			Builtin: true,
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package fingerprint
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Kind says what sort of address a Fingerprint matches
+type Kind string
+
+const (
+	// Bogon addresses are special purpose and never routed on the internet
+	Bogon Kind = "bogon"
+	// Private addresses are RFC 1918 (and the IPv6 equivalent) space
+	Private Kind = "private"
+	// Reserved addresses are set aside for documentation, benchmarking, etc.
+	Reserved Kind = "reserved"
+	// Forged addresses are from pools an injector picks fake answers from
+	Forged Kind = "forged"
+	// Sinkhole addresses are where a country sends every blocked domain
+	Sinkhole Kind = "sinkhole"
+)
+
+// IsBogon returns true for the kinds that can never be a real answer
+// (Bogon, Private, and Reserved) as opposed to those left by an injector.
+func (k Kind) IsBogon() bool {
+	return k == Bogon || k == Private || k == Reserved
+}
+
+// Kinds is every Kind a Fingerprint can have
+var Kinds = []Kind{Bogon, Private, Reserved, Forged, Sinkhole}
+
+// Valid returns true for the Kinds above
+func (k Kind) Valid() bool {
+	for _, kind := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fingerprint is a network known to be handed out in place of real answers.
+// Builtin fingerprints come from Default and are never written by Save.
+type Fingerprint struct {
+	Network *net.IPNet
+	Kind    Kind
+	Label   string
+	Builtin bool
+}
+
+func (fp Fingerprint) String() string {
+	return fmt.Sprintf("%s %s %s", fp.Network, fp.Kind, fp.Label)
+}
+
+// Database is a list of Fingerprints to match answered addresses against
+type Database struct {
+	fingerprints []Fingerprint
+}
+
+// New returns an empty Database
+func New() *Database {
+	return new(Database)
+}
+
+// Default returns a Database with only the builtin special purpose ranges
+func Default() *Database {
+	db := New()
+	db.fingerprints = append(db.fingerprints, builtins...)
+
+	return db
+}
+
+// parseNetwork accepts either a CIDR or a single address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an address or CIDR: %s", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Add parses and adds a fingerprint to db
+func (db *Database) Add(network string, kind Kind, label string) error {
+	if !kind.Valid() {
+		return fmt.Errorf("unknown kind %q, expected one of %v", kind, Kinds)
+	}
+	n, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+	db.fingerprints = append(
+		db.fingerprints, Fingerprint{Network: n, Kind: kind, Label: label},
+	)
+
+	return nil
+}
+
+// Merge adds all of other's fingerprints to db
+func (db *Database) Merge(other *Database) {
+	db.fingerprints = append(db.fingerprints, other.fingerprints...)
+}
+
+// Fingerprints returns every fingerprint in db
+func (db *Database) Fingerprints() []Fingerprint {
+	return db.fingerprints
+}
+
+// Match returns the most specific Fingerprint that contains ip
+func (db *Database) Match(ip net.IP) (Fingerprint, bool) {
+	var ret Fingerprint
+	found := false
+	bestOnes := -1
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, fp := range db.fingerprints {
+		if !fp.Network.Contains(ip) {
+			continue
+		}
+		ones, _ := fp.Network.Mask.Size()
+		if ones > bestOnes {
+			ret = fp
+			bestOnes = ones
+			found = true
+		}
+	}
+
+	return ret, found
+}
+
+// Parse reads fingerprints, one per line, in
+// <address or CIDR> <kind> [label]
+// form, kind being one of Kinds. Blank lines and lines starting with # are skipped.
+func Parse(r io.Reader) (*Database, error) {
+	db := New()
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected <network> <kind> [label]", lineNum)
+		}
+		label := strings.Join(fields[2:], " ")
+		err := db.Add(fields[0], Kind(fields[1]), label)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+
+	return db, scanner.Err()
+}
+
+// Load returns the Default database with the fingerprints in path added
+func Load(path string) (*Database, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fromFile, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	db := Default()
+	db.Merge(fromFile)
+
+	return db, nil
+}
+
+// Save writes all the non builtin fingerprints in db to path in the form
+// Parse reads.
+func (db *Database) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, fp := range db.fingerprints {
+		if fp.Builtin {
+			continue
+		}
+		_, err = file.WriteString(fp.String() + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
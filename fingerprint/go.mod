@@ -0,0 +1,3 @@
+module github.com/timartiny/RipeProbe/fingerprint
+
+go 1.16
@@ -0,0 +1,8 @@
+module github.com/timartiny/RipeProbe/normalize
+
+go 1.16
+
+require (
+	golang.org/x/net v0.0.0-20190912160710-24e19bdeb0f2
+	golang.org/x/text v0.3.2 // indirect
+)
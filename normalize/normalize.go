@@ -0,0 +1,74 @@
+package normalize
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Options change how far a domain is normalized
+type Options struct {
+	// Registrable reduces the domain to the part that can be registered
+	// (eTLD+1, e.g. news.bbc.co.uk to bbc.co.uk) using the public suffix list
+	Registrable bool
+}
+
+// Domain returns the host in raw, which may be a bare domain or a full URL,
+// lowercased, without a scheme, "www." label, port, path, query string or
+// trailing dot, and with any IDN converted to punycode.
+func Domain(raw string, opts Options) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", fmt.Errorf("empty domain")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if len(host) == 0 {
+		return "", fmt.Errorf("no host in %s", raw)
+	}
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	host = strings.TrimPrefix(host, "www.")
+	host, err = idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", err
+	}
+	if opts.Registrable {
+		registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+		if err == nil {
+			host = registrable
+		}
+	}
+
+	return host, nil
+}
+
+// Stats count how many entries of a list could be normalized and how many of
+// those matched.
+type Stats struct {
+	Entries int
+	Failed  int
+	Matched int
+}
+
+// MatchRate is the fraction of normalized entries that matched
+func (s Stats) MatchRate() float64 {
+	normalized := s.Entries - s.Failed
+	if normalized == 0 {
+		return 0.0
+	}
+
+	return float64(s.Matched) / float64(normalized)
+}
@@ -0,0 +1,5 @@
+module github.com/timartiny/RipeProbe/resolve
+
+go 1.16
+
+require golang.org/x/net v0.0.0-20190912160710-24e19bdeb0f2
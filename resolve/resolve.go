@@ -0,0 +1,440 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNoAnswer is returned when none of the servers gave an answer
+var ErrNoAnswer = errors.New("no server gave an answer")
+
+// Answer is the result of resolving a domain starting from a set of name
+// servers: the addresses, the CNAMEs followed on the way and which server
+// finally answered.
+type Answer struct {
+	Domain string   `json:"domain"`
+	IPs    []net.IP `json:"ips"`
+	CNAMEs []string `json:"cnames,omitempty"`
+	// NS is the name of the server that answered (as given in the referral)
+	NS string `json:"ns"`
+	// Server is the address that was queried
+	Server string `json:"server"`
+}
+
+// Resolver resolves domains iteratively from a given set of name servers,
+// without recursion. Port (53 by default) is used for every server, so a
+// Resolver can be pointed at local stub servers.
+type Resolver struct {
+	Port    string
+	Timeout time.Duration
+	// MaxDepth is how many referrals and CNAMEs are followed, 10 when 0
+	MaxDepth int
+	// LookupHost resolves name server names that came without glue, the
+	// system resolver is used when nil
+	LookupHost func(ctx context.Context, host string) ([]net.IP, error)
+	// Roots are the name servers (names or addresses) a CNAME target the
+	// answering server can't resolve is resolved from, the root servers when
+	// empty
+	Roots []string
+}
+
+// rootServers are the IPv4 addresses of the root name servers, from IANA's
+// root hints
+var rootServers = []server{
+	{name: "a.root-servers.net.", addrs: []net.IP{net.ParseIP("198.41.0.4")}},
+	{name: "b.root-servers.net.", addrs: []net.IP{net.ParseIP("170.247.170.2")}},
+	{name: "c.root-servers.net.", addrs: []net.IP{net.ParseIP("192.33.4.12")}},
+	{name: "d.root-servers.net.", addrs: []net.IP{net.ParseIP("199.7.91.13")}},
+	{name: "e.root-servers.net.", addrs: []net.IP{net.ParseIP("192.203.230.10")}},
+	{name: "f.root-servers.net.", addrs: []net.IP{net.ParseIP("192.5.5.241")}},
+	{name: "g.root-servers.net.", addrs: []net.IP{net.ParseIP("192.112.36.4")}},
+	{name: "h.root-servers.net.", addrs: []net.IP{net.ParseIP("198.97.190.53")}},
+	{name: "i.root-servers.net.", addrs: []net.IP{net.ParseIP("192.36.148.17")}},
+	{name: "j.root-servers.net.", addrs: []net.IP{net.ParseIP("192.58.128.30")}},
+	{name: "k.root-servers.net.", addrs: []net.IP{net.ParseIP("193.0.14.129")}},
+	{name: "l.root-servers.net.", addrs: []net.IP{net.ParseIP("199.7.83.42")}},
+	{name: "m.root-servers.net.", addrs: []net.IP{net.ParseIP("202.12.27.33")}},
+}
+
+// New returns a Resolver using port 53 and a 2 second timeout
+func New() *Resolver {
+	return &Resolver{Port: "53", Timeout: 2 * time.Second}
+}
+
+func (r *Resolver) port() string {
+	if len(r.Port) == 0 {
+		return "53"
+	}
+
+	return r.Port
+}
+
+func (r *Resolver) roots() []server {
+	if len(r.Roots) == 0 {
+		return rootServers
+	}
+	var ret []server
+	for _, ns := range r.Roots {
+		ret = append(ret, server{name: ns})
+	}
+
+	return ret
+}
+
+func (r *Resolver) maxDepth() int {
+	if r.MaxDepth <= 0 {
+		return 10
+	}
+
+	return r.MaxDepth
+}
+
+// lookupHost returns the addresses of a name server, IP literals are used as
+// is.
+func (r *Resolver) lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r.LookupHost != nil {
+		return r.LookupHost(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	for _, addr := range addrs {
+		ret = append(ret, addr.IP)
+	}
+
+	return ret, nil
+}
+
+// fqdn lowercases name and adds the trailing dot
+func fqdn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
+
+// Query sends a single non-recursive question to server (an IP) over UDP,
+// retrying over TCP if the answer was truncated.
+func (r *Resolver) Query(
+	ctx context.Context, server net.IP, name string, qtype dnsmessage.Type,
+) (*dnsmessage.Message, error) {
+	return r.query(ctx, server, name, qtype, false)
+}
+
+// QueryRecursive is Query with recursion desired, for asking a recursive
+// resolver instead of a name server
+func (r *Resolver) QueryRecursive(
+	ctx context.Context, server net.IP, name string, qtype dnsmessage.Type,
+) (*dnsmessage.Message, error) {
+	return r.query(ctx, server, name, qtype, true)
+}
+
+// query sends the question to server, with the RD bit set when recurse is
+func (r *Resolver) query(
+	ctx context.Context,
+	server net.IP,
+	name string,
+	qtype dnsmessage.Type,
+	recurse bool,
+) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Intn(1 << 16)),
+			RecursionDesired: recurse,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(server.String(), r.port())
+	resp, err := r.exchange(ctx, "udp", addr, b)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		if resp, err = r.exchange(ctx, "tcp", addr, b); err != nil {
+			return nil, err
+		}
+	}
+	if resp.ID != query.ID {
+		return nil, fmt.Errorf("%s answered with ID %d, asked %d", addr, resp.ID, query.ID)
+	}
+
+	return resp, nil
+}
+
+// exchange writes the packed query b to addr and reads back the response
+func (r *Resolver) exchange(
+	ctx context.Context, network, addr string, b []byte,
+) (*dnsmessage.Message, error) {
+	dialer := &net.Dialer{Timeout: r.Timeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// the earlier of the timeout and the context's deadline, either can be
+	// missing
+	var deadline time.Time
+	if r.Timeout > 0 {
+		deadline = time.Now().Add(r.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var buf []byte
+	if network == "tcp" {
+		msg := make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(msg, uint16(len(b)))
+		copy(msg[2:], b)
+		if _, err = conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(b); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	resp := new(dnsmessage.Message)
+	if err = resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// server is a name server to ask and the addresses it is known by
+type server struct {
+	name  string
+	addrs []net.IP
+}
+
+// referral returns the name servers in the authority section of resp, with
+// any glue addresses from the additional section.
+func referral(resp *dnsmessage.Message) []server {
+	var ret []server
+	for _, rr := range resp.Authorities {
+		ns, ok := rr.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		s := server{name: ns.NS.String()}
+		for _, extra := range resp.Additionals {
+			if !strings.EqualFold(extra.Header.Name.String(), s.name) {
+				continue
+			}
+			switch body := extra.Body.(type) {
+			case *dnsmessage.AResource:
+				s.addrs = append(s.addrs, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				s.addrs = append(s.addrs, net.IP(body.AAAA[:]))
+			}
+		}
+		ret = append(ret, s)
+	}
+
+	return ret
+}
+
+// ResolveFrom resolves domain (A and AAAA) by asking each of nss (names or
+// addresses) in turn, following referrals and CNAMEs, until one of them
+// answers.
+func (r *Resolver) ResolveFrom(
+	ctx context.Context, nss []string, domain string,
+) (*Answer, error) {
+	var servers []server
+	for _, ns := range nss {
+		servers = append(servers, server{name: ns})
+	}
+	ans := &Answer{Domain: domain}
+
+	return ans, r.resolve(ctx, servers, fqdn(domain), ans, 0)
+}
+
+// resolve asks each of servers for name and fills in ans
+func (r *Resolver) resolve(
+	ctx context.Context, servers []server, name string, ans *Answer, depth int,
+) error {
+	if depth > r.maxDepth() {
+		return fmt.Errorf("gave up on %s after %d referrals/CNAMEs", name, depth)
+	}
+	lastErr := ErrNoAnswer
+	for _, s := range servers {
+		addrs := s.addrs
+		if len(addrs) == 0 {
+			var err error
+			if addrs, err = r.lookupHost(ctx, strings.TrimSuffix(s.name, ".")); err != nil {
+				lastErr = fmt.Errorf("resolving %s: %v", s.name, err)
+				continue
+			}
+		}
+		for _, addr := range addrs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err := r.ask(ctx, s.name, addr, name, ans, depth)
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// chain follows the CNAMEs in cnames (owner to target, all fqdn and
+// lowercased) from name, it returns every target on the way and the name the
+// chain ends at
+func chain(cnames map[string]string, name string) ([]string, string) {
+	var hops []string
+	seen := map[string]bool{name: true}
+	for {
+		target, ok := cnames[name]
+		if !ok || seen[target] {
+			return hops, name
+		}
+		seen[target] = true
+		hops = append(hops, strings.TrimSuffix(target, "."))
+		name = target
+	}
+}
+
+// ask queries one server for the A and AAAA records of name. A nil error
+// means ans is complete (possibly through a referral or CNAME), ans is only
+// changed then, so a failed attempt leaves nothing behind for the next
+// server.
+func (r *Resolver) ask(
+	ctx context.Context,
+	nsName string,
+	addr net.IP,
+	name string,
+	ans *Answer,
+	depth int,
+) error {
+	addrs := make(map[string][]net.IP)
+	cnames := make(map[string]string)
+	var next []server
+	answered := false
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		resp, err := r.Query(ctx, addr, name, qtype)
+		if err != nil {
+			return fmt.Errorf("%s (%s): %v", nsName, addr, err)
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			return fmt.Errorf("%s (%s) answered %v", nsName, addr, resp.RCode)
+		}
+		for _, rr := range resp.Answers {
+			owner := strings.ToLower(rr.Header.Name.String())
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs[owner] = append(addrs[owner], net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				addrs[owner] = append(addrs[owner], net.IP(body.AAAA[:]))
+			case *dnsmessage.CNAMEResource:
+				cnames[owner] = strings.ToLower(body.CNAME.String())
+			}
+		}
+		if resp.Authoritative || len(resp.Answers) > 0 {
+			answered = true
+		} else if len(next) == 0 {
+			next = referral(resp)
+		}
+	}
+	// a response can hold a whole chain of CNAMEs, only the addresses of
+	// the name it ends at are the answer
+	hops, end := chain(cnames, strings.ToLower(name))
+	ips := addrs[end]
+
+	switch {
+	case len(ips) > 0:
+		ans.IPs = append(ans.IPs, ips...)
+		ans.CNAMEs = append(ans.CNAMEs, hops...)
+		ans.NS = strings.TrimSuffix(nsName, ".")
+		ans.Server = addr.String()
+		return nil
+	case len(hops) > 0:
+		// the target may be out of this server's zone, try it first and
+		// then resolve the target iteratively from the roots. The rest of
+		// the chain is built in target and only added to ans once the
+		// target resolved.
+		target := &Answer{Domain: ans.Domain}
+		err := r.resolve(
+			ctx, []server{{name: nsName, addrs: []net.IP{addr}}}, end, target,
+			depth+1,
+		)
+		if err != nil {
+			target = &Answer{Domain: ans.Domain}
+			if err = r.resolve(ctx, r.roots(), end, target, depth+1); err != nil {
+				return fmt.Errorf("following CNAME %s: %v", end, err)
+			}
+		}
+		ans.CNAMEs = append(ans.CNAMEs, hops...)
+		ans.CNAMEs = append(ans.CNAMEs, target.CNAMEs...)
+		ans.IPs = append(ans.IPs, target.IPs...)
+		ans.NS = target.NS
+		ans.Server = target.Server
+		return nil
+	case answered:
+		return fmt.Errorf("%s (%s) has no addresses for %s", nsName, addr, name)
+	case len(next) > 0:
+		return r.resolve(ctx, next, name, ans, depth+1)
+	}
+
+	return fmt.Errorf("%s (%s) gave no answer or referral", nsName, addr)
+}
@@ -0,0 +1,401 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// handler answers one question, tcp is whether it came over TCP
+type handler func(q dnsmessage.Question, tcp bool) dnsmessage.Message
+
+// stub is an authoritative name server on a loopback address, answering
+// over UDP and TCP
+type stub struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	queries int32
+}
+
+// newStub starts a stub on ip at port, a free one when port is "0", and
+// returns it with the port it got
+func newStub(t *testing.T, ip, port string, h handler) (*stub, string) {
+	udp, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	_, port, _ = net.SplitHostPort(udp.LocalAddr().String())
+	tcp, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		udp.Close()
+		t.Fatalf("listen tcp: %v", err)
+	}
+	s := &stub{udp: udp, tcp: tcp}
+	t.Cleanup(s.close)
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.answer(buf[:n], h, false); resp != nil {
+				udp.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveTCP(conn, h)
+		}
+	}()
+
+	return s, port
+}
+
+func (s *stub) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *stub) serveTCP(conn net.Conn, h handler) {
+	defer conn.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	resp := s.answer(buf, h, true)
+	if resp == nil {
+		return
+	}
+	msg := make([]byte, 2+len(resp))
+	binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+	copy(msg[2:], resp)
+	conn.Write(msg)
+}
+
+// answer unpacks a query and packs the handler's response to it
+func (s *stub) answer(b []byte, h handler, tcp bool) []byte {
+	atomic.AddInt32(&s.queries, 1)
+	var query dnsmessage.Message
+	if err := query.Unpack(b); err != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	resp := h(query.Questions[0], tcp)
+	resp.ID = query.ID
+	resp.Response = true
+	resp.Questions = query.Questions
+	ret, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return ret
+}
+
+func mustName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(fqdn(name))
+}
+
+func header(name string, qtype dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name: mustName(name), Type: qtype, Class: dnsmessage.ClassINET, TTL: 300,
+	}
+}
+
+func aRecord(name, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypeA),
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func cnameRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypeCNAME),
+		Body:   &dnsmessage.CNAMEResource{CNAME: mustName(target)},
+	}
+}
+
+func nsRecord(zone, ns string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(zone, dnsmessage.TypeNS),
+		Body:   &dnsmessage.NSResource{NS: mustName(ns)},
+	}
+}
+
+// authoritative answers with the A records in addrs for their names and
+// nothing for anything else
+func authoritative(addrs map[string]string) handler {
+	return func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		resp := dnsmessage.Message{
+			Header: dnsmessage.Header{Authoritative: true},
+		}
+		ip, ok := addrs[strings.TrimSuffix(q.Name.String(), ".")]
+		if ok && q.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{aRecord(q.Name.String(), ip)}
+		}
+
+		return resp
+	}
+}
+
+// refer answers every question with a referral to ns for zone, with glue
+// when there is any
+func refer(zone, ns, glue string) handler {
+	return func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		resp := dnsmessage.Message{
+			Authorities: []dnsmessage.Resource{nsRecord(zone, ns)},
+		}
+		if len(glue) > 0 {
+			resp.Additionals = []dnsmessage.Resource{aRecord(ns, glue)}
+		}
+
+		return resp
+	}
+}
+
+// lookups returns a LookupHost answering from hosts and counting its calls
+func lookups(hosts map[string]string, calls *int32) func(context.Context, string) ([]net.IP, error) {
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(calls, 1)
+		ip, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+}
+
+func newTestResolver(port string) *Resolver {
+	r := New()
+	r.Port = port
+	r.Timeout = time.Second
+	r.LookupHost = func(ctx context.Context, host string) ([]net.IP, error) {
+		return nil, errors.New("unexpected lookup of " + host)
+	}
+	// nothing listens there, tests that resolve from the roots set their own
+	r.Roots = []string{"127.0.0.99"}
+
+	return r
+}
+
+func TestReferralWithGlue(t *testing.T) {
+	_, port := newStub(t, "127.0.0.1", "0", refer("example.com", "ns.example.com", "127.0.0.2"))
+	newStub(t, "127.0.0.2", port, authoritative(map[string]string{"example.com": "192.0.2.1"}))
+	r := newTestResolver(port)
+
+	ans, err := r.ResolveFrom(context.Background(), []string{"127.0.0.1"}, "example.com")
+	if err != nil {
+		t.Fatalf("ResolveFrom: %v", err)
+	}
+	if len(ans.IPs) != 1 || !ans.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("IPs = %v, want [192.0.2.1]", ans.IPs)
+	}
+	if ans.NS != "ns.example.com" || ans.Server != "127.0.0.2" {
+		t.Errorf("answered by %s (%s), want ns.example.com (127.0.0.2)", ans.NS, ans.Server)
+	}
+}
+
+func TestReferralWithoutGlue(t *testing.T) {
+	_, port := newStub(t, "127.0.0.1", "0", refer("example.com", "ns.example.net", ""))
+	newStub(t, "127.0.0.2", port, authoritative(map[string]string{"example.com": "192.0.2.1"}))
+	r := newTestResolver(port)
+	var calls int32
+	r.LookupHost = lookups(map[string]string{"ns.example.net": "127.0.0.2"}, &calls)
+
+	ans, err := r.ResolveFrom(context.Background(), []string{"127.0.0.1"}, "example.com")
+	if err != nil {
+		t.Fatalf("ResolveFrom: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("LookupHost called %d times, want 1", calls)
+	}
+	if len(ans.IPs) != 1 || !ans.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("IPs = %v, want [192.0.2.1]", ans.IPs)
+	}
+	if ans.NS != "ns.example.net" {
+		t.Errorf("NS = %s, want ns.example.net", ans.NS)
+	}
+}
+
+// cnameTo answers name with the chain of CNAMEs through targets, and the
+// addresses of the last target when it has any in addrs, all in one response.
+// Anything else is refused, as a server that isn't authoritative for it would.
+func cnameTo(addrs map[string]string, name string, targets ...string) handler {
+	return func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if !strings.EqualFold(q.Name.String(), fqdn(name)) {
+			return dnsmessage.Message{
+				Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused},
+			}
+		}
+
+		resp := dnsmessage.Message{
+			Header: dnsmessage.Header{Authoritative: true},
+		}
+		owner := name
+		for _, target := range targets {
+			resp.Answers = append(resp.Answers, cnameRecord(owner, target))
+			owner = target
+		}
+		if ip, ok := addrs[owner]; ok && q.Type == dnsmessage.TypeA {
+			resp.Answers = append(resp.Answers, aRecord(owner, ip))
+		}
+
+		return resp
+	}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	_, port := newStub(t, "127.0.0.1", "0", cnameTo(
+		map[string]string{"b.example.com": "192.0.2.1"},
+		"www.example.com", "a.example.com", "b.example.com",
+	))
+	r := newTestResolver(port)
+
+	ans, err := r.ResolveFrom(context.Background(), []string{"127.0.0.1"}, "www.example.com")
+	if err != nil {
+		t.Fatalf("ResolveFrom: %v", err)
+	}
+	if want := []string{"a.example.com", "b.example.com"}; !reflect.DeepEqual(ans.CNAMEs, want) {
+		t.Errorf("CNAMEs = %v, want %v", ans.CNAMEs, want)
+	}
+	if len(ans.IPs) != 1 || !ans.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("IPs = %v, want [192.0.2.1]", ans.IPs)
+	}
+}
+
+// TestCNAMEOutOfZone checks a target the server has no answer for is
+// resolved iteratively from the roots, not with LookupHost
+func TestCNAMEOutOfZone(t *testing.T) {
+	_, port := newStub(t, "127.0.0.1", "0", cnameTo(
+		nil, "www.example.com", "a.example.com", "cdn.example.net",
+	))
+	roots, _ := newStub(t, "127.0.0.3", port, refer("example.net", "ns.example.net", "127.0.0.4"))
+	newStub(t, "127.0.0.4", port, authoritative(map[string]string{"cdn.example.net": "198.51.100.1"}))
+	r := newTestResolver(port)
+	r.Roots = []string{"127.0.0.3"}
+
+	ans, err := r.ResolveFrom(context.Background(), []string{"127.0.0.1"}, "www.example.com")
+	if err != nil {
+		t.Fatalf("ResolveFrom: %v", err)
+	}
+	if want := []string{"a.example.com", "cdn.example.net"}; !reflect.DeepEqual(ans.CNAMEs, want) {
+		t.Errorf("CNAMEs = %v, want %v", ans.CNAMEs, want)
+	}
+	if len(ans.IPs) != 1 || !ans.IPs[0].Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("IPs = %v, want [198.51.100.1]", ans.IPs)
+	}
+	if ans.NS != "ns.example.net" || ans.Server != "127.0.0.4" {
+		t.Errorf("answered by %s (%s), want ns.example.net (127.0.0.4)", ans.NS, ans.Server)
+	}
+	if atomic.LoadInt32(&roots.queries) == 0 {
+		t.Errorf("the roots weren't asked")
+	}
+}
+
+// TestFailedCNAMELeavesNothing checks a CNAME that couldn't be followed at
+// one server isn't in the answer another server gave
+func TestFailedCNAMELeavesNothing(t *testing.T) {
+	_, port := newStub(t, "127.0.0.1", "0", cnameTo(nil, "www.example.com", "gone.example.net"))
+	newStub(t, "127.0.0.2", port, authoritative(map[string]string{"www.example.com": "192.0.2.1"}))
+	r := newTestResolver(port)
+
+	ans, err := r.ResolveFrom(
+		context.Background(), []string{"127.0.0.1", "127.0.0.2"}, "www.example.com",
+	)
+	if err != nil {
+		t.Fatalf("ResolveFrom: %v", err)
+	}
+	if len(ans.CNAMEs) != 0 {
+		t.Errorf("CNAMEs = %v, want none", ans.CNAMEs)
+	}
+	if len(ans.IPs) != 1 || !ans.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("IPs = %v, want [192.0.2.1]", ans.IPs)
+	}
+	if ans.Server != "127.0.0.2" {
+		t.Errorf("Server = %s, want 127.0.0.2", ans.Server)
+	}
+}
+
+func TestTruncatedRetriedOverTCP(t *testing.T) {
+	answer := authoritative(map[string]string{"example.com": "192.0.2.1"})
+	_, port := newStub(t, "127.0.0.1", "0", func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if !tcp {
+			return dnsmessage.Message{
+				Header: dnsmessage.Header{Authoritative: true, Truncated: true},
+			}
+		}
+
+		return answer(q, tcp)
+	})
+	r := newTestResolver(port)
+
+	ans, err := r.ResolveFrom(context.Background(), []string{"127.0.0.1"}, "example.com")
+	if err != nil {
+		t.Fatalf("ResolveFrom: %v", err)
+	}
+	if len(ans.IPs) != 1 || !ans.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("IPs = %v, want [192.0.2.1]", ans.IPs)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	// every referral leads back to the same server
+	s, port := newStub(t, "127.0.0.1", "0", refer("example.com", "ns.example.com", "127.0.0.1"))
+	r := newTestResolver(port)
+	r.MaxDepth = 3
+
+	_, err := r.ResolveFrom(context.Background(), []string{"127.0.0.1"}, "example.com")
+	if err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Fatalf("ResolveFrom err = %v, want it to give up", err)
+	}
+	// A and AAAA at each of the first server and 3 referrals
+	if n := atomic.LoadInt32(&s.queries); n != 8 {
+		t.Errorf("stub got %d queries, want 8", n)
+	}
+}
+
+// TestContextDeadline checks the context's deadline is kept when there is
+// no Timeout
+func TestContextDeadline(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	r := newTestResolver(port)
+	r.Timeout = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = r.Query(ctx, net.ParseIP("127.0.0.1"), "example.com", dnsmessage.TypeA); err == nil {
+		t.Fatalf("Query of a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Query took %v, want about the context's 200ms", elapsed)
+	}
+}
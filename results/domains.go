@@ -0,0 +1,206 @@
+package results
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DomainResults is what querylist knows about a domain: its Tranco rank and
+// its place on any other popularity lists, whether it resolves and supports
+// TLS over each IP version and whether Citizen Lab lists it. querylist writes
+// one per line to its full details file.
+type DomainResults struct {
+	Domain string `json:"domain,omitempty"`
+	Rank   int    `json:"tranco_rank,omitempty"`
+	// Rankings are the domain's ranks on the lists given to querylist with
+	// --ranking, one per list it is on
+	Rankings []Ranking `json:"rankings,omitempty"`
+	HasV4    bool      `json:"has_v4"`
+	HasV6    bool      `json:"has_v6"`
+	// V4DNS and V6DNS are the answers to the A and AAAA lookups, usable as
+	// control answers for the domain
+	V4DNS                 DNSLookup `json:"v4_dns"`
+	V6DNS                 DNSLookup `json:"v6_dns"`
+	HasV4TLS              bool      `json:"has_v4_tls"`
+	HasV6TLS              bool      `json:"has_v6_tls"`
+	CitizenLabGlobalList  bool      `json:"citizen_lab_global_list"`
+	CitizenLabCountryList []string  `json:"citizen_lab_country_list"`
+	// CitizenLabCategories are the distinct category codes (NEWS, HUMR, ...)
+	// the domain is listed under across all lists
+	CitizenLabCategories []string          `json:"citizen_lab_categories,omitempty"`
+	CitizenLabEntries    []CitizenLabEntry `json:"citizen_lab_entries,omitempty"`
+	// V4TLS and V6TLS are the banner grabbed addresses of each IP version
+	// and whether each had a valid certificate for the domain. HasV4TLS and
+	// HasV6TLS are these summaries under querylist's --tls_policy.
+	V4TLS TLSSummary `json:"v4_tls"`
+	V6TLS TLSSummary `json:"v6_tls"`
+}
+
+// Ranking is a domain's rank on one popularity list and where that list came
+// from. Source names the list (tranco, umbrella, crux-br, ...), ListID is the
+// provider's identifier for it (e.g. a Tranco list ID), Date is the day it was
+// made and Country is set for country lists. CrUX ranks are buckets (1000,
+// 5000, 10000, ...) rather than exact places.
+type Ranking struct {
+	Source  string `json:"source"`
+	Rank    int    `json:"rank"`
+	ListID  string `json:"list_id,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// RankOn returns the domain's rank on the list named source, false when it
+// isn't on that list
+func (dr *DomainResults) RankOn(source string) (int, bool) {
+	for _, r := range dr.Rankings {
+		if strings.EqualFold(r.Source, source) {
+			return r.Rank, true
+		}
+	}
+
+	return 0, false
+}
+
+// TLSAddress is whether an address had a valid certificate for a domain,
+// Reason is "valid" or why it wasn't (see the zgrabtls package)
+type TLSAddress struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
+
+// DNSAnswer is one record of a lookup, Answer is the address or CNAME target
+type DNSAnswer struct {
+	Name   string `json:"name"`
+	Answer string `json:"answer"`
+	TTL    uint32 `json:"ttl"`
+}
+
+// DNSLookup is what a ZDNS lookup of a domain got back and from which resolver
+type DNSLookup struct {
+	Resolver  string      `json:"resolver,omitempty"`
+	Status    string      `json:"status,omitempty"`
+	Addresses []DNSAnswer `json:"addresses,omitempty"`
+	// CNAMEs is the chain from the domain to the name holding the addresses,
+	// in the order it was answered
+	CNAMEs []DNSAnswer `json:"cnames,omitempty"`
+}
+
+// IPs returns the addresses of the lookup that parse
+func (l DNSLookup) IPs() []net.IP {
+	var ret []net.IP
+	for _, a := range l.Addresses {
+		if ip := net.ParseIP(a.Answer); ip != nil {
+			ret = append(ret, ip)
+		}
+	}
+
+	return ret
+}
+
+// TLSSummary counts how many of a domain's addresses of one IP version had a
+// valid certificate, so domains where only some do aren't lost
+type TLSSummary struct {
+	Valid     int          `json:"valid"`
+	Invalid   int          `json:"invalid"`
+	Addresses []TLSAddress `json:"addresses,omitempty"`
+}
+
+// Partial returns true when some, but not all, addresses had a valid
+// certificate
+func (s TLSSummary) Partial() bool {
+	return s.Valid > 0 && s.Invalid > 0
+}
+
+// Supports returns true when the addresses count as supporting TLS under p,
+// never when no address was grabbed
+func (s TLSSummary) Supports(p TLSPolicy) bool {
+	total := s.Valid + s.Invalid
+	if total == 0 {
+		return false
+	}
+	if p.Any {
+		return s.Valid > 0
+	}
+
+	return float64(s.Valid)/float64(total) >= p.Fraction
+}
+
+// TLSPolicy decides when a domain supports TLS: when any of its addresses has
+// a valid certificate, or when at least Fraction of them do
+type TLSPolicy struct {
+	Any      bool
+	Fraction float64
+}
+
+// TLSPolicyAll needs every address to have a valid certificate
+var TLSPolicyAll = TLSPolicy{Fraction: 1}
+
+// ParseTLSPolicy parses "all", "any" or a fraction such as "0.5"
+func ParseTLSPolicy(s string) (TLSPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "all":
+		return TLSPolicyAll, nil
+	case "any":
+		return TLSPolicy{Any: true}, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 || f > 1 {
+		return TLSPolicy{}, fmt.Errorf(
+			"TLS policy must be all, any or a fraction in (0, 1], got %q", s,
+		)
+	}
+
+	return TLSPolicy{Fraction: f}, nil
+}
+
+func (p TLSPolicy) String() string {
+	switch {
+	case p.Any:
+		return "any"
+	case p.Fraction >= 1:
+		return "all"
+	}
+
+	return strconv.FormatFloat(p.Fraction, 'f', -1, 64)
+}
+
+type DomainResultsMap map[string]*DomainResults
+
+// CitizenLabEntry is one row of a Citizen Lab test list, List is the country
+// code of the list it came from (or GLOBAL)
+type CitizenLabEntry struct {
+	List                string `json:"list"`
+	URL                 string `json:"url"`
+	CategoryCode        string `json:"category_code"`
+	CategoryDescription string `json:"category_description"`
+	DateAdded           string `json:"date_added"`
+	Source              string `json:"source,omitempty"`
+}
+
+// ReadDomainResults reads a querylist full details file, one DomainResults
+// per line, in the order they appear.
+func ReadDomainResults(r io.Reader) ([]*DomainResults, error) {
+	var ret []*DomainResults
+	scanner := bufio.NewScanner(r)
+	// Citizen Lab entries can make a line long
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		dr := new(DomainResults)
+		if err := json.Unmarshal(scanner.Bytes(), dr); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ret = append(ret, dr)
+	}
+
+	return ret, scanner.Err()
+}
@@ -0,0 +1,130 @@
+package results
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Kinds of resolver in a resolver list
+const (
+	// ResolverKindInfra is an address of a popular domain's servers, looked
+	// up from inside the country
+	ResolverKindInfra = "in-country-infra"
+	// ResolverKindOpen is an open resolver in the country
+	ResolverKindOpen = "open"
+	// ResolverKindISP is an ISP's resolver in the country
+	ResolverKindISP = "isp"
+)
+
+// Verdicts of resolverlist validating a resolver
+const (
+	VerdictValid = "valid"
+	// VerdictDead never answered a probe
+	VerdictDead = "dead"
+	// VerdictNotRecursive answered without recursion available or refused
+	// the recursive queries
+	VerdictNotRecursive = "not-recursive"
+	// VerdictIncorrect gave answers inconsistent with the control answers
+	VerdictIncorrect = "incorrect"
+	// VerdictSlow answered, but slower than -max_rtt
+	VerdictSlow = "slow"
+	// VerdictUnstable missed some probes, or answered a name differently
+	// from one round to the next
+	VerdictUnstable = "unstable"
+)
+
+// Classifications of a resolver by determineDNSCensorship
+const (
+	ClassificationClean      = "clean"
+	ClassificationCensoring  = "censoring"
+	ClassificationUnreliable = "unreliable"
+)
+
+// Resolver is one address of the resolver list resolverlist writes, one per
+// line, for whiteboard to send queries to
+type Resolver struct {
+	IP string `json:"ip"`
+	// PairIP is the address of the other IP version of the same resolver,
+	// only known for open and ISP resolvers
+	PairIP string `json:"pair_ip,omitempty"`
+	ASN    uint   `json:"asn,omitempty"`
+	Org    string `json:"org,omitempty"`
+	// Country and City are where GeoIP puts the address
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	RDNS    string `json:"rdns,omitempty"`
+	// Source is the domain an in-country-infra address was found through, or
+	// the list an open or ISP resolver came from
+	Source string `json:"source,omitempty"`
+	// DiscoveryDate is the day the address was found (YYYY-MM-DD)
+	DiscoveryDate string `json:"discovery_date,omitempty"`
+	Kind          string `json:"kind"`
+}
+
+// Label is what the old text resolver lists had in their second column and
+// what whiteboardresults keeps as a QueryResult's ResolverType: the source
+// domain for in-country-infra addresses and <country_code>_Resolver for open
+// resolvers (<country_code>_ISP_Resolver for ISP ones)
+func (r Resolver) Label() string {
+	switch r.Kind {
+	case ResolverKindOpen:
+		return r.Country + "_Resolver"
+	case ResolverKindISP:
+		return r.Country + "_ISP_Resolver"
+	}
+
+	return r.Source
+}
+
+// parseResolverText reads a line of the old text format, "<ip> <label>"
+func parseResolverText(line string) (Resolver, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Resolver{}, fmt.Errorf("expected <ip> <label>, got %q", line)
+	}
+	ret := Resolver{IP: fields[0], Source: fields[1], Kind: ResolverKindInfra}
+	switch {
+	case strings.HasSuffix(fields[1], "_ISP_Resolver"):
+		ret.Kind = ResolverKindISP
+		ret.Country = strings.TrimSuffix(fields[1], "_ISP_Resolver")
+		ret.Source = ""
+	case strings.HasSuffix(fields[1], "_Resolver"):
+		ret.Kind = ResolverKindOpen
+		ret.Country = strings.TrimSuffix(fields[1], "_Resolver")
+		ret.Source = ""
+	}
+
+	return ret, nil
+}
+
+// ReadResolvers reads a resolver list, either a Resolver as JSON on each line
+// or the older "<ip> <label>" lines, in the order they appear
+func ReadResolvers(r io.Reader) ([]Resolver, error) {
+	var ret []Resolver
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var res Resolver
+		var err error
+		if b[0] == '{' {
+			err = json.Unmarshal(b, &res)
+		} else {
+			res, err = parseResolverText(string(b))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ret = append(ret, res)
+	}
+
+	return ret, scanner.Err()
+}
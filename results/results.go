@@ -1,5 +1,10 @@
 package results
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 //Result stores actual result of query, stored in abuf, needs to be decoded.
 type Result struct {
 	Rt      float64 `json:"rt,omitempty"`
@@ -66,4 +71,66 @@ type QueryResult struct {
 	ResolverIP   string              `json:"resolver_ip"`
 	ResolverType string              `json:"resolver_type"`
 	Queries      map[string][]string `json:"queries,omitempty"`
+	// RCodes is the response code of the response each answer in Queries
+	// came from, RCodes[name][i] for Queries[name][i]
+	RCodes map[string]RCodeList `json:"rcodes,omitempty"`
+	// Resolver is the resolver list's record of ResolverIP
+	Resolver *Resolver `json:"resolver,omitempty"`
+}
+
+// RCodeList is the response codes for one name's answers. Results written
+// before there was one per answer have a single response code for the name,
+// which reads as a list of one.
+type RCodeList []string
+
+// UnmarshalJSON reads either a list of response codes or a single one
+func (l *RCodeList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*l = RCodeList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*l = list
+
+	return nil
+}
+
+// Response is the answers to a name that came with one response code
+type Response struct {
+	RCode   string
+	Answers []string
+}
+
+// Responses groups name's answers by the response code they came with, in
+// the order each code first appears, so each can be classified on its own.
+// Answers recorded without a code (a probe's error) are a group of their
+// own, and results with a single code for the name give it to every answer.
+func (qr QueryResult) Responses(name string) []Response {
+	answers := qr.Queries[name]
+	rcodes := qr.RCodes[name]
+	var ret []Response
+	index := make(map[string]int)
+	for i, answer := range answers {
+		var rcode string
+		switch {
+		case len(rcodes) == 1:
+			rcode = rcodes[0]
+		case i < len(rcodes):
+			rcode = rcodes[i]
+		}
+		rcode = strings.TrimSpace(rcode)
+		j, ok := index[rcode]
+		if !ok {
+			j = len(ret)
+			index[rcode] = j
+			ret = append(ret, Response{RCode: rcode})
+		}
+		ret[j].Answers = append(ret[j].Answers, answer)
+	}
+
+	return ret
 }
@@ -0,0 +1,71 @@
+package results
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []string
+		rcodes  RCodeList
+		want    []Response
+	}{
+		{
+			name:    "addresses and a SERVFAIL retry",
+			queries: []string{"192.0.2.1", "192.0.2.2", "No Answer or Authority Given"},
+			rcodes:  RCodeList{"No Error", "No Error", "Server Failure"},
+			want: []Response{
+				{RCode: "No Error", Answers: []string{"192.0.2.1", "192.0.2.2"}},
+				{RCode: "Server Failure", Answers: []string{"No Answer or Authority Given"}},
+			},
+		},
+		{
+			name:    "probe error without a code",
+			queries: []string{"192.0.2.1", "timeout: 5000"},
+			rcodes:  RCodeList{"No Error", ""},
+			want: []Response{
+				{RCode: "No Error", Answers: []string{"192.0.2.1"}},
+				{Answers: []string{"timeout: 5000"}},
+			},
+		},
+		{
+			name:    "single code from older results",
+			queries: []string{"192.0.2.1", "192.0.2.2"},
+			rcodes:  RCodeList{"No Error"},
+			want: []Response{
+				{RCode: "No Error", Answers: []string{"192.0.2.1", "192.0.2.2"}},
+			},
+		},
+		{
+			name:    "no codes",
+			queries: []string{"192.0.2.1"},
+			want:    []Response{{Answers: []string{"192.0.2.1"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			qr := QueryResult{
+				Queries: map[string][]string{"example.com": test.queries},
+				RCodes:  map[string]RCodeList{"example.com": test.rcodes},
+			}
+			if got := qr.Responses("example.com"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Responses = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRCodeListReadsSingleCode(t *testing.T) {
+	var qr QueryResult
+	err := json.Unmarshal([]byte(`{"rcodes":{"example.com":"No Error"}}`), &qr)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(qr.RCodes["example.com"], RCodeList{"No Error"}) {
+		t.Errorf("RCodes = %v, want [No Error]", qr.RCodes)
+	}
+}
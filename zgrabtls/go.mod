@@ -0,0 +1,3 @@
+module github.com/timartiny/RipeProbe/zgrabtls
+
+go 1.16
@@ -0,0 +1,227 @@
+package zgrabtls
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Reasons an address does or doesn't have a valid certificate for a domain
+const (
+	ReasonValid = "valid"
+	// ReasonNoHandshake is a grab without a successful handshake or without
+	// server certificates in it
+	ReasonNoHandshake = "no-handshake"
+	// ReasonMalformed is a grab whose certificates or timestamp couldn't be
+	// decoded
+	ReasonMalformed        = "malformed"
+	ReasonNameMismatch     = "name-mismatch"
+	ReasonExpired          = "expired"
+	ReasonUnknownAuthority = "unknown-authority"
+	// ReasonInvalid is any other chain verification failure
+	ReasonInvalid = "invalid"
+)
+
+// reasonRank orders reasons from the most to the least informative, when an
+// address was grabbed more than once (e.g. again after a timeout) the best
+// result is kept
+var reasonRank = map[string]int{
+	ReasonValid:            0,
+	ReasonNameMismatch:     1,
+	ReasonExpired:          1,
+	ReasonUnknownAuthority: 1,
+	ReasonInvalid:          1,
+	ReasonMalformed:        2,
+	ReasonNoHandshake:      3,
+}
+
+// Better returns true when reason a says more about an address than reason b
+func Better(a, b string) bool {
+	ra, ok := reasonRank[a]
+	if !ok {
+		ra = len(reasonRank)
+	}
+	rb, ok := reasonRank[b]
+	if !ok {
+		rb = len(reasonRank)
+	}
+
+	return ra < rb
+}
+
+// Certificate is a certificate as ZGrab2 writes it, only the DER (base64
+// encoded) is used
+type Certificate struct {
+	Raw string `json:"raw"`
+}
+
+// ServerCertificates are the leaf and the chain the server sent
+type ServerCertificates struct {
+	Certificate *Certificate  `json:"certificate"`
+	Chain       []Certificate `json:"chain"`
+}
+
+// HandshakeLog is the part of the handshake that is needed to verify the
+// server's certificate
+type HandshakeLog struct {
+	ServerCertificates *ServerCertificates `json:"server_certificates"`
+}
+
+// TLSResult is the result of ZGrab2's tls module
+type TLSResult struct {
+	HandshakeLog *HandshakeLog `json:"handshake_log"`
+}
+
+// ScanResult is one module's status and result in a grab
+type ScanResult struct {
+	Status    string     `json:"status"`
+	Protocol  string     `json:"protocol"`
+	Timestamp string     `json:"timestamp"`
+	Error     string     `json:"error,omitempty"`
+	Result    *TLSResult `json:"result"`
+}
+
+// Grab is one line of ZGrab2 output for the tls module. Every part of the
+// result can be missing, so all of them are pointers.
+type Grab struct {
+	IP     string `json:"ip"`
+	Domain string `json:"domain"`
+	Data   struct {
+		TLS *ScanResult `json:"tls"`
+	} `json:"data"`
+}
+
+// Decode decodes one line of ZGrab2 output
+func Decode(line []byte) (*Grab, error) {
+	g := new(Grab)
+	if err := json.Unmarshal(line, g); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Result is whether an address has a valid certificate for a domain and, when
+// it doesn't, why not
+type Result struct {
+	IP     string `json:"ip"`
+	Domain string `json:"domain"`
+	Reason string `json:"reason"`
+	// Err is the underlying error, for logging
+	Err error `json:"-"`
+}
+
+// Valid returns true when the certificate verified
+func (r Result) Valid() bool {
+	return r.Reason == ReasonValid
+}
+
+// Verifier verifies the certificates in grabs against Roots, or the system
+// roots when Roots is nil. Certificates are verified at the time of the grab.
+type Verifier struct {
+	Roots *x509.CertPool
+}
+
+// LoadRoots reads a PEM bundle of root certificates, such as a snapshot of
+// Mozilla's root store from around the time of a scan
+func LoadRoots(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// decodeCertificate parses a certificate from a grab
+func decodeCertificate(c Certificate) (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(c.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// Verify decides whether the grab got a valid certificate for its domain
+func (v *Verifier) Verify(g *Grab) Result {
+	ret := Result{IP: g.IP, Domain: g.Domain, Reason: ReasonNoHandshake}
+	scan := g.Data.TLS
+	if scan == nil || scan.Status != "success" || scan.Result == nil ||
+		scan.Result.HandshakeLog == nil ||
+		scan.Result.HandshakeLog.ServerCertificates == nil ||
+		scan.Result.HandshakeLog.ServerCertificates.Certificate == nil {
+		if scan != nil && len(scan.Error) > 0 {
+			ret.Err = errors.New(scan.Error)
+		}
+		return ret
+	}
+	certs := scan.Result.HandshakeLog.ServerCertificates
+
+	ret.Reason = ReasonMalformed
+	timestamp, err := time.Parse(time.RFC3339, scan.Timestamp)
+	if err != nil {
+		ret.Err = fmt.Errorf("parsing timestamp %q: %v", scan.Timestamp, err)
+		return ret
+	}
+	leaf, err := decodeCertificate(*certs.Certificate)
+	if err != nil {
+		ret.Err = fmt.Errorf("leaf certificate: %v", err)
+		return ret
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs.Chain {
+		cert, err := decodeCertificate(c)
+		if err != nil {
+			// a broken chain certificate might not be needed, verification
+			// decides
+			continue
+		}
+		intermediates.AddCert(cert)
+	}
+
+	if err = leaf.VerifyHostname(g.Domain); err != nil {
+		ret.Reason = ReasonNameMismatch
+		ret.Err = err
+		return ret
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       g.Domain,
+		CurrentTime:   timestamp,
+		Intermediates: intermediates,
+		Roots:         v.Roots,
+	})
+	ret.Err = err
+	ret.Reason = reason(err)
+
+	return ret
+}
+
+// reason maps a verification error to a Reason
+func reason(err error) string {
+	if err == nil {
+		return ReasonValid
+	}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+		return ReasonExpired
+	}
+	var unknown x509.UnknownAuthorityError
+	if errors.As(err, &unknown) {
+		return ReasonUnknownAuthority
+	}
+	var hostname x509.HostnameError
+	if errors.As(err, &hostname) {
+		return ReasonNameMismatch
+	}
+
+	return ReasonInvalid
+}
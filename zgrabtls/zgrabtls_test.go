@@ -0,0 +1,150 @@
+package zgrabtls
+
+import (
+	"bufio"
+	"crypto/x509"
+	"os"
+	"testing"
+)
+
+// readGrabs decodes testdata/grabs.jsonl, ZGrab2 tls module output for
+// certificates issued by testdata/roots.pem through an intermediate. The leaf
+// is for example.com and www.example.com, valid during 2021.
+func readGrabs(t *testing.T) map[string]*Grab {
+	f, err := os.Open("testdata/grabs.jsonl")
+	if err != nil {
+		t.Fatalf("opening grabs: %v", err)
+	}
+	defer f.Close()
+
+	ret := make(map[string]*Grab)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		g, err := Decode(scanner.Bytes())
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		ret[g.IP] = g
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatalf("reading grabs: %v", err)
+	}
+
+	return ret
+}
+
+func TestDecode(t *testing.T) {
+	grabs := readGrabs(t)
+	if len(grabs) != 10 {
+		t.Fatalf("decoded %d grabs, want 10", len(grabs))
+	}
+
+	g := grabs["192.0.2.1"]
+	if g.Domain != "example.com" || g.Data.TLS == nil {
+		t.Fatalf("grab %+v has no domain or tls result", g)
+	}
+	tls := g.Data.TLS
+	if tls.Status != "success" || tls.Protocol != "tls" ||
+		tls.Timestamp != "2021-09-01T12:00:00Z" {
+		t.Errorf("scan result %+v", tls)
+	}
+	certs := tls.Result.HandshakeLog.ServerCertificates
+	if certs.Certificate == nil || len(certs.Certificate.Raw) == 0 || len(certs.Chain) != 1 {
+		t.Errorf("want a leaf and one chain certificate, got %+v", certs)
+	}
+
+	failed := grabs["192.0.2.8"].Data.TLS
+	if failed.Status != "connection-timeout" || failed.Result != nil ||
+		failed.Error != "dial tcp 192.0.2.8:443: i/o timeout" {
+		t.Errorf("failed scan result %+v", failed)
+	}
+
+	if _, err := Decode([]byte(`{"ip":"192.0.2.1","data":`)); err == nil {
+		t.Errorf("a truncated line decoded")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	roots, err := LoadRoots("testdata/roots.pem")
+	if err != nil {
+		t.Fatalf("LoadRoots: %v", err)
+	}
+	v := &Verifier{Roots: roots}
+	grabs := readGrabs(t)
+
+	tests := []struct {
+		name   string
+		ip     string
+		reason string
+		// err is whether the result should carry the underlying error
+		err bool
+	}{
+		{"valid", "192.0.2.1", ReasonValid, false},
+		{"valid with a timezone offset", "192.0.2.2", ReasonValid, false},
+		{"expired at the time of the grab", "192.0.2.3", ReasonExpired, true},
+		{"hostname mismatch", "192.0.2.4", ReasonNameMismatch, true},
+		{"self signed", "192.0.2.5", ReasonUnknownAuthority, true},
+		{"missing intermediate", "192.0.2.6", ReasonUnknownAuthority, true},
+		{"handshake failure", "192.0.2.7", ReasonNoHandshake, true},
+		{"connection timeout", "192.0.2.8", ReasonNoHandshake, true},
+		{"no certificates before timeout", "192.0.2.9", ReasonNoHandshake, true},
+		{"certificate not base64", "192.0.2.10", ReasonMalformed, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, ok := grabs[test.ip]
+			if !ok {
+				t.Fatalf("no grab of %s", test.ip)
+			}
+			r := v.Verify(g)
+			if r.IP != test.ip || r.Domain != g.Domain {
+				t.Errorf("result for %s %s, want %s %s", r.IP, r.Domain, test.ip, g.Domain)
+			}
+			if r.Reason != test.reason {
+				t.Errorf("Reason = %s (%v), want %s", r.Reason, r.Err, test.reason)
+			}
+			if (r.Err != nil) != test.err {
+				t.Errorf("Err = %v, want an error: %v", r.Err, test.err)
+			}
+			if r.Valid() != (test.reason == ReasonValid) {
+				t.Errorf("Valid() = %v for %s", r.Valid(), r.Reason)
+			}
+		})
+	}
+}
+
+// TestUntrustedRoot checks the chain isn't trusted without its root
+func TestUntrustedRoot(t *testing.T) {
+	empty, err := LoadRoots("testdata/grabs.jsonl")
+	if err == nil || empty != nil {
+		t.Errorf("LoadRoots of a file without certificates succeeded")
+	}
+
+	v := &Verifier{Roots: x509.NewCertPool()}
+	r := v.Verify(readGrabs(t)["192.0.2.1"])
+	if r.Reason != ReasonUnknownAuthority {
+		t.Errorf("Reason = %s (%v), want %s", r.Reason, r.Err, ReasonUnknownAuthority)
+	}
+}
+
+func TestBetter(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{ReasonValid, ReasonExpired, true},
+		{ReasonExpired, ReasonValid, false},
+		{ReasonNameMismatch, ReasonMalformed, true},
+		{ReasonMalformed, ReasonNoHandshake, true},
+		{ReasonNoHandshake, "unknown", true},
+		{ReasonExpired, ReasonUnknownAuthority, false},
+	}
+
+	for _, test := range tests {
+		if got := Better(test.a, test.b); got != test.want {
+			t.Errorf("Better(%s, %s) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}